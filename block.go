@@ -1,14 +1,68 @@
 package dbft
 
 import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/txhsl/dbft-anti-mev/util/message"
 )
 
+// ErrTxNotFound is returned for a transaction which is not committed
+var ErrTxNotFound = errors.New("transaction not found")
+
 type Block struct {
 	Header       *types.Header
-	Transactions []*types.Transaction
+	Transactions []*types.Transaction // executed carriers, decrypted transactions, then legacy transactions
 	Signature    []byte
+	CarrierNum   uint64        // the number of carriers at the beginning of the transactions
+	Links        []CarrierLink // carriers with a decrypted transaction in the block
+
+	KeyDecision *message.KeyDecision `rlp:"optional"` // the keys of the next epoch, in the last block of an epoch
+}
+
+// CarrierLink points from a carrier to the transaction decrypted from its
+// envelope, both are positions in the transactions of the block.
+type CarrierLink struct {
+	Carrier uint64
+	Inner   uint64
+}
+
+// extraHash commits to the carriers and links of a block and to its key
+// decision, the final header carries it in Extra, so that they are covered by
+// the block signature
+func extraHash(carrierNum uint64, links []CarrierLink, decision *message.KeyDecision) common.Hash {
+	fields := []any{carrierNum, links}
+	if decision != nil {
+		fields = append(fields, decision)
+	}
+	data, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		panic("failed to encode carrier links: " + err.Error())
+	}
+	return crypto.Keccak256Hash(data)
+}
+
+// decisionExtra is the Extra of a proposal header, which commits to the key
+// decision of the proposal, empty without one
+func decisionExtra(decision *message.KeyDecision) []byte {
+	if decision == nil {
+		return nil
+	}
+	data, err := rlp.EncodeToBytes(decision)
+	if err != nil {
+		panic("failed to encode key decision: " + err.Error())
+	}
+	return crypto.Keccak256(data)
+}
+
+// TxLocation is the position of a committed transaction.
+type TxLocation struct {
+	Height uint64
+	Index  uint64
 }
 
 // Hash implements Block interface. Hash returns unsealed block hash that doesn't
@@ -17,3 +71,85 @@ type Block struct {
 func (b *Block) Hash() util.Uint256 {
 	return util.Uint256(WorkerSealHash(b.Header))
 }
+
+// the number of latest blocks kept in memory, the older ones are read from
+// the store
+const blockWindow = 256
+
+// addBlock keeps a committed block and indexes it for lookups. With a store,
+// the block leaving the window is dropped from memory.
+func (n *Node) addBlock(height uint64, b *Block) {
+	n.blocks[height] = b
+	n.blockIndex[b.Header.Hash()] = height
+	for i, tx := range b.Transactions {
+		n.txIndex[tx.Hash()] = TxLocation{Height: height, Index: uint64(i)}
+	}
+	if n.store == nil || height <= blockWindow {
+		return
+	}
+	if old, ok := n.blocks[height-blockWindow]; ok {
+		delete(n.blocks, height-blockWindow)
+		delete(n.blockIndex, old.Header.Hash())
+		for _, tx := range old.Transactions {
+			delete(n.txIndex, tx.Hash())
+		}
+	}
+}
+
+// get a committed block, blocks not kept in memory are read from the store
+func (n *Node) GetBlock(height uint64) (*Block, error) {
+	if b, ok := n.blocks[height]; ok {
+		return b, nil
+	}
+	if n.store == nil || height > n.height {
+		return nil, ErrBlockNotFound
+	}
+	return n.store.Get(height)
+}
+
+// get a committed block and its height by the hash of its header
+func (n *Node) GetBlockByHash(hash common.Hash) (*Block, uint64, error) {
+	height, ok := n.blockIndex[hash]
+	if !ok {
+		if n.store == nil {
+			return nil, 0, ErrBlockNotFound
+		}
+		var err error
+		if height, err = n.store.BlockHeight(hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	b, err := n.GetBlock(height)
+	return b, height, err
+}
+
+// parentHash returns the header hash of the latest block, empty before the
+// first block
+func (n *Node) parentHash() common.Hash {
+	if b, ok := n.blocks[n.height]; ok {
+		return b.Header.Hash()
+	}
+	return common.Hash{}
+}
+
+// get a committed transaction and its position
+func (n *Node) GetTransaction(hash common.Hash) (*types.Transaction, TxLocation, error) {
+	loc, ok := n.txIndex[hash]
+	if !ok {
+		if n.store == nil {
+			return nil, TxLocation{}, ErrTxNotFound
+		}
+		var err error
+		if loc, err = n.store.TxLocation(hash); err != nil {
+			return nil, TxLocation{}, err
+		}
+	}
+	b, err := n.GetBlock(loc.Height)
+	if err != nil {
+		return nil, TxLocation{}, err
+	}
+	if loc.Index >= uint64(len(b.Transactions)) {
+		return nil, TxLocation{}, ErrTxNotFound
+	}
+	return b.Transactions[loc.Index], loc, nil
+}
@@ -0,0 +1,310 @@
+package dbft
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// A network can also be set up without a trusted party, the validators run
+// the DKG of dkg.go by exchanging files in three steps:
+//
+//  1. every validator generates its message signing key with JoinCeremony and
+//     publishes its participant file
+//  2. with the participant files of all validators, every validator deals with
+//     DealCeremony and publishes its deal file, the shares in it are encrypted
+//     to the signing keys of their owners and the file is signed by the dealer
+//  3. with the deal files of all validators, every validator gets its keystore
+//     with FinishCeremony, which also writes the network config, the same one
+//     for every validator
+//
+// Each validator works in its own directory and copies the files published by
+// the others into it.
+
+// participantJSON is the file a validator joins a ceremony with
+type participantJSON struct {
+	Index      byte   `json:"index"`
+	SigningKey string `json:"signingKey"`
+}
+
+// dealJSON is the deal of a validator in a ceremony
+type dealJSON struct {
+	Index       byte            `json:"index"`
+	Threshold   int             `json:"threshold"`
+	Commitments []string        `json:"commitments"`
+	Shares      []dealShareJSON `json:"shares"`
+	Signature   string          `json:"signature"`
+}
+
+// dealShareJSON is a share of a deal encrypted to the signing key of its owner
+type dealShareJSON struct {
+	Index byte   `json:"index"`
+	Share string `json:"share"`
+}
+
+// the file names of a ceremony
+func ParticipantFile(index byte) string {
+	return fmt.Sprintf("participant%d.json", index)
+}
+
+func DealFile(index byte) string {
+	return fmt.Sprintf("deal%d.json", index)
+}
+
+// JoinCeremony generates the message signing key of a validator into its
+// keystore and writes the participant file to publish to the others
+func JoinCeremony(dir string, index byte, password string, scryptN, scryptP int) error {
+	if index == 0 {
+		return errors.New("validator index starts from 1")
+	}
+	signer, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	data, err := EncryptSigningKey(index, signer, password, scryptN, scryptP)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(filepath.Join(dir, SignerKeystoreFile(index)), data); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(dir, ParticipantFile(index)), participantJSON{
+		Index:      index,
+		SigningKey: hex.EncodeToString(crypto.CompressPubkey(&signer.PublicKey)),
+	})
+}
+
+// DealCeremony deals the part of a validator in the keys of the network to
+// all participants and writes the deal file to publish to the others
+func DealCeremony(dir string, index byte, password string) error {
+	signer, signers, err := loadParticipants(dir, index, password)
+	if err != nil {
+		return err
+	}
+	ms := sortedIndexes(signers)
+	threshold := KeyThreshold(len(ms))
+	p, err := newDKGPolynomial(threshold)
+	if err != nil {
+		return err
+	}
+	d := dealJSON{Index: index, Threshold: threshold}
+	for k := range p.commitments {
+		d.Commitments = append(d.Commitments, hex.EncodeToString(encodeG1(&p.commitments[k])))
+	}
+	for _, i := range ms {
+		s := p.eval(i)
+		c, err := encryptShare(signers[i], &s)
+		if err != nil {
+			return err
+		}
+		d.Shares = append(d.Shares, dealShareJSON{Index: byte(i), Share: hex.EncodeToString(c)})
+	}
+	sig, err := crypto.Sign(d.digest(), signer)
+	if err != nil {
+		return err
+	}
+	d.Signature = hex.EncodeToString(sig[:crypto.RecoveryIDOffset])
+	return writeJSON(filepath.Join(dir, DealFile(index)), d)
+}
+
+// FinishCeremony combines the deals of all participants into the keystore of
+// a validator and writes the network config
+func FinishCeremony(dir string, index byte, keyEnabledHeight uint64, password string, scryptN, scryptP int) (*NetworkConfig, error) {
+	signer, signers, err := loadParticipants(dir, index, password)
+	if err != nil {
+		return nil, err
+	}
+	ms := sortedIndexes(signers)
+	threshold := KeyThreshold(len(ms))
+	sum := make([]bls.G1Jac, threshold+1)
+	share := new(fr.Element)
+	for _, dealer := range ms {
+		var d dealJSON
+		if err := readJSON(filepath.Join(dir, DealFile(byte(dealer))), &d); err != nil {
+			return nil, err
+		}
+		cs, s, err := d.open(byte(dealer), ms, signers[dealer], index, signer)
+		if err != nil {
+			return nil, fmt.Errorf("deal of validator %d: %w", dealer, err)
+		}
+		for k := range cs {
+			sum[k].AddMixed(&cs[k])
+		}
+		share.Add(share, s)
+	}
+	cs := make([]bls.G1Affine, len(sum))
+	for k := range sum {
+		cs[k].FromJacobian(&sum[k])
+	}
+
+	globalPub, err := tpkePublicKey(&cs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert global key: %w", err)
+	}
+	pubs := make(ValidatorSet, len(ms))
+	for _, i := range ms {
+		p := commitmentAt(cs, i)
+		if pubs[i], err = tpkePublicKey(&p); err != nil {
+			return nil, fmt.Errorf("failed to convert public key of validator %d: %w", i, err)
+		}
+		if i != uint16(index) {
+			continue
+		}
+		prv, err := tpkePrivateKey(share, &p)
+		if err != nil {
+			return nil, err
+		}
+		// there is no tpke scaler, shares are combined in lagrange.go
+		data, err := EncryptKey(&KeyBundle{
+			Index:            index,
+			PrivateKey:       prv,
+			GlobalPubKey:     globalPub,
+			Scaler:           1,
+			KeyEnabledHeight: keyEnabledHeight,
+		}, password, scryptN, scryptP)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeKeyFile(filepath.Join(dir, KeystoreFile(index)), data); err != nil {
+			return nil, err
+		}
+	}
+
+	c := NewNetworkConfig(globalPub, pubs, signers, threshold, 1, keyEnabledHeight)
+	if err := c.Save(filepath.Join(dir, NetworkConfigFile)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadParticipants opens the signing key of a validator and reads the signing
+// keys of all participants
+func loadParticipants(dir string, index byte, password string) (*ecdsa.PrivateKey, SignerSet, error) {
+	i, signer, err := LoadSigningKey(filepath.Join(dir, SignerKeystoreFile(index)), password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if i != index {
+		return nil, nil, fmt.Errorf("signing key of validator %d for validator %d", i, index)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "participant*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) > message.MaxKeyDealSize {
+		return nil, nil, fmt.Errorf("too many participants: %d", len(paths))
+	}
+	signers := make(SignerSet, len(paths))
+	for _, path := range paths {
+		var p participantJSON
+		if err := readJSON(path, &p); err != nil {
+			return nil, nil, err
+		}
+		if p.Index == 0 || filepath.Base(path) != ParticipantFile(p.Index) {
+			return nil, nil, fmt.Errorf("unexpected participant %d in %s", p.Index, path)
+		}
+		b, err := hex.DecodeString(p.SigningKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid signing key of validator %d: %w", p.Index, err)
+		}
+		if signers[uint16(p.Index)], err = crypto.DecompressPubkey(b); err != nil {
+			return nil, nil, fmt.Errorf("invalid signing key of validator %d: %w", p.Index, err)
+		}
+	}
+	if pub, ok := signers[uint16(index)]; !ok || !pub.Equal(&signer.PublicKey) {
+		return nil, nil, fmt.Errorf("participant file of validator %d doesn't match its signing key", index)
+	}
+	return signer, signers, nil
+}
+
+// digest returns the hash the dealer signs, that is the hash of the deal
+// without the signature
+func (d dealJSON) digest() []byte {
+	d.Signature = ""
+	data, err := json.Marshal(d)
+	if err != nil {
+		panic("failed to encode deal: " + err.Error())
+	}
+	return crypto.Keccak256(data)
+}
+
+// open checks a deal against the participants and returns its commitments
+// with the share of the validator
+func (d *dealJSON) open(dealer byte, ms []uint16, dealerKey *ecdsa.PublicKey, index byte, signer *ecdsa.PrivateKey) ([]bls.G1Affine, *fr.Element, error) {
+	sig, err := hex.DecodeString(d.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	if d.Index != dealer || !crypto.VerifySignature(crypto.FromECDSAPub(dealerKey), d.digest(), sig) {
+		return nil, nil, errors.New("invalid signature")
+	}
+	if d.Threshold != KeyThreshold(len(ms)) || len(d.Commitments) != d.Threshold+1 {
+		return nil, nil, fmt.Errorf("unexpected threshold %d with %d commitments", d.Threshold, len(d.Commitments))
+	}
+	if len(d.Shares) != len(ms) {
+		return nil, nil, fmt.Errorf("%d shares for %d participants", len(d.Shares), len(ms))
+	}
+	bs := make([][]byte, len(d.Commitments))
+	for k, v := range d.Commitments {
+		if bs[k], err = hex.DecodeString(v); err != nil {
+			return nil, nil, fmt.Errorf("commitment %d: %w", k, err)
+		}
+	}
+	cs, err := decodeCommitments(bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(d.Shares, func(i, j int) bool { return d.Shares[i].Index < d.Shares[j].Index })
+	var share *fr.Element
+	for j, v := range d.Shares {
+		if uint16(v.Index) != ms[j] {
+			return nil, nil, errors.New("unexpected participants")
+		}
+		if v.Index != index {
+			continue
+		}
+		c, err := hex.DecodeString(v.Share)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid share: %w", err)
+		}
+		if share, err = decryptShare(signer, c); err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt share: %w", err)
+		}
+		if err := verifyShare(share, cs, uint16(index)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cs, share, nil
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package dbft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCeremony(t *testing.T) {
+	// 4 validators with their own directories and passwords
+	root := t.TempDir()
+	dirs := make([]string, 5)
+	for i := 1; i <= 4; i++ {
+		dirs[i] = filepath.Join(root, fmt.Sprint(i))
+	}
+	password := func(i int) string { return fmt.Sprintf("password%d", i) }
+	publish := func(name func(byte) string) {
+		for i := 1; i <= 4; i++ {
+			data, err := os.ReadFile(filepath.Join(dirs[i], name(byte(i))))
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			for j := 1; j <= 4; j++ {
+				if err := os.WriteFile(filepath.Join(dirs[j], name(byte(i))), data, 0644); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		if err := JoinCeremony(dirs[i], byte(i), password(i), LightScryptN, LightScryptP); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	publish(ParticipantFile)
+	for i := 1; i <= 4; i++ {
+		if err := DealCeremony(dirs[i], byte(i), password(i)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	publish(DealFile)
+
+	// a deal altered on the way is detected
+	path := filepath.Join(dirs[1], DealFile(2))
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var d dealJSON
+	if err := json.Unmarshal(valid, &d); err != nil {
+		t.Fatalf(err.Error())
+	}
+	d.Commitments[0], d.Commitments[1] = d.Commitments[1], d.Commitments[0]
+	if err := writeJSON(path, d); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := FinishCeremony(dirs[1], 1, 0, password(1), LightScryptN, LightScryptP); err == nil {
+		t.Fatalf("altered deal accepted")
+	}
+	if err := os.WriteFile(path, valid, 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// every validator gets the same network config and a key share matching it
+	var config []byte
+	for i := 1; i <= 4; i++ {
+		c, err := FinishCeremony(dirs[i], byte(i), 0, password(i), LightScryptN, LightScryptP)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if config != nil && !bytes.Equal(config, data) {
+			t.Fatalf("validator %d got another network config", i)
+		}
+		config = data
+		_, pubs, err := c.Keys()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		n, err := NewNodeFromKeystore(filepath.Join(dirs[i], KeystoreFile(byte(i))), filepath.Join(dirs[i], SignerKeystoreFile(byte(i))), password(i), password(i))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !bytes.Equal(n.GetPublicKey().ToBytes(), pubs[uint16(i)].ToBytes()) {
+			t.Fatalf("key share of validator %d doesn't match the network config", i)
+		}
+	}
+}
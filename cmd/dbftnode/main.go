@@ -0,0 +1,164 @@
+// Command dbftnode runs a validator or an observer of a dBFT network.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dbft "github.com/txhsl/dbft-anti-mev"
+	"github.com/txhsl/dbft-anti-mev/rpc"
+)
+
+func main() {
+	configPath := flag.String("config", "node.json", "node config file")
+	passwordFile := flag.String("password", "", "file with the password of the keystores without a password file in the config")
+	stdinTxs := flag.Bool("stdin-txs", false, "read hex encoded raw transactions from stdin, one per line")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "log level of the consensus: debug, info, warn or error")
+	flag.Parse()
+
+	if err := run(*configPath, *passwordFile, *stdinTxs, logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "dbftnode:", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath, passwordFile string, stdinTxs bool, logLevel slog.Level) error {
+	c, err := dbft.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	password := ""
+	if passwordFile != "" {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	n, err := dbft.NewNodeFromConfig(c, password)
+	if err != nil {
+		return err
+	}
+	n.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+
+	if c.DataDir != "" {
+		store, err := dbft.OpenBlockStore(c.DataDir)
+		if err != nil {
+			return fmt.Errorf("failed to open block store: %w", err)
+		}
+		defer store.Close()
+		if err := n.SetBlockStore(store); err != nil {
+			return err
+		}
+	}
+
+	if c.Journal != "" {
+		j, err := dbft.OpenJournal(c.Journal)
+		if err != nil {
+			return fmt.Errorf("failed to open journal: %w", err)
+		}
+		defer j.Close()
+		if err := n.SetJournal(j); err != nil {
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+	}
+
+	t := dbft.NewTransport(n)
+	if err := t.Listen(c.ListenAddress); err != nil {
+		return err
+	}
+	defer t.Close()
+	for _, p := range c.Peers {
+		t.AddPeer(uint16(p.Index), p.Address)
+	}
+	fmt.Printf("validator %d listening on %s\n", c.Index, t.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if c.RPCAddress != "" {
+		s := rpc.NewServer()
+		s.SetAllowedOrigins(c.RPCOrigins)
+		rpc.RegisterEthAPI(s, n)
+		rpc.RegisterAntiMEVAPI(s, n)
+		srv, addr, err := serve(c.RPCAddress, s)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		fmt.Printf("validator %d serving rpc on %s\n", c.Index, addr)
+	}
+	if c.MetricsAddress != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		n.SetMetrics(dbft.NewMetrics(reg))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		srv, addr, err := serve(c.MetricsAddress, mux)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		fmt.Printf("validator %d serving metrics on %s/metrics\n", c.Index, addr)
+	}
+	if stdinTxs {
+		go readTxs(ctx, n, os.Stdin)
+	}
+	n.EventLoop(ctx)
+	fmt.Printf("validator %d stopped\n", c.Index)
+	return nil
+}
+
+// serve starts an HTTP server in the background
+func serve(addr string, h http.Handler) (*http.Server, net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	return srv, l.Addr(), nil
+}
+
+// readTxs submits the raw transactions read from r to the node
+func readTxs(ctx context.Context, n *dbft.Node, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		b, err := hexutil.Decode(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid tx:", err)
+			continue
+		}
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(b); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid tx:", err)
+			continue
+		}
+		if err := n.SubmitTx(ctx, tx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "tx %s rejected: %v\n", tx.Hash(), err)
+		}
+	}
+}
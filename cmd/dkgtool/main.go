@@ -0,0 +1,159 @@
+// Command dkgtool runs a DKG ceremony for a new network and writes a keystore
+// with the key share and another with a message signing key for each
+// validator, together with the public network config.
+//
+// By default the ceremony is simulated locally by a single trusted party,
+// which should hand every keystore to its validator and then delete it. The
+// password file has a line with the password of each validator.
+//
+// Without a trusted party, every validator runs the ceremony in its own
+// directory with its own password and the validators exchange files:
+//
+//	dkgtool join -index i     writes participant<i>.json, send it to all others
+//	dkgtool deal -index i     needs the participant files of all validators,
+//	                          writes deal<i>.json, send it to all others
+//	dkgtool finish -index i   needs the deal files of all validators, writes
+//	                          the keystores and the network config
+//
+// The shares in a deal file are encrypted to the signing keys of their owners
+// and the file is signed by the dealer, so the files can be exchanged over any
+// channel, but the participant files should be checked with their owners. The
+// network configs of all validators should be equal.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dbft "github.com/txhsl/dbft-anti-mev"
+)
+
+const usage = `Usage:
+  dkgtool [-n 4] [-out keys] [-height 0] -password file [-light]
+      run the ceremony locally, the password file has a line per validator
+  dkgtool join -index i [-out dir] -password file [-light]
+  dkgtool deal -index i [-out dir] -password file
+  dkgtool finish -index i [-out dir] [-height 0] -password file [-light]
+      run the ceremony by exchanging files, with the password of validator i
+`
+
+func main() {
+	var err error
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		err = runStep(os.Args[1], os.Args[2:])
+	} else {
+		err = runLocal(os.Args[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dkgtool:", err)
+		os.Exit(1)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	return fs
+}
+
+func runLocal(args []string) error {
+	fs := newFlagSet("dkgtool")
+	size := fs.Int("n", 4, "number of validators")
+	out := fs.String("out", "keys", "output directory")
+	height := fs.Uint64("height", 0, "height the keys are enabled from")
+	passwordFile := fs.String("password", "", "file with a keystore password per line, one for each validator")
+	light := fs.Bool("light", false, "use light scrypt parameters, for local networks only")
+	fs.Parse(args)
+
+	passwords, err := readPasswords(*passwordFile)
+	if err != nil {
+		return err
+	}
+	if len(passwords) != *size {
+		return fmt.Errorf("the password file has %d passwords for %d validators", len(passwords), *size)
+	}
+	scryptN, scryptP := scryptParams(*light)
+	c, err := dbft.SetupNetwork(*out, *size, *height, passwords, scryptN, scryptP)
+	if err != nil {
+		return err
+	}
+	for _, v := range c.Validators {
+		fmt.Println("keystore", filepath.Join(*out, dbft.KeystoreFile(v.Index)))
+		fmt.Println("signing key", filepath.Join(*out, dbft.SignerKeystoreFile(v.Index)))
+	}
+	fmt.Println("network config", filepath.Join(*out, dbft.NetworkConfigFile))
+	return nil
+}
+
+func runStep(step string, args []string) error {
+	fs := newFlagSet("dkgtool " + step)
+	index := fs.Uint("index", 0, "index of this validator, starting from 1")
+	out := fs.String("out", ".", "working directory of this validator")
+	height := fs.Uint64("height", 0, "height the keys are enabled from")
+	passwordFile := fs.String("password", "", "file with the keystore password of this validator")
+	light := fs.Bool("light", false, "use light scrypt parameters, for local networks only")
+	fs.Parse(args)
+
+	if *index == 0 || *index > 0xff {
+		return fmt.Errorf("invalid validator index %d", *index)
+	}
+	passwords, err := readPasswords(*passwordFile)
+	if err != nil {
+		return err
+	}
+	if len(passwords) != 1 {
+		return fmt.Errorf("the password file has %d passwords, expected 1", len(passwords))
+	}
+	i, password := byte(*index), passwords[0]
+	scryptN, scryptP := scryptParams(*light)
+
+	switch step {
+	case "join":
+		if err := dbft.JoinCeremony(*out, i, password, scryptN, scryptP); err != nil {
+			return err
+		}
+		fmt.Println("signing key", filepath.Join(*out, dbft.SignerKeystoreFile(i)))
+		fmt.Println("participant file", filepath.Join(*out, dbft.ParticipantFile(i)))
+	case "deal":
+		if err := dbft.DealCeremony(*out, i, password); err != nil {
+			return err
+		}
+		fmt.Println("deal file", filepath.Join(*out, dbft.DealFile(i)))
+	case "finish":
+		if _, err := dbft.FinishCeremony(*out, i, *height, password, scryptN, scryptP); err != nil {
+			return err
+		}
+		fmt.Println("keystore", filepath.Join(*out, dbft.KeystoreFile(i)))
+		fmt.Println("network config", filepath.Join(*out, dbft.NetworkConfigFile))
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown step %q", step)
+	}
+	return nil
+}
+
+// readPasswords reads the passwords in a file, one per line
+func readPasswords(path string) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("password file is required")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	return lines, nil
+}
+
+func scryptParams(light bool) (int, int) {
+	if light {
+		return dbft.LightScryptN, dbft.LightScryptP
+	}
+	return dbft.StandardScryptN, dbft.StandardScryptP
+}
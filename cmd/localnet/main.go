@@ -0,0 +1,197 @@
+// Command localnet runs a network of validators on localhost for testing. It
+// generates keys by DKG, writes a config for every validator, launches the
+// dbftnode binary for each of them and prefixes their logs with the validator
+// index. Optionally it feeds every validator with a stream of sealed envelopes
+// and legacy transactions.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	dbft "github.com/txhsl/dbft-anti-mev"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"github.com/txhsl/tpke"
+)
+
+const password = "localnet"
+
+func main() {
+	size := flag.Int("n", 4, "number of validators")
+	dir := flag.String("dir", "localnet", "working directory for keys, configs and data")
+	basePort := flag.Int("port", 20000, "validator i listens on port+i, serves rpc on port+100+i and metrics on port+200+i")
+	bin := flag.String("bin", "dbftnode", "path of the dbftnode binary")
+	blockTime := flag.Duration("block-time", time.Second, "block time of the validators")
+	txInterval := flag.Duration("tx-interval", 0, "interval between injected transactions, 0 disables injection")
+	flag.Parse()
+
+	if err := run(*size, *dir, *basePort, *bin, *blockTime, *txInterval); err != nil {
+		fmt.Fprintln(os.Stderr, "localnet:", err)
+		os.Exit(1)
+	}
+}
+
+func run(size int, dir string, basePort int, bin string, blockTime, txInterval time.Duration) error {
+	keys := filepath.Join(dir, "keys")
+	passwords := make([]string, size)
+	for i := range passwords {
+		passwords[i] = password
+	}
+	network, err := dbft.SetupNetwork(keys, size, 0, passwords, dbft.LightScryptN, dbft.LightScryptP)
+	if err != nil {
+		return err
+	}
+	globalPub, _, err := network.Keys()
+	if err != nil {
+		return err
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte(password), 0600); err != nil {
+		return err
+	}
+
+	// configs, every validator knows all others
+	paths := make([]string, size)
+	for i := 1; i <= size; i++ {
+		c := dbft.DefaultConfig()
+		c.Index = byte(i)
+		c.Keystore = filepath.Join("keys", dbft.KeystoreFile(byte(i)))
+		c.SignerKeystore = filepath.Join("keys", dbft.SignerKeystoreFile(byte(i)))
+		c.Network = filepath.Join("keys", dbft.NetworkConfigFile)
+		c.ListenAddress = fmt.Sprintf("127.0.0.1:%d", basePort+i)
+		c.RPCAddress = fmt.Sprintf("127.0.0.1:%d", basePort+100+i)
+		c.MetricsAddress = fmt.Sprintf("127.0.0.1:%d", basePort+200+i)
+		c.DataDir = fmt.Sprintf("data%d", i)
+		c.BlockTime = dbft.Duration(blockTime)
+		c.ViewTimeout = dbft.Duration(5 * blockTime)
+		for j := 1; j <= size; j++ {
+			if j != i {
+				c.Peers = append(c.Peers, dbft.PeerConfig{Index: byte(j), Address: fmt.Sprintf("127.0.0.1:%d", basePort+j)})
+			}
+		}
+		paths[i-1] = filepath.Join(dir, fmt.Sprintf("node%d.json", i))
+		if err := c.Save(paths[i-1]); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	cmds := make([]*exec.Cmd, size)
+	inputs := make([]io.WriteCloser, size)
+	for i := 0; i < size; i++ {
+		cmd := exec.Command(bin, "-config", paths[i], "-password", passwordFile, "-stdin-txs")
+		prefix := fmt.Sprintf("[v%d] ", i+1)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		inputs[i], err = cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to start validator %d: %w", i+1, err)
+		}
+		cmds[i] = cmd
+		for _, r := range []io.Reader{stdout, stderr} {
+			wg.Add(1)
+			go func(r io.Reader) {
+				defer wg.Done()
+				streamLog(prefix, r)
+			}(r)
+		}
+	}
+
+	if txInterval > 0 {
+		go injectTxs(ctx, globalPub, inputs, txInterval)
+	}
+	<-ctx.Done()
+
+	// validators stop on interrupt, the same as dbftnode run by hand
+	for i, cmd := range cmds {
+		cmd.Process.Signal(os.Interrupt)
+		inputs[i].Close()
+	}
+	for _, cmd := range cmds {
+		cmd.Wait()
+	}
+	wg.Wait()
+	return nil
+}
+
+// streamLog copies the lines of a validator log to stdout with a prefix
+func streamLog(prefix string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Println(prefix + scanner.Text())
+	}
+}
+
+// injectTxs sends an envelope and a legacy tx to all validators per interval
+func injectTxs(ctx context.Context, globalPub *tpke.PublicKey, inputs []io.WriteCloser, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for nonce := uint64(0); ; nonce += 3 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// the nonce of the sealed tx leaves a space for its carrier
+		legacy := types.NewTransaction(nonce, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		carrier, err := sealTx(globalPub, types.NewTransaction(nonce+2, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil), nonce+1)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "localnet: failed to seal tx:", err)
+			continue
+		}
+		for _, tx := range []*types.Transaction{carrier, legacy} {
+			b, err := tx.MarshalBinary()
+			if err != nil {
+				continue
+			}
+			line := []byte(hexutil.Encode(b) + "\n")
+			for _, w := range inputs {
+				w.Write(line)
+			}
+		}
+	}
+}
+
+// sealTx encrypts a tx to the global key and wraps it into a carrier
+func sealTx(globalPub *tpke.PublicKey, tx *types.Transaction, nonce uint64) (*types.Transaction, error) {
+	buf := new(bytes.Buffer)
+	if err := tx.EncodeRLP(buf); err != nil {
+		return nil, err
+	}
+	seed := tpke.RandPG1()
+	et, err := tpke.AESEncrypt(seed, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	envelope := &transaction.Envelope{
+		EncryptedSeed:        globalPub.Encrypt(seed),
+		EncryptedTransaction: et,
+	}
+	return types.NewTransaction(nonce, dbft.ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes()), nil
+}
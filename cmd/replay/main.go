@@ -0,0 +1,247 @@
+// Command replay feeds the journal of a node into a fresh node set up from the
+// same config, so that a stall or a divergence can be reproduced offline.
+//
+// The inputs of the journal are applied in order without timers or peers. The
+// tool prints every input with the consensus events it causes, and checks the
+// messages the replayed node sends against the ones in the journal.
+//
+// A node which was not at genesis when the journal started needs a copy of
+// its block store at that time, the replay commits blocks into it.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/nspcc-dev/dbft/payload"
+	dbft "github.com/txhsl/dbft-anti-mev"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+func main() {
+	configPath := flag.String("config", "node.json", "config of the journaled node")
+	passwordFile := flag.String("password", "", "file with the password of the keystores without a password file in the config")
+	journalPath := flag.String("journal", "", "journal to replay, the journal of the config by default")
+	dataDir := flag.String("datadir", "", "copy of the block store at the start of the journal")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelWarn, "log level of the replayed node: debug, info, warn or error")
+	flag.Parse()
+
+	diverged, err := run(*configPath, *passwordFile, *journalPath, *dataDir, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(1)
+	}
+	if diverged {
+		os.Exit(2)
+	}
+}
+
+func run(configPath, passwordFile, journalPath, dataDir string, logLevel slog.Level) (bool, error) {
+	c, err := dbft.LoadConfig(configPath)
+	if err != nil {
+		return false, err
+	}
+	if journalPath == "" {
+		journalPath = c.Journal
+	}
+	if journalPath == "" {
+		return false, errors.New("no journal to replay")
+	}
+	password := ""
+	if passwordFile != "" {
+		b, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return false, err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	n, err := dbft.NewNodeFromConfig(c, password)
+	if err != nil {
+		return false, err
+	}
+	n.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	if dataDir != "" {
+		store, err := dbft.OpenBlockStore(dataDir)
+		if err != nil {
+			return false, fmt.Errorf("failed to open block store: %w", err)
+		}
+		defer store.Close()
+		if err := n.SetBlockStore(store); err != nil {
+			return false, err
+		}
+	}
+
+	f, err := os.Open(journalPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := &replayer{node: n, events: n.Subscribe(1024), sent: new(bytes.Buffer)}
+	if err := n.SetJournal(dbft.NewJournal(r.sent)); err != nil {
+		return false, err
+	}
+	r.out = dbft.NewJournalReader(r.sent)
+	if _, err := r.out.Next(); err != nil {
+		return false, err
+	}
+	err = r.replay(dbft.NewJournalReader(bufio.NewReader(f)))
+	r.flush()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Println("journal ends with a partial record")
+		err = nil
+	}
+	fmt.Printf("replayed %d records, stopped at height %d view %d\n", r.records, n.GetHeight()+1, n.GetView())
+	return r.diverged, err
+}
+
+// replayer applies the inputs of a journal and matches the outputs
+type replayer struct {
+	node     *dbft.Node
+	events   *dbft.Subscription
+	sent     *bytes.Buffer // the journal of the replayed node
+	out      *dbft.JournalReader
+	pending  []*message.Payload // sent by the replayed node, not matched yet
+	records  int
+	diverged bool
+}
+
+func (r *replayer) replay(j *dbft.JournalReader) error {
+	for {
+		rec, err := j.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.records += 1
+		switch rec.Kind {
+		case dbft.JournalStart:
+			r.flush()
+			fmt.Printf("%s start       height %d view %d\n", stamp(rec), rec.Height, rec.View)
+			if h, v := r.node.GetHeight()+1, r.node.GetView(); h != rec.Height || v != rec.View {
+				fmt.Printf("  replayed node is at height %d view %d\n", h, v)
+			}
+		case dbft.JournalOut:
+			r.match(rec.Payload)
+		default:
+			r.flush()
+			fmt.Printf("%s %-11s %s\n", stamp(rec), rec.Kind, describe(rec))
+			if err := r.node.Apply(rec); err != nil {
+				fmt.Printf("  error: %v\n", err)
+			}
+			r.collect()
+		}
+	}
+}
+
+// collect prints the events and keeps the messages caused by the last input
+func (r *replayer) collect() {
+	for drained := false; !drained; {
+		select {
+		case e := <-r.events.C:
+			fmt.Printf("  event %s %+v\n", e.EventName(), e)
+		default:
+			drained = true
+		}
+	}
+	for {
+		rec, err := r.out.Next()
+		if err != nil {
+			break
+		}
+		if rec.Kind == dbft.JournalOut {
+			r.pending = append(r.pending, rec.Payload)
+		}
+	}
+}
+
+// the messages fully determined by the inputs, others carry the time they
+// are sent at or shares encrypted at random
+var deterministic = map[payload.MessageType]bool{
+	payload.PrepareRequestType:  true,
+	payload.PrepareResponseType: true,
+	payload.CommitType:          true,
+	message.KeyComplaintType:    true,
+	message.KeyRevealType:       true,
+}
+
+// match checks a journaled message against the next one sent on replay
+func (r *replayer) match(m *message.Payload) {
+	if len(r.pending) == 0 {
+		r.diverged = true
+		fmt.Printf("  DIVERGED: journal sent %s, replay sent nothing\n", describeMsg(m))
+		return
+	}
+	got := r.pending[0]
+	r.pending = r.pending[1:]
+	switch {
+	case got.Type() != m.Type() || got.BlockIndex != m.BlockIndex || got.ViewNumber() != m.ViewNumber():
+		r.diverged = true
+		fmt.Printf("  DIVERGED: journal sent %s, replay sent %s\n", describeMsg(m), describeMsg(got))
+	case deterministic[m.Type()] && !bytes.Equal(got.ToBytes(), m.ToBytes()):
+		r.diverged = true
+		fmt.Printf("  DIVERGED: %s differs in content\n", describeMsg(m))
+	case m.Type() == message.KeyDealType && !sameDeal(got, m):
+		// the polynomial of a node is derived from its key, only the shares
+		// are encrypted at random
+		r.diverged = true
+		fmt.Printf("  DIVERGED: %s differs in commitments\n", describeMsg(m))
+	default:
+		fmt.Printf("  sent %s\n", describeMsg(m))
+	}
+}
+
+// sameDeal reports whether two key deals commit to the same polynomial
+func sameDeal(a, b *message.Payload) bool {
+	da, ok := a.Payload().(message.KeyDeal)
+	if !ok {
+		return false
+	}
+	db, ok := b.Payload().(message.KeyDeal)
+	if !ok || len(da.Commitments) != len(db.Commitments) {
+		return false
+	}
+	for i := range da.Commitments {
+		if !bytes.Equal(da.Commitments[i], db.Commitments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// flush reports the messages sent on replay but not in the journal
+func (r *replayer) flush() {
+	for _, m := range r.pending {
+		r.diverged = true
+		fmt.Printf("  DIVERGED: replay sent %s, journal sent nothing\n", describeMsg(m))
+	}
+	r.pending = nil
+}
+
+func stamp(rec *dbft.JournalRecord) string {
+	return rec.Time.Format("15:04:05.000")
+}
+
+func describe(rec *dbft.JournalRecord) string {
+	switch rec.Kind {
+	case dbft.JournalIn:
+		return describeMsg(rec.Payload)
+	case dbft.JournalTx:
+		return rec.Tx.Hash().Hex()
+	}
+	return ""
+}
+
+func describeMsg(m *message.Payload) string {
+	return fmt.Sprintf("%s from %d at height %d view %d", message.TypeName(m.Type()), m.ValidatorIndex(), m.BlockIndex, m.ViewNumber())
+}
@@ -0,0 +1,343 @@
+package dbft
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of a node, usually loaded from a JSON or YAML
+// file. The keystores are opened with the password given to the node, unless
+// a password file is set for them.
+type Config struct {
+	Index              byte         `json:"index"`                        // validator index, starting from 1
+	Keystore           string       `json:"keystore"`                     // keystore of the key share, empty for an observer
+	SignerKeystore     string       `json:"signerKeystore"`               // keystore of the message signing key
+	PasswordFile       string       `json:"passwordFile,omitempty"`       // password of the keystore of the key share
+	SignerPasswordFile string       `json:"signerPasswordFile,omitempty"` // password of the signing keystore
+	Network            string       `json:"network"`                      // network config written by dkgtool
+	Peers              []PeerConfig `json:"peers"`
+
+	ListenAddress  string   `json:"listenAddress"`
+	RPCAddress     string   `json:"rpcAddress"`     // JSON-RPC over HTTP and websocket, disabled if empty
+	RPCOrigins     []string `json:"rpcOrigins"`     // browser origins allowed to use the websocket, "*" for any, localhost if empty
+	MetricsAddress string   `json:"metricsAddress"` // prometheus metrics on /metrics, disabled if empty
+	DataDir        string   `json:"dataDir"`        // the path of the block store
+	Journal        string   `json:"journal"`        // the file consensus messages are journaled to, disabled if empty
+
+	BlockTime   Duration `json:"blockTime"`   // the interval between proposals
+	ViewTimeout Duration `json:"viewTimeout"` // the time to wait for a block before changing view
+
+	MessageBuffer int      `json:"messageBuffer"` // the capacity of the message queue
+	MaxLegacyTxs  int      `json:"maxLegacyTxs"`  // 0 if unlimited
+	MaxEnvelopes  int      `json:"maxEnvelopes"`  // 0 if unlimited
+	BaseFee       *big.Int `json:"baseFee"`       // the service fee of an envelope
+	ByteFee       *big.Int `json:"byteFee"`       // the service fee per byte of an encrypted tx
+
+	EpochInterval uint64 `json:"epochInterval"` // 0 if keys are never rotated
+	EpochGrace    uint64 `json:"epochGrace"`
+}
+
+// PeerConfig is the address of another node. The signing key of a validator
+// is in the network config, an observer needs its signing key here to sync
+// blocks from this node.
+type PeerConfig struct {
+	Index      byte   `json:"index"`
+	Address    string `json:"address"`
+	SigningKey string `json:"signingKey,omitempty"` // compressed hex, observers only
+}
+
+func (p PeerConfig) signingKey() (*ecdsa.PublicKey, error) {
+	b, err := hex.DecodeString(p.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key of peer %d: %w", p.Index, err)
+	}
+	pub, err := crypto.DecompressPubkey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key of peer %d: %w", p.Index, err)
+	}
+	return pub, nil
+}
+
+// Duration is a time.Duration written as a string like "1s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultConfig returns a config with defaults for everything but the
+// identity, keys and addresses.
+func DefaultConfig() *Config {
+	return &Config{
+		BlockTime:     Duration(time.Second),
+		ViewTimeout:   Duration(5 * time.Second),
+		MessageBuffer: 100,
+		BaseFee:       big.NewInt(0),
+		ByteFee:       big.NewInt(0),
+		EpochGrace:    defaultEpochGrace,
+	}
+}
+
+// LoadConfig reads a config file over the defaults, relative paths in the
+// file are resolved against its directory. A YAML file has the keys of the
+// JSON one.
+func LoadConfig(path string) (*Config, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".json", ".yaml", ".yml":
+	case ".toml":
+		return nil, fmt.Errorf("unsupported config format %s, use JSON or YAML", ext)
+	default:
+		return nil, fmt.Errorf("unknown config format %q", ext)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext != ".json" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	c := DefaultConfig()
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&c.Keystore, &c.SignerKeystore, &c.PasswordFile, &c.SignerPasswordFile, &c.Network, &c.DataDir, &c.Journal} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return c, c.Validate()
+}
+
+// yamlToJSON converts a YAML document to JSON, so it is decoded with the
+// JSON keys and checks of the config
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = map[string]any{}
+	}
+	return json.Marshal(v)
+}
+
+// readPassword reads the password in a file, a trailing newline is dropped
+func readPassword(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// passwords returns the passwords of the keystores, the given password is
+// used for those without a password file
+func (c *Config) passwords(password string) (string, string, error) {
+	key, signer := password, password
+	var err error
+	if c.PasswordFile != "" {
+		if key, err = readPassword(c.PasswordFile); err != nil {
+			return "", "", err
+		}
+	}
+	if c.SignerPasswordFile != "" {
+		if signer, err = readPassword(c.SignerPasswordFile); err != nil {
+			return "", "", err
+		}
+	}
+	return key, signer, nil
+}
+
+// Save writes the config as JSON
+func (c *Config) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Validate checks the config is complete and consistent
+func (c *Config) Validate() error {
+	if c.Index == 0 {
+		return errors.New("validator index starts from 1")
+	}
+	if c.Network == "" {
+		return errors.New("network config is required")
+	}
+	if c.Keystore != "" && c.SignerKeystore == "" {
+		return errors.New("a validator needs a signing key")
+	}
+	if c.Keystore == "" && c.PasswordFile != "" || c.SignerKeystore == "" && c.SignerPasswordFile != "" {
+		return errors.New("password file without a keystore")
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	if c.RPCAddress != "" {
+		if _, _, err := net.SplitHostPort(c.RPCAddress); err != nil {
+			return fmt.Errorf("invalid rpc address: %w", err)
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("invalid metrics address: %w", err)
+		}
+	}
+	seen := map[byte]bool{c.Index: true}
+	for _, p := range c.Peers {
+		if p.Index == 0 || seen[p.Index] {
+			return fmt.Errorf("invalid or duplicated peer index %d", p.Index)
+		}
+		seen[p.Index] = true
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("invalid address of peer %d: %w", p.Index, err)
+		}
+		if p.SigningKey != "" {
+			if _, err := p.signingKey(); err != nil {
+				return err
+			}
+		}
+	}
+	if c.BlockTime <= 0 || c.ViewTimeout <= 0 {
+		return errors.New("timeouts should be positive")
+	}
+	if c.ViewTimeout < c.BlockTime {
+		return errors.New("view timeout should not be shorter than block time")
+	}
+	if c.MessageBuffer <= 0 {
+		return errors.New("message buffer should be positive")
+	}
+	if c.MaxLegacyTxs < 0 || c.MaxEnvelopes < 0 {
+		return errors.New("pool limits should not be negative")
+	}
+	if c.BaseFee == nil || c.BaseFee.Sign() < 0 || c.ByteFee == nil || c.ByteFee.Sign() < 0 {
+		return errors.New("fees should not be negative")
+	}
+	if c.EpochInterval != 0 && c.EpochInterval < minEpochInterval {
+		return fmt.Errorf("epoch interval should be at least %d", minEpochInterval)
+	}
+	return nil
+}
+
+// set up a node from a config, the keystores are opened with the password
+// unless the config has password files for them
+func NewNodeFromConfig(c *Config, password string) (*Node, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	keyPassword, signerPassword, err := c.passwords(password)
+	if err != nil {
+		return nil, err
+	}
+	network, err := LoadNetworkConfig(c.Network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load network config: %w", err)
+	}
+	globalPub, pubs, err := network.Keys()
+	if err != nil {
+		return nil, err
+	}
+	signers, err := network.Signers()
+	if err != nil {
+		return nil, err
+	}
+	if len(pubs) > message.MaxKeyDealSize {
+		return nil, fmt.Errorf("too many validators %d", len(pubs))
+	}
+
+	var n *Node
+	if c.Keystore == "" {
+		var signer *ecdsa.PrivateKey
+		if c.SignerKeystore != "" {
+			_, signer, err = LoadSigningKey(c.SignerKeystore, signerPassword)
+			if err != nil {
+				return nil, err
+			}
+		}
+		n = NewObserver(c.Index, signer, globalPub, network.KeyEnabledHeight, network.Scaler)
+	} else {
+		n, err = NewNodeFromKeystore(c.Keystore, c.SignerKeystore, keyPassword, signerPassword)
+		if err != nil {
+			return nil, err
+		}
+		if n.index != c.Index {
+			return nil, fmt.Errorf("keystore of validator %d for validator %d", n.index, c.Index)
+		}
+		pub, err := pubs.Lookup(uint16(c.Index))
+		if err != nil || !bytes.Equal(pub.ToBytes(), n.pub.ToBytes()) {
+			return nil, errors.New("key share doesn't match the network config")
+		}
+		if s := signers[uint16(c.Index)]; s == nil || !s.Equal(n.GetSigningKey()) {
+			return nil, errors.New("signing key doesn't match the network config")
+		}
+	}
+	if !bytes.Equal(n.globalPubKey.ToBytes(), globalPub.ToBytes()) {
+		return nil, errors.New("global public key doesn't match the network config")
+	}
+
+	for i, pub := range pubs {
+		if i != uint16(c.Index) {
+			n.neighborPubKeys[i] = pub
+			n.signers[i] = signers[i]
+		}
+	}
+	for _, p := range c.Peers {
+		if p.SigningKey == "" {
+			continue
+		}
+		if _, ok := pubs[uint16(p.Index)]; ok {
+			return nil, fmt.Errorf("peer %d is a validator, its signing key is in the network config", p.Index)
+		}
+		if n.signers[uint16(p.Index)], err = p.signingKey(); err != nil {
+			return nil, err
+		}
+	}
+	if err := n.SetEpochInterval(c.EpochInterval); err != nil {
+		return nil, err
+	}
+	n.SetEpochGrace(c.EpochGrace)
+	n.SetTimeouts(time.Duration(c.BlockTime), time.Duration(c.ViewTimeout))
+	n.messageHandler = make(chan *message.Payload, c.MessageBuffer)
+	n.maxLegacyTxs = c.MaxLegacyTxs
+	n.maxEnvelopes = c.MaxEnvelopes
+	n.SetFeeParams(transaction.FeeParams{
+		BaseFee: new(big.Int).Set(c.BaseFee),
+		ByteFee: new(big.Int).Set(c.ByteFee),
+	})
+	return n, nil
+}
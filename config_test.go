@@ -0,0 +1,174 @@
+package dbft
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/tpke"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node.json")
+	err := os.WriteFile(path, []byte(`{
+		"index": 1,
+		"keystore": "keys/validator1.json",
+		"signerKeystore": "keys/signer1.json",
+		"network": "keys/network.json",
+		"peers": [{"index": 2, "address": "127.0.0.1:20002"}],
+		"listenAddress": "127.0.0.1:20001",
+		"viewTimeout": "10s",
+		"maxEnvelopes": 64
+	}`), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if c.Keystore != filepath.Join(dir, "keys", "validator1.json") {
+		t.Fatalf("relative path not resolved: %s", c.Keystore)
+	}
+	if time.Duration(c.ViewTimeout) != 10*time.Second || time.Duration(c.BlockTime) != time.Second {
+		t.Fatalf("invalid timeouts")
+	}
+	if c.MaxEnvelopes != 64 || c.MessageBuffer != 100 {
+		t.Fatalf("invalid pool limits")
+	}
+
+	// peers can't share an index
+	c.Peers = append(c.Peers, PeerConfig{Index: 2, Address: "127.0.0.1:20003"})
+	if err := c.Validate(); err == nil {
+		t.Fatalf("duplicated peer is accepted")
+	}
+
+	// a yaml config has the same keys, the keystores may have their own passwords
+	path = filepath.Join(dir, "node.yaml")
+	err = os.WriteFile(path, []byte(`
+index: 1
+keystore: keys/validator1.json
+signerKeystore: keys/signer1.json
+passwordFile: keys/password1
+network: keys/network.json
+peers:
+  - index: 2
+    address: 127.0.0.1:20002
+listenAddress: 127.0.0.1:20001
+viewTimeout: 10s
+maxEnvelopes: 64
+`), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	y, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if y.Keystore != c.Keystore || y.ViewTimeout != c.ViewTimeout || y.MaxEnvelopes != 64 || len(y.Peers) != 1 || y.Peers[0].Address != "127.0.0.1:20002" {
+		t.Fatalf("yaml config differs from json config")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.WriteFile(y.PasswordFile, []byte("share\n"), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if key, signer, err := y.passwords("default"); err != nil || key != "share" || signer != "default" {
+		t.Fatalf("unexpected passwords %q and %q: %v", key, signer, err)
+	}
+
+	if err := os.WriteFile(path, []byte("index: 1\nunknown: 2\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("unknown yaml key is accepted")
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "node.toml")); err == nil {
+		t.Fatalf("toml config is accepted")
+	}
+}
+
+func TestNewNodeFromConfig(t *testing.T) {
+	dkg := tpke.NewDKG(4, KeyThreshold(4))
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(4)
+
+	dir := t.TempDir()
+	pubs := make(ValidatorSet)
+	signerPubs := make(SignerSet)
+	for i := 1; i <= 4; i++ {
+		pubs[uint16(i)] = prvs[i].GetPublicKey()
+		signerPubs[uint16(i)] = &signers[i].PublicKey
+	}
+	network := filepath.Join(dir, "network.json")
+	err = NewNetworkConfig(globalpub, pubs, signerPubs, KeyThreshold(4), dkg.GetScaler(), 0).Save(network)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	data, err := EncryptKey(&KeyBundle{Index: 2, PrivateKey: prvs[2], GlobalPubKey: globalpub, Scaler: dkg.GetScaler()}, "secret", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keystore := filepath.Join(dir, "validator2.json")
+	if err = os.WriteFile(keystore, data, 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	data, err = EncryptSigningKey(2, signers[2], "secret", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	signerKeystore := filepath.Join(dir, "signer2.json")
+	if err = os.WriteFile(signerKeystore, data, 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c := DefaultConfig()
+	c.Index = 2
+	c.Keystore = keystore
+	c.SignerKeystore = signerKeystore
+	c.Network = network
+	c.ListenAddress = "127.0.0.1:20002"
+	c.MaxLegacyTxs = 1
+	// an observer peer syncing blocks with its signing key
+	observer := newSigners(5)[5]
+	c.Peers = []PeerConfig{{Index: 5, Address: "127.0.0.1:20005", SigningKey: hex.EncodeToString(crypto.CompressPubkey(&observer.PublicKey))}}
+	n, err := NewNodeFromConfig(c, "secret")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !n.validator || len(n.Validators()) != 3 || n.quorum() != 3 {
+		t.Fatalf("invalid validator set")
+	}
+	if s, err := n.signers.Lookup(5); err != nil || !s.Equal(&observer.PublicKey) {
+		t.Fatalf("signing key of the observer peer not known")
+	}
+	c.Peers = nil
+
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	if err := n.PendLegacyTx(tx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := n.PendLegacyTx(tx); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the keystore should belong to the configured validator
+	c.Index = 3
+	if _, err := NewNodeFromConfig(c, "secret"); err == nil {
+		t.Fatalf("keystore of another validator is accepted")
+	}
+}
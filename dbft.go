@@ -2,7 +2,12 @@ package dbft
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -19,80 +24,196 @@ import (
 // the address of mev fee receiver, here use zero address
 var ZeroAddress = common.HexToAddress("0x0000000000000000000000000000000000000000")
 
+const (
+	maxFutureMessages = 128 // the maximum number of cached messages of a validator for future heights and views
+	maxFutureHeights  = 16  // messages further ahead than this are dropped
+)
+
+// errors returned for rejected transactions
+var (
+	ErrPoolFull           = errors.New("mempool is full")
+	ErrInvalidEnvelope    = errors.New("invalid envelope")
+	ErrNotEnoughFee       = errors.New("not enough service fee")
+	ErrWrongPaymentTarget = errors.New("wrong payment target")
+)
+
+// ErrInvalidMessage is returned by HandleMsg when a message can't be decoded or
+// verified, such messages are dropped and counted against the sender.
+var ErrInvalidMessage = errors.New("invalid message")
+
 type Node struct {
-	index            byte             // validator index
-	prv              *tpke.PrivateKey // private key for decryption and signature
-	pub              *tpke.PublicKey  // public key for verification
-	neighborPubKeys  map[uint16]*tpke.PublicKey
-	globalPubKey     *tpke.PublicKey // public key for users' encryption
-	keyEnabledHeight uint64          // the beginning point of height that the global public key is used in encryption and decryption
-	scaler           int             // a scaler factor generated by DKG for computation speed up
-
-	blocks     map[uint64]*Block    // blocks
-	height     uint64               // current height
-	view       byte                 // view number
-	viewLock   bool                 // a lock to stop change view after decryption sharing
-	txList     []*types.Transaction // transactions selected for next block
-	envelopNum int                  // number of enveloped tx in txList
-	proposal   *types.Header        // consensus proposal as a header
+	index            byte              // validator index
+	validator        bool              // whether the node is in the validator set, otherwise it only follows the consensus
+	signer           *ecdsa.PrivateKey // private key for message witnesses
+	signers          SignerSet         // message signing keys of other nodes
+	prv              *tpke.PrivateKey  // private key share for decryption and block signature
+	pub              *tpke.PublicKey   // public key share for verification
+	neighborPubKeys  ValidatorSet
+	globalPubKey     *tpke.PublicKey            // public key for users' encryption
+	keyEnabledHeight uint64                     // the beginning point of height that the global public key is used in encryption and decryption
+	scaler           int                        // a scaler factor generated by DKG, shares are combined without it
+	epoch            uint64                     // the number of the key epoch in use
+	epochInterval    uint64                     // the number of blocks between key rotations, 0 if keys are never rotated
+	nextEpochHeight  uint64                     // the height where the next key epoch begins
+	keyDeals         map[uint16]*keyDeal        // the deals of the next epoch by dealer
+	keyComplaints    map[uint16]map[uint16]bool // the members complaining about the deals of the next epoch by dealer
+	keyDealMsgs      []*message.Payload         // the key deal messages of the next epoch handled or sent, persisted
+	oldEpochs        []*KeyEpoch                // previous epochs still accepted for decryption
+	epochGrace       uint64                     // the number of blocks an old epoch is accepted after rotation
+	pendingChange    *validatorChange           // the scheduled change of the validator set
+
+	blocks     map[uint64]*Block               // the latest blocks, all of them without a store
+	blockIndex map[common.Hash]uint64          // heights of blocks by header hash
+	txIndex    map[common.Hash]TxLocation      // positions of committed transactions by hash
+	envelopes  map[common.Hash]*EnvelopeRecord // status of carriers by hash
+	height     uint64                          // current height
+	view       byte                            // view number
+	viewLock   bool                            // a lock to stop change view after decryption sharing
+	txList     []*types.Transaction            // transactions selected for next block
+	envelopNum int                             // number of enveloped tx in txList
+	proposal   *types.Header                   // consensus proposal as a header
+	decision   *message.KeyDecision            // the key decision of the proposal, nil for most blocks
+	locked     *lockedProposal                 // the block this node has sent commit for at the current height
+	sent       []*message.Payload              // messages this node has sent in the current view
 
 	// message pool
 	prepareResponses map[uint16]*message.PrepareResponse
 	finalizes        map[uint16]*message.Finalize
 	dbftFinalized    bool
 	commits          map[uint16]*message.Commit
+	earlyCommits     map[uint16]*message.Commit  // commits received before this node has locked
+	earlyFinalizes   map[uint16]*message.Payload // finalizes received before the proposal
 	dbftCommited     bool
 	changeViews      map[uint16]*message.ChangeView
+	invalidMessages  map[uint16]int // number of malformed messages received from each validator
+	evidence         *EvidencePool  // signed votes and detected equivocations
+	futureMessages   map[futureKey][]*message.Payload
+	futureCount      int            // number of cached future messages
+	futureSenders    map[uint16]int // number of cached future messages per validator
+	staleMessages    int            // number of messages dropped for past heights and views
+	unknownSenders   int            // number of messages dropped for coming from outside of the validator set
 
 	// P2P channel, handler and mempool
 	neighbors      []chan<- *message.Payload
+	peers          map[uint16]chan<- *message.Payload // neighbors by validator index, for point-to-point messages
 	messageHandler chan *message.Payload
+	txHandler      chan txRequest       // transactions submitted while the event loop runs
+	callHandler    chan func()          // queries run inside the event loop
 	legacyPool     []*types.Transaction // the mempool for legacy tx
 	envelopePool   []*types.Transaction // an independent mempool only handles enveloped tx
+	maxLegacyTxs   int                  // the capacity of the legacy mempool, 0 if unlimited
+	maxEnvelopes   int                  // the capacity of the envelope mempool, 0 if unlimited
+	feeParams      transaction.FeeParams
+
+	// timers of the event loop, 0 if disabled
+	blockTime   time.Duration // the time the primary waits before proposing
+	viewTimeout time.Duration // the time to wait for a block before asking for change view
+
+	store   *BlockStore  // persists committed blocks, optional
+	logger  *slog.Logger // debug logs on every message decision
+	feed    feed         // subscriptions to consensus events
+	metrics *Metrics     // consensus instrumentation, optional
+	journal *Journal     // records inputs and outputs, optional
+
+	// block sync
+	syncTarget    uint64    // the highest height announced by peers
+	syncRequested time.Time // when the pending block request was sent, zero if none
+	syncServed    map[uint16]*serveLimit
+}
 
-	// stop signal, just for testing
-	stopSignalHandler chan any
+// lockedProposal is the block a node has sent Commit for. The lock is kept across
+// view changes and the node never commits another block at the same height, so
+// re-proposals in later views have to carry the locked block.
+type lockedProposal struct {
+	proposal   *types.Header        // the prepared header, before decryption
+	txList     []*types.Transaction // the prepared tx sequence
+	envelopNum int
+	header     *types.Header        // the final header that was signed in commit
+	final      []*types.Transaction // the final tx sequence with decrypted transactions
+	links      []CarrierLink
+	decision   *message.KeyDecision
 }
 
-// set up a node based on dkg
-func NewNode(index byte, prv *tpke.PrivateKey, pub *tpke.PublicKey, globalPub *tpke.PublicKey, keyEnabledHeight uint64, scaler int) *Node {
+// futureKey is the round a cached future message belongs to
+type futureKey struct {
+	height uint64
+	view   byte
+}
+
+// set up a node based on dkg, the signer signs consensus messages and is kept
+// apart from the key share, so either of them can be rotated alone
+func NewNode(index byte, signer *ecdsa.PrivateKey, prv *tpke.PrivateKey, pub *tpke.PublicKey, globalPub *tpke.PublicKey, keyEnabledHeight uint64, scaler int) *Node {
 	return &Node{
 		index:            index,
+		validator:        prv != nil,
+		signer:           signer,
+		signers:          make(SignerSet),
 		prv:              prv,
 		pub:              pub,
-		neighborPubKeys:  make(map[uint16]*tpke.PublicKey),
+		neighborPubKeys:  make(ValidatorSet),
 		globalPubKey:     globalPub,
 		keyEnabledHeight: keyEnabledHeight,
 		scaler:           scaler,
+		epochGrace:       defaultEpochGrace,
 
 		blocks:     make(map[uint64]*Block),
+		blockIndex: make(map[common.Hash]uint64),
+		txIndex:    make(map[common.Hash]TxLocation),
+		envelopes:  make(map[common.Hash]*EnvelopeRecord),
 		height:     0,
 		view:       0,
 		viewLock:   false,
 		txList:     nil,
 		envelopNum: 0,
 		proposal:   nil,
+		locked:     nil,
 
 		prepareResponses: make(map[uint16]*message.PrepareResponse),
 		finalizes:        make(map[uint16]*message.Finalize),
 		dbftFinalized:    false,
 		commits:          make(map[uint16]*message.Commit),
+		earlyCommits:     make(map[uint16]*message.Commit),
+		earlyFinalizes:   make(map[uint16]*message.Payload),
 		dbftCommited:     false,
 		changeViews:      make(map[uint16]*message.ChangeView),
+		invalidMessages:  make(map[uint16]int),
+		evidence:         NewEvidencePool(),
+		futureMessages:   make(map[futureKey][]*message.Payload),
+		futureSenders:    make(map[uint16]int),
+		syncServed:       make(map[uint16]*serveLimit),
 
 		neighbors:      make([]chan<- *message.Payload, 0),
+		peers:          make(map[uint16]chan<- *message.Payload),
 		messageHandler: make(chan *message.Payload, 100),
+		txHandler:      make(chan txRequest),
+		logger:         slog.New(discardHandler{}),
+		callHandler:    make(chan func()),
 		legacyPool:     make([]*types.Transaction, 0),
 		envelopePool:   make([]*types.Transaction, 0),
-
-		stopSignalHandler: make(chan any, 1),
+		feeParams:      transaction.DefaultFeeParams,
 	}
 }
 
+// set up a node outside of the validator set, it follows the consensus and
+// can join the validator set later
+func NewObserver(index byte, signer *ecdsa.PrivateKey, globalPub *tpke.PublicKey, keyEnabledHeight uint64, scaler int) *Node {
+	return NewNode(index, signer, nil, nil, globalPub, keyEnabledHeight, scaler)
+}
+
 func (n *Node) GetIndex() byte {
 	return n.index
 }
 
+// get the height of the latest committed block
+func (n *Node) GetHeight() uint64 {
+	return n.height
+}
+
+// get the view of the current round
+func (n *Node) GetView() byte {
+	return n.view
+}
+
 func (n *Node) GetHandler() chan<- *message.Payload {
 	return n.messageHandler
 }
@@ -101,37 +222,166 @@ func (n *Node) GetPublicKey() *tpke.PublicKey {
 	return n.pub
 }
 
+func (n *Node) GetSigningKey() *ecdsa.PublicKey {
+	if n.signer == nil {
+		return nil
+	}
+	return &n.signer.PublicKey
+}
+
+// get the number of invalid messages received from a validator
+func (n *Node) InvalidMessages(index uint16) int {
+	return n.invalidMessages[index]
+}
+
+// get the number of messages dropped for being too late
+func (n *Node) StaleMessages() int {
+	return n.staleMessages
+}
+
+// get the number of messages dropped for coming from an unknown validator
+func (n *Node) UnknownSenderMessages() int {
+	return n.unknownSenders
+}
+
+// get the validator set this node accepts messages from
+func (n *Node) Validators() ValidatorSet {
+	return n.neighborPubKeys
+}
+
+// get the number of messages waiting for a future height or view
+func (n *Node) FutureMessages() int {
+	return n.futureCount
+}
+
+// get the detected equivocations which are not included into a block yet
+func (n *Node) PendingEvidence() []*Evidence {
+	return n.evidence.Pending()
+}
+
+// remove the evidence included into a block from the pending list
+func (n *Node) MarkEvidenceIncluded(es []*Evidence) {
+	n.evidence.MarkIncluded(es)
+}
+
 func (n *Node) Connect(ns []*Node) {
 	for _, v := range ns {
 		if v.index == n.index {
 			continue
 		}
 		n.neighbors = append(n.neighbors, v.GetHandler())
-		n.neighborPubKeys[uint16(v.GetIndex())] = v.GetPublicKey()
+		n.peers[uint16(v.GetIndex())] = v.GetHandler()
+		if v.GetPublicKey() != nil {
+			n.neighborPubKeys[uint16(v.GetIndex())] = v.GetPublicKey()
+		}
+		if v.GetSigningKey() != nil {
+			n.signers[uint16(v.GetIndex())] = v.GetSigningKey()
+		}
 	}
 }
 
+// add a remote validator reached through the channel, its keys should be
+// known from the network config
+func (n *Node) AddPeer(index uint16, ch chan<- *message.Payload) {
+	n.neighbors = append(n.neighbors, ch)
+	n.peers[index] = ch
+}
+
+// txRequest is a transaction handed to the event loop
+type txRequest struct {
+	tx     *types.Transaction
+	result chan<- error
+}
+
+// add a tx to the right mempool, carriers are transfers to the zero address
+// with an envelope as data, anything else is a legacy tx
+func (n *Node) PendTx(tx *types.Transaction) error {
+	if IsCarrier(tx) {
+		return n.PendEnvelopedTx(tx)
+	}
+	return n.PendLegacyTx(tx)
+}
+
+// IsCarrier reports whether the tx carries an envelope
+func IsCarrier(tx *types.Transaction) bool {
+	if tx.To() == nil || *tx.To() != ZeroAddress {
+		return false
+	}
+	return len(tx.Data()) >= transaction.HeaderLen+transaction.SeedLen
+}
+
+// SubmitTx hands a tx to the running event loop, it is safe to call from
+// other goroutines
+func (n *Node) SubmitTx(ctx context.Context, tx *types.Transaction) error {
+	result := make(chan error, 1)
+	select {
+	case n.txHandler <- txRequest{tx: tx, result: result}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Call runs f inside the running event loop and waits for it, so f can read
+// the node state safely from other goroutines
+func (n *Node) Call(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case n.callHandler <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// set the rule envelope fees are checked with
+func (n *Node) SetFeeParams(p transaction.FeeParams) {
+	n.feeParams = p
+}
+
+// get the rule envelope fees are checked with
+func (n *Node) FeeParams() transaction.FeeParams {
+	return n.feeParams
+}
+
 // add a legacy tx to mempool
 func (n *Node) PendLegacyTx(tx *types.Transaction) error {
+	if n.maxLegacyTxs > 0 && len(n.legacyPool) >= n.maxLegacyTxs {
+		return ErrPoolFull
+	}
 	n.legacyPool = append(n.legacyPool, tx)
+	n.metrics.setPools(len(n.legacyPool), len(n.envelopePool))
 	return nil
 }
 
 // add a enveloped tx to mempool
 func (n *Node) PendEnvelopedTx(tx *types.Transaction) error {
 	// only resolvable envelope can be added to this mempool
+	if n.maxEnvelopes > 0 && len(n.envelopePool) >= n.maxEnvelopes {
+		return ErrPoolFull
+	}
 	envelope, err := transaction.BytesToEnvelope(tx.Data())
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrInvalidEnvelope, err)
 	}
-	if envelope.EncryptHeight < n.keyEnabledHeight {
-		return errors.New("encryption expired")
+	if _, err := n.envelopeKey(envelope, n.currentEpoch()); err != nil {
+		return err
 	}
-	if envelope.ComputeFee().Cmp(tx.Value()) > 0 {
-		return errors.New("not enough service fee")
+	if envelope.ComputeFeeWith(n.feeParams).Cmp(tx.Value()) > 0 {
+		return ErrNotEnoughFee
 	}
-	if tx.To().Cmp(ZeroAddress) != 0 {
-		return errors.New("wrong payment target")
+	if tx.To() == nil || tx.To().Cmp(ZeroAddress) != 0 {
+		return ErrWrongPaymentTarget
 	}
 	// verify that user provides a random r as he commits
 	// CNs will only focus and decrypt the random r to generate the seed point
@@ -139,27 +389,59 @@ func (n *Node) PendEnvelopedTx(tx *types.Transaction) error {
 	// the envelope will be dropped and we cannot say any CN is malicious
 	err = envelope.EncryptedSeed.Verify()
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrInvalidEnvelope, err)
 	}
 	n.envelopePool = append(n.envelopePool, tx)
+	n.setEnvelopeStatus(tx.Hash(), EnvelopePending, n.height, nil)
+	n.metrics.setPools(len(n.legacyPool), len(n.envelopePool))
 	return nil
 }
 
 func (n *Node) RefreshEnvelopePool() error {
-	for i, v := range n.envelopePool {
+	cur := n.currentEpoch()
+	pool := make([]*types.Transaction, 0, len(n.envelopePool))
+	for _, v := range n.envelopePool {
 		envelope, err := transaction.BytesToEnvelope(v.Data())
 		if err != nil {
 			return err
 		}
-		if envelope.EncryptHeight < n.keyEnabledHeight {
-			n.envelopePool = append(n.envelopePool[:i], n.envelopePool[i+1:]...)
+		if _, err := n.envelopeKey(envelope, cur); err == nil {
+			pool = append(pool, v)
+		} else {
+			n.setEnvelopeStatus(v.Hash(), EnvelopeExpired, n.height, nil)
 		}
 	}
+	n.envelopePool = pool
+	n.metrics.setPools(len(n.legacyPool), len(n.envelopePool))
 	return nil
 }
 
+// the number of votes from other validators needed to move on
+func (n *Node) quorum() int {
+	size := len(n.neighborPubKeys)
+	if n.validator {
+		size += 1
+	}
+	return quorumOf(size)
+}
+
+// the number of votes needed in a validator set of the given size
+func quorumOf(size int) int {
+	return size - (size-1)/3
+}
+
 // propose a new block and start consensus
 func (n *Node) Propose() {
+	if !n.validator {
+		return
+	}
+
+	// a locked node can only re-propose the block it has committed to
+	if n.locked != nil {
+		n.proposeLocked()
+		return
+	}
+
 	// propose the tx sequence
 	txhashes := make([]util.Uint256, len(n.envelopePool)+len(n.legacyPool))
 	for i, v := range n.envelopePool {
@@ -178,15 +460,44 @@ func (n *Node) Propose() {
 	// build a pre-header for consensus of the tx sequence
 	txhash := types.DeriveSha(types.Transactions(append(n.envelopePool, n.legacyPool...)), trie.NewStackTrie(nil))
 	h := &types.Header{
-		TxHash: txhash,
+		ParentHash: n.parentHash(),
+		Number:     new(big.Int).SetUint64(n.height + 1),
+		TxHash:     txhash,
 		// Root: stateRoot,
 		// ......
 	}
-	n.proposal = h
+	n.decision = n.decideKeys()
+	h.Extra = decisionExtra(n.decision)
+	n.proposal = types.CopyHeader(h)
 	n.txList = append(n.envelopePool, n.legacyPool...)
 	n.envelopNum = len(n.envelopePool)
+	n.proposeEnvelopes()
+	n.metrics.startRound()
+	n.emitProposal(uint16(n.index))
+	n.logRound(slog.LevelInfo, "proposing block", "txs", len(n.txList), "envelopes", n.envelopNum)
 
-	// broadcast prepare request
+	n.broadcastPrepareRequest(h, txhashes, n.decision)
+}
+
+// re-propose the locked block in the current view
+func (n *Node) proposeLocked() {
+	txhashes := make([]util.Uint256, len(n.locked.txList))
+	for i, v := range n.locked.txList {
+		txhashes[i] = util.Uint256(v.Hash())
+	}
+	n.proposal = types.CopyHeader(n.locked.proposal)
+	n.decision = n.locked.decision
+	n.txList = n.locked.txList
+	n.envelopNum = n.locked.envelopNum
+	n.proposeEnvelopes()
+	n.metrics.startRound()
+	n.emitProposal(uint16(n.index))
+	n.logRound(slog.LevelInfo, "re-proposing locked block", "hash", n.proposal.Hash())
+
+	n.broadcastPrepareRequest(types.CopyHeader(n.locked.proposal), txhashes, n.locked.decision)
+}
+
+func (n *Node) broadcastPrepareRequest(h *types.Header, txhashes []util.Uint256, decision *message.KeyDecision) {
 	msg := &message.Payload{
 		Message: message.Message{
 			Type:           payload.PrepareRequestType,
@@ -198,31 +509,119 @@ func (n *Node) Propose() {
 	msg.SetPayload(message.PrepareRequest{
 		SealingProposal: h,
 		TxHashes:        txhashes,
+		KeyDecision:     decision,
 	})
-	msg.Sign(n.prv)
+	n.broadcast(msg)
+}
+
+// broadcast signs a message and sends it to all neighbors, nodes outside of
+// the validator set only follow the consensus and never send anything
+func (n *Node) broadcast(msg *message.Payload) {
+	if !n.validator || n.signer == nil {
+		return
+	}
+	msg.Sign(n.signer)
+
+	// the round is persisted before anything leaves the node
+	n.sent = append(n.sent, msg)
+	if err := n.saveRound(); err != nil {
+		n.sent = n.sent[:len(n.sent)-1]
+		n.logRound(slog.LevelError, "failed to save round, message not sent", "type", message.TypeName(msg.Type()), "err", err)
+		return
+	}
+	n.metrics.message(msg.Type(), "out")
+	n.recordMsg(JournalOut, msg)
 	for i := 0; i < len(n.neighbors); i++ {
 		n.neighbors[i] <- msg
 	}
 }
 
-func (n *Node) HandleMsg(m *message.Payload) {
-	// drop some scam
-	if m.BlockIndex != n.height+1 {
-		return
+// reject drops an invalid message and counts it against the sender
+func (n *Node) reject(m *message.Payload, err error) error {
+	n.invalidMessages[m.ValidatorIndex()] += 1
+	n.metrics.invalidMessage(m.ValidatorIndex())
+	n.logMsg(slog.LevelDebug, "rejected invalid message", m, "err", err, "invalid", n.invalidMessages[m.ValidatorIndex()])
+	return fmt.Errorf("%w from validator %d: %w", ErrInvalidMessage, m.ValidatorIndex(), err)
+}
+
+func (n *Node) HandleMsg(m *message.Payload) error {
+	// drop some scam, key deals and block sync are not bound to a round
+	isRound := !isKeyDeal(m.Type()) && !isSync(m.Type())
+	if isRound && (m.BlockIndex < n.height+1 || m.BlockIndex == n.height+1 && m.ViewNumber() < n.view) {
+		n.staleMessages += 1
+		n.metrics.staleMessage(1)
+		n.logMsg(slog.LevelDebug, "dropped stale message", m)
+		return nil
 	}
-	if m.ViewNumber() != n.view {
-		return
+	// senders should be in the validator set with a known signing key, block
+	// requests only ask for committed blocks, so observers with a known
+	// signing key may send them too
+	var signer *ecdsa.PublicKey
+	var err error
+	switch {
+	case m.Type() == message.BlockRequestType:
+	case m.Type() == message.KeyComplaintType && n.isNextMember(m.ValidatorIndex()):
+		// members joining with the next epoch complain about their shares too
+	default:
+		_, err = n.neighborPubKeys.Lookup(m.ValidatorIndex())
 	}
-	if !m.Verify(n.neighborPubKeys[m.ValidatorIndex()]) {
-		return
+	if err == nil {
+		signer, err = n.signers.Lookup(m.ValidatorIndex())
+	}
+	if err != nil {
+		// not counted against the sender, since the index isn't a validator
+		n.unknownSenders += 1
+		n.metrics.unknownSender()
+		n.logMsg(slog.LevelDebug, "dropped message from unknown sender", m, "err", err)
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
 
+	if err := m.Verify(signer); err != nil {
+		return n.reject(m, err)
+	}
+
+	// keep messages of future rounds until this node gets there, they are
+	// handled again on replay since the validator set may change at an epoch
+	// boundary
+	if isRound && (m.BlockIndex > n.height+1 || m.ViewNumber() > n.view) {
+		n.cacheFuture(m)
+		n.logMsg(slog.LevelDebug, "cached future message", m, "cached", n.futureCount)
+		return nil
+	}
+
+	// keep signed votes to detect equivocation
+	n.evidence.Add(m)
+
 	// handle
 	if m.Type() == payload.PrepareRequestType {
-		prepareRequest := m.Payload().(message.PrepareRequest)
-		h := prepareRequest.SealingProposal
+		prepareRequest, ok := m.Payload().(message.PrepareRequest)
+		if !ok || prepareRequest.SealingProposal == nil {
+			return n.reject(m, errors.New("malformed prepare request"))
+		}
+		if m.ValidatorIndex() != n.primaryIndex() {
+			return n.reject(m, fmt.Errorf("prepare request from validator %d, the primary is %d", m.ValidatorIndex(), n.primaryIndex()))
+		}
+		// a node responds once per view, another proposal of the primary is ignored
+		if n.sentMsg(payload.PrepareResponseType) != nil {
+			n.logMsg(slog.LevelDebug, "dropped prepare request, already responded", m)
+			return nil
+		}
+		h := types.CopyHeader(prepareRequest.SealingProposal)
 		txhs := prepareRequest.TxHashes
 
+		// the proposal should extend the chain of this node, or the block
+		// can't be verified once committed
+		if h.Number == nil || h.Number.Uint64() != n.height+1 || h.ParentHash != n.parentHash() {
+			n.requestChangeView(payload.CVChangeAgreement)
+			return n.reject(m, fmt.Errorf("proposal of block %v on parent %s, expected block %d on %s", h.Number, h.ParentHash, n.height+1, n.parentHash()))
+		}
+		// the header commits to the key decision, so responses agree on it
+		decision := prepareRequest.KeyDecision
+		if !bytes.Equal(h.Extra, decisionExtra(decision)) {
+			n.requestChangeView(payload.CVChangeAgreement)
+			return n.reject(m, errors.New("proposal header doesn't commit to the key decision"))
+		}
+
 		// verify request, deal anti-mev tx as normal tx (consider all tx are enveloped tx in this code)
 		txsChecked := true
 		envelopNum := 0
@@ -250,6 +649,18 @@ func (n *Node) HandleMsg(m *message.Payload) {
 		}
 		hChecked := types.DeriveSha(types.Transactions(txs), trie.NewStackTrie(nil)) == h.TxHash
 
+		// a locked node only accepts the re-proposal of its locked block
+		hChecked = hChecked && (n.locked == nil || n.locked.proposal.Hash() == h.Hash())
+
+		// a validator only accepts the key decision matching its own deals,
+		// the locked decision was checked before
+		if hChecked && decision != nil && n.validator && n.locked == nil {
+			if err := n.checkKeyDecision(decision); err != nil {
+				n.logMsg(slog.LevelDebug, "proposal has an unacceptable key decision", m, "err", err)
+				hChecked = false
+			}
+		}
+
 		// execute and verify envelope carriers locally
 		// ......
 		// ...... stateRoot = execute(txs[:envelopNum])
@@ -260,31 +671,21 @@ func (n *Node) HandleMsg(m *message.Payload) {
 		n.txList = txs
 		n.envelopNum = envelopNum
 		n.proposal = h
+		n.decision = decision
+		n.proposeEnvelopes()
+		n.metrics.startRound()
+		n.emitProposal(m.ValidatorIndex())
 
 		// broadcast response
 		if !txsChecked {
 			// request missing txs
+			n.logMsg(slog.LevelDebug, "proposal has unknown transactions", m, "txs", len(txhs), "known", len(txs))
 		} else if !hChecked {
-			// request change view
-			msg := &message.Payload{
-				Message: message.Message{
-					Type:           payload.ChangeViewType,
-					ValidatorIndex: n.index,
-					BlockIndex:     m.BlockIndex,
-					ViewNumber:     m.ViewNumber(),
-				},
-			}
-			msg.SetPayload(message.ChangeView{
-				NewViewNumber: m.ViewNumber() + 1,
-				Timestamp:     uint64(time.Now().Unix()),
-				Reason:        payload.CVChangeAgreement,
-			})
-			msg.Sign(n.prv)
-			for i := 0; i < len(n.neighbors); i++ {
-				n.neighbors[i] <- msg
-			}
+			n.logMsg(slog.LevelDebug, "proposal header mismatch", m, "locked", n.locked != nil)
+			n.requestChangeView(payload.CVChangeAgreement)
 		}
 		if txsChecked && hChecked {
+			n.logMsg(slog.LevelDebug, "accepted proposal", m, "txs", len(txs), "envelopes", envelopNum)
 			msg := &message.Payload{
 				Message: message.Message{
 					Type:           payload.PrepareResponseType,
@@ -296,13 +697,26 @@ func (n *Node) HandleMsg(m *message.Payload) {
 			msg.SetPayload(message.PrepareResponse{
 				PreparationHash: util.Uint256(h.Hash()),
 			})
-			msg.Sign(n.prv)
-			for i := 0; i < len(n.neighbors); i++ {
-				n.neighbors[i] <- msg
-			}
+			n.broadcast(msg)
+		}
+
+		// the finalizes arrived before can be checked now
+		early := n.earlyFinalizes
+		n.earlyFinalizes = make(map[uint16]*message.Payload)
+		for _, f := range early {
+			n.HandleMsg(f)
 		}
 	} else if m.Type() == payload.PrepareResponseType {
-		prepareResponse := m.Payload().(message.PrepareResponse)
+		prepareResponse, ok := m.Payload().(message.PrepareResponse)
+		if !ok {
+			return n.reject(m, errors.New("malformed prepare response"))
+		}
+
+		if n.proposal == nil {
+			// no proposal to respond to yet
+			n.logMsg(slog.LevelDebug, "dropped prepare response without proposal", m)
+			return nil
+		}
 
 		// verify response
 		checked := prepareResponse.PreparationHash == util.Uint256(n.proposal.Hash())
@@ -310,24 +724,35 @@ func (n *Node) HandleMsg(m *message.Payload) {
 		// count vote
 		if checked {
 			n.prepareResponses[m.ValidatorIndex()] = &prepareResponse
+			n.logMsg(slog.LevelDebug, "counted prepare response", m, "responses", len(n.prepareResponses), "quorum", n.quorum())
+		} else {
+			n.logMsg(slog.LevelDebug, "dropped prepare response for another proposal", m)
 		}
 
-		if len(n.prepareResponses) == len(n.neighbors)*2/3+1 {
-			// generate decrypt share for anti-mev tx
-			s := make([]*tpke.DecryptionShare, 0)
-			for i, v := range n.txList {
-				if i < n.envelopNum {
-					envelope, err := transaction.BytesToEnvelope(v.Data())
-					if err != nil {
-						continue
-					}
-					s = append(s, n.prv.DecryptShare(envelope.EncryptedSeed))
-				}
+		if len(n.prepareResponses) == n.quorum() {
+			n.metrics.endPhase("prepare")
+			n.emit(PrepareQuorumEvent{Height: n.height + 1, View: n.view, Responses: len(n.prepareResponses)})
+		}
+		if len(n.prepareResponses) == n.quorum() && n.validator && n.sentMsg(message.FinalizeType) != nil {
+			// the shares were sent before a restart and are sent again on start
+			n.logRound(slog.LevelDebug, "decryption shares already sent")
+		} else if len(n.prepareResponses) == n.quorum() && n.validator {
+			// generate decrypt share for anti-mev tx, with the key of its epoch
+			sealed := n.sealedEnvelopes()
+			s := make([]*tpke.DecryptionShare, len(sealed))
+			for i, v := range sealed {
+				s[i] = v.key.PrivateKey.DecryptShare(v.envelope.EncryptedSeed)
 			}
 			share := EncodeDecryptionShare(s)
+			epochs := sealedEpochs(sealed)
+			proofs := make([][]byte, len(epochs))
+			for i, key := range epochs {
+				proofs[i] = EncodeSignatureShare(key.PrivateKey.SignShare(keyProofMessage))
+			}
 
 			// lock change view
 			n.viewLock = true
+			n.logRound(slog.LevelDebug, "sending decryption shares", "envelopes", len(sealed))
 
 			// broadcast finalize
 			msg := &message.Payload{
@@ -340,64 +765,131 @@ func (n *Node) HandleMsg(m *message.Payload) {
 			}
 			msg.SetPayload(message.Finalize{
 				DecryptShare: share,
+				KeyProofs:    proofs,
 			})
-			msg.Sign(n.prv)
-			for i := 0; i < len(n.neighbors); i++ {
-				n.neighbors[i] <- msg
-			}
+			n.broadcast(msg)
 		}
 	} else if m.Type() == message.FinalizeType {
-		finalize := m.Payload().(message.Finalize)
+		finalize, ok := m.Payload().(message.Finalize)
+		if !ok {
+			return n.reject(m, errors.New("malformed finalize"))
+		}
+		// shares are checked against the proposal, the ones arriving before it
+		// are handled once it is known
+		if n.proposal == nil {
+			n.earlyFinalizes[m.ValidatorIndex()] = m
+			n.logMsg(slog.LevelDebug, "kept finalize until the proposal", m)
+			return nil
+		}
+		if err := n.verifyFinalize(m.ValidatorIndex(), &finalize); err != nil {
+			n.metrics.shareFailed()
+			return n.reject(m, err)
+		}
 
 		// count vote
 		n.finalizes[m.ValidatorIndex()] = &finalize
+		n.logMsg(slog.LevelDebug, "counted finalize", m, "finalizes", len(n.finalizes), "quorum", n.quorum())
 
-		if len(n.finalizes) >= len(n.neighbors)*2/3+1 && !n.dbftFinalized {
-			// try decrypt tx data
-			bs := make([][]byte, 0)           // encrypted transactions
-			cs := make([]*tpke.CipherText, 0) // seeds for decryption
-			for i, v := range n.txList {
-				if i < n.envelopNum {
-					envelope, err := transaction.BytesToEnvelope(v.Data())
+		if len(n.finalizes) >= n.quorum() && !n.dbftFinalized {
+			// try decrypt tx data, envelopes are grouped by the epoch they are encrypted to
+			sealed := n.sealedEnvelopes()
+			groups := make(map[uint64][]int) // positions of envelopes per epoch
+			for i, v := range sealed {
+				groups[v.key.Number] = append(groups[v.key.Number], i)
+			}
+			shares := make(map[uint16][]*tpke.DecryptionShare)
+			for i, v := range n.finalizes {
+				// shares are checked on receipt
+				shares[i], _ = DecodeDecryptionShare(v.DecryptShare)
+			}
+			plain := make([][]byte, len(sealed)) // decrypted transactions
+			for k, key := range sealedEpochs(sealed) {
+				pos := groups[key.Number]
+				cs := make([]*tpke.CipherText, len(pos)) // seeds for decryption
+				for j, p := range pos {
+					cs[j] = sealed[p].envelope.EncryptedSeed
+				}
+				inputs := make(map[int][]*tpke.DecryptionShare)
+				for i, share := range shares {
+					in := make([]*tpke.DecryptionShare, len(pos))
+					for j, p := range pos {
+						in[j] = share[p]
+					}
+					inputs[int(i)] = in
+				}
+				if key.PrivateKey == nil {
+					// without a key share the shares are only checked against each other
+					proofs := make(map[int]*tpke.SignatureShare)
+					for i, v := range n.finalizes {
+						proofs[int(i)], _ = DecodeSignatureShare(v.KeyProofs[k])
+					}
+					var err error
+					if inputs, err = consistentShares(inputs, proofs, key.Threshold+1); err != nil {
+						n.logRound(slog.LevelDebug, "too few agreeing decryption shares", "epoch", key.Number, "shares", len(inputs))
+						return nil
+					}
+				}
+				seeds, err := decryptSeeds(cs, inputs, key.GlobalPubKey, key.Threshold)
+				if err != nil {
+					// shares are verified on receipt, so this is not counted against them
+					n.logRound(slog.LevelWarn, "failed to combine decryption shares", "epoch", key.Number, "shares", len(inputs), "err", err)
+					// wait for another finalize message and will not change view
+					return nil
+				}
+				for j, p := range pos {
+					data, err := tpke.AESDecrypt(seeds[j], sealed[p].envelope.EncryptedTransaction)
 					if err != nil {
+						n.logRound(slog.LevelDebug, "envelope failed to decrypt", "carrier", n.txList[sealed[p].carrier].Hash(), "err", err)
 						continue
 					}
-					bs = append(bs, envelope.EncryptedTransaction)
-					cs = append(cs, envelope.EncryptedSeed)
+					plain[p] = data
 				}
 			}
-			inputs := make(map[int][]*tpke.DecryptionShare)
-			for i, v := range n.finalizes {
-				share := DecodeDecryptionShare(v.DecryptShare)
-				inputs[int(i)] = share
-			}
-			seeds, err := tpke.Decrypt(cs, inputs, n.globalPubKey, len(n.neighbors)*2/3, int(n.scaler))
-			if err != nil {
-				// wait for another finalize message and will not change view
-				return
-			}
 			n.dbftFinalized = true
 
 			// build the final block
 			finalTxList := make([]*types.Transaction, 0)
-			for i, v := range bs {
-				data, err := tpke.AESDecrypt(seeds[i], v)
-				if err != nil {
+			links := make([]CarrierLink, 0, len(plain))
+			for p, data := range plain {
+				carrier := n.txList[sealed[p].carrier].Hash()
+				if data == nil {
+					n.setEnvelopeStatus(carrier, EnvelopeInvalidInner, n.height+1, nil)
+					n.metrics.envelopeFailed()
 					continue
 				}
 				tx := new(types.Transaction)
 				s := rlp.NewStream(bytes.NewBuffer(data), 0)
 				err = tx.DecodeRLP(s)
 				if err != nil {
+					n.logRound(slog.LevelDebug, "decrypted envelope is not a transaction", "carrier", carrier, "err", err)
+					n.setEnvelopeStatus(carrier, EnvelopeInvalidInner, n.height+1, nil)
+					n.metrics.envelopeFailed()
 					continue
 				}
+				inner := tx.Hash()
+				n.setEnvelopeStatus(carrier, EnvelopeDecrypted, n.height+1, &inner)
+				links = append(links, CarrierLink{
+					Carrier: uint64(sealed[p].carrier),
+					Inner:   uint64(n.envelopNum + len(finalTxList)),
+				})
 				finalTxList = append(finalTxList, tx)
 			}
+			n.metrics.endPhase("finalize")
+			n.logRound(slog.LevelDebug, "decrypted envelopes", "envelopes", n.envelopNum, "decrypted", len(finalTxList))
+			n.emit(DecryptionEvent{
+				Height:    n.height + 1,
+				View:      n.view,
+				Envelopes: n.envelopNum,
+				Decrypted: len(finalTxList),
+				Invalid:   n.envelopNum - len(finalTxList),
+			})
 
 			// now we can have the final tx list, executed carriers at first, then decrypted envelopes, then legacy txs
-			finalTxList = append(n.txList[:n.envelopNum], finalTxList...)
-			finalTxList = append(finalTxList, n.txList[n.envelopNum:]...)
+			prepared := types.CopyHeader(n.proposal)
+			finalTxList = append(append(append(make([]*types.Transaction, 0, len(n.txList)+len(finalTxList)),
+				n.txList[:n.envelopNum]...), finalTxList...), n.txList[n.envelopNum:]...)
 			n.proposal.TxHash = types.DeriveSha(types.Transactions(finalTxList), trie.NewStackTrie(nil))
+			n.proposal.Extra = extraHash(uint64(n.envelopNum), links, n.decision).Bytes()
 
 			// execute all txs to get necessary info to build the final block
 			// ......
@@ -405,111 +897,496 @@ func (n *Node) HandleMsg(m *message.Payload) {
 			// ...... n.proposal.Root = stateRoot
 			// ......
 
-			// broadcast commit
-			msg := &message.Payload{
-				Message: message.Message{
-					Type:           payload.CommitType,
-					ValidatorIndex: n.index,
-					BlockIndex:     m.BlockIndex,
-					ViewNumber:     m.ViewNumber(),
-				},
+			// never commit another block at the locked height
+			if n.locked != nil && n.locked.header.Hash() != n.proposal.Hash() {
+				n.logRound(slog.LevelDebug, "final block differs from the locked one", "locked", n.locked.header.Hash(), "final", n.proposal.Hash())
+				return nil
 			}
-
-			msg.SetPayload(message.Commit{
-				FinalHash: util.Uint256(n.proposal.Hash()),
-				Signature: EncodeSignatureShare(n.prv.SignShare(n.proposal.Hash().Bytes())),
-			})
-			msg.Sign(n.prv)
-			for i := 0; i < len(n.neighbors); i++ {
-				n.neighbors[i] <- msg
+			if n.locked == nil {
+				n.locked = &lockedProposal{
+					proposal:   prepared,
+					txList:     n.txList,
+					envelopNum: n.envelopNum,
+					header:     types.CopyHeader(n.proposal),
+					final:      finalTxList,
+					links:      links,
+					decision:   n.decision,
+				}
 			}
-		}
-	} else if m.Type() == payload.CommitType {
-		commit := m.Payload().(message.Commit)
-
-		// verify header and sig
-		checked := commit.FinalHash == util.Uint256(n.proposal.Hash())
-		sig := DecodeSignature(commit.Signature)
-		checked = checked && n.neighborPubKeys[m.ValidatorIndex()].VerifySig(n.proposal.Hash().Bytes(), sig)
 
-		// increase local height and reset dbft
-		if checked {
-			n.commits[m.ValidatorIndex()] = &commit
-		}
+			// broadcast commit, observers have no key share and only collect the commits
+			if n.validator && n.prv != nil {
+				msg := &message.Payload{
+					Message: message.Message{
+						Type:           payload.CommitType,
+						ValidatorIndex: n.index,
+						BlockIndex:     m.BlockIndex,
+						ViewNumber:     m.ViewNumber(),
+					},
+				}
 
-		if len(n.commits) >= len(n.neighbors)*2/3+1 && !n.dbftCommited {
-			// compute the bls signature
-			shares := make(map[int]*tpke.SignatureShare, len(n.commits))
-			for i, v := range n.commits {
-				shares[int(i)] = DecodeSignatureShare(v.Signature)
+				msg.SetPayload(message.Commit{
+					FinalHash: util.Uint256(n.proposal.Hash()),
+					Signature: EncodeSignatureShare(n.prv.SignShare(n.proposal.Hash().Bytes())),
+				})
+				n.broadcast(msg)
 			}
-			// the global public key is necessary for verification
-			sig, err := tpke.AggregateAndVerifySig(n.globalPubKey, n.proposal.Hash().Bytes(), len(n.neighbors)*2/3+1, shares, int(n.scaler))
-			if err != nil {
-				// wait for another commit message and will not change view
-				return
-			}
-			n.dbftCommited = true
 
-			// finish
-			n.blocks[n.height+1] = &Block{
-				Header:       n.proposal,
-				Transactions: n.txList,
-				Signature:    sig.ToBytes(),
+			// count the commits which arrived before
+			for i, v := range n.earlyCommits {
+				// signatures are checked on receipt
+				sig, _ := DecodeSignature(v.Signature)
+				n.addCommit(i, v, sig)
 			}
-			n.height += 1
-			n.view = 0
-			n.viewLock = false
-
-			// reset for next round
-			n.txList = nil
-			n.proposal = nil
-			n.legacyPool = make([]*types.Transaction, 0)
-			n.envelopePool = make([]*types.Transaction, 0)
-			n.prepareResponses = make(map[uint16]*message.PrepareResponse)
-			n.finalizes = make(map[uint16]*message.Finalize)
-			n.dbftFinalized = false
-			n.commits = make(map[uint16]*message.Commit)
-			n.dbftCommited = false
-			n.changeViews = make(map[uint16]*message.ChangeView)
+			n.earlyCommits = make(map[uint16]*message.Commit)
+			return n.tryCommit()
+		}
+	} else if m.Type() == payload.CommitType {
+		commit, ok := m.Payload().(message.Commit)
+		if !ok {
+			return n.reject(m, errors.New("malformed commit"))
+		}
+		sig, err := DecodeSignature(commit.Signature)
+		if err != nil {
+			return n.reject(m, err)
+		}
+		if _, err := DecodeSignatureShare(commit.Signature); err != nil {
+			return n.reject(m, err)
+		}
 
-			// broadcast the new block
-			// ......
+		// commits arriving before this node has locked are checked once it locks
+		if n.locked == nil {
+			n.earlyCommits[m.ValidatorIndex()] = &commit
+			n.logMsg(slog.LevelDebug, "cached commit before locking", m)
+			return nil
 		}
+		n.addCommit(m.ValidatorIndex(), &commit, sig)
+		return n.tryCommit()
+	} else if isKeyDeal(m.Type()) {
+		return n.handleKeyDeal(m)
+	} else if isSync(m.Type()) {
+		return n.handleSync(m)
 	} else if m.Type() == payload.ChangeViewType {
-		changeView := m.Payload().(message.ChangeView)
+		changeView, ok := m.Payload().(message.ChangeView)
+		if !ok {
+			return n.reject(m, errors.New("malformed change view"))
+		}
 
-		// count vote
-		if changeView.NewViewNumber == n.view+1 && !n.viewLock {
+		// count vote, a view locked node doesn't ask for change view itself,
+		// but follows the quorum and keeps its commit lock
+		if changeView.NewViewNumber == n.view+1 {
 			n.changeViews[m.ValidatorIndex()] = &changeView
+			n.logMsg(slog.LevelDebug, "counted change view", m, "reason", changeView.Reason, "changeViews", len(n.changeViews), "quorum", n.quorum())
 		}
 
 		// change view
-		if len(n.changeViews) == len(n.neighbors)*2/3+1 {
+		if len(n.changeViews) == n.quorum() {
+			n.unproposeEnvelopes()
 			n.view += 1
+			n.viewLock = false
 			n.txList = nil
 			n.proposal = nil
+			n.decision = nil
 			n.prepareResponses = make(map[uint16]*message.PrepareResponse)
 			n.finalizes = make(map[uint16]*message.Finalize)
+			n.dbftFinalized = false
 			n.commits = make(map[uint16]*message.Commit)
+			n.earlyCommits = make(map[uint16]*message.Commit)
+			n.earlyFinalizes = make(map[uint16]*message.Payload)
+			n.dbftCommited = false
 			n.changeViews = make(map[uint16]*message.ChangeView)
+			n.sent = nil
+			if err := n.saveRound(); err != nil {
+				n.logRound(slog.LevelError, "failed to save round", "err", err)
+			}
+			n.metrics.viewChanged(changeView.Reason)
+			n.metrics.setRound(n.height, n.view)
+			n.logRound(slog.LevelInfo, "changed view", "reason", changeView.Reason)
+			n.emit(ViewChangeEvent{Height: n.height + 1, View: n.view, Reason: changeView.Reason})
+
+			n.replayFuture()
 		}
 	} else {
-		panic("UNKNOWN MSG")
+		return n.reject(m, fmt.Errorf("unknown message type 0x%02x", byte(m.Type())))
+	}
+	return nil
+}
+
+// addCommit counts a commit if it is for the locked block
+func (n *Node) addCommit(index uint16, commit *message.Commit, sig *tpke.Signature) {
+	pub, err := n.neighborPubKeys.Lookup(index)
+	if err != nil {
+		return
+	}
+	target := n.locked.header
+	checked := commit.FinalHash == util.Uint256(target.Hash())
+	checked = checked && pub.VerifySig(target.Hash().Bytes(), sig)
+	if checked {
+		n.commits[index] = commit
+		n.logRound(slog.LevelDebug, "counted commit", "validator", index, "commits", len(n.commits), "quorum", n.quorum())
+	} else {
+		n.logRound(slog.LevelDebug, "dropped commit for another block", "validator", index)
+	}
+}
+
+// verifyFinalize checks the decryption shares of a validator for the sealed
+// envelopes of the proposal. The key proofs are checked against the public key
+// shares of the validator, the shares are checked against the shares of this
+// node. Observers only check the key proofs, the shares are checked against
+// each other before they are combined.
+func (n *Node) verifyFinalize(index uint16, f *message.Finalize) error {
+	shares, err := DecodeDecryptionShare(f.DecryptShare)
+	if err != nil {
+		return err
+	}
+	sealed := n.sealedEnvelopes()
+	if len(shares) != len(sealed) {
+		return fmt.Errorf("%d decryption shares for %d envelopes", len(shares), len(sealed))
+	}
+	epochs := sealedEpochs(sealed)
+	if len(f.KeyProofs) != len(epochs) {
+		return fmt.Errorf("%d key proofs for %d epochs", len(f.KeyProofs), len(epochs))
+	}
+	for i, key := range epochs {
+		pub, err := key.PublicKeys.Lookup(index)
+		if err != nil {
+			return fmt.Errorf("epoch %d: %w", key.Number, err)
+		}
+		proof, err := DecodeSignatureShare(f.KeyProofs[i])
+		if err != nil {
+			return err
+		}
+		if !pub.VerifySigShare(keyProofMessage, proof) {
+			return fmt.Errorf("invalid key proof for epoch %d", key.Number)
+		}
+		if key.PrivateKey == nil {
+			continue
+		}
+		peer := make([]*tpke.DecryptionShare, 0, len(sealed))
+		own := make([]*tpke.DecryptionShare, 0, len(sealed))
+		for j, v := range sealed {
+			if v.key.Number == key.Number {
+				peer = append(peer, shares[j])
+				own = append(own, key.PrivateKey.DecryptShare(v.envelope.EncryptedSeed))
+			}
+		}
+		ownProof := key.PrivateKey.SignShare(keyProofMessage)
+		if err := verifyDecryptionShares(peer, own, proof, ownProof); err != nil {
+			return fmt.Errorf("epoch %d: %w", key.Number, err)
+		}
+	}
+	return nil
+}
+
+// tryCommit aggregates the commit signature and finishes the round once a
+// quorum of commits for the locked block is collected
+func (n *Node) tryCommit() error {
+	if len(n.commits) < n.quorum() || n.dbftCommited {
+		return nil
+	}
+	target := n.locked.header
+
+	// compute the bls signature
+	shares := make(map[int]*tpke.SignatureShare, len(n.commits))
+	for i, v := range n.commits {
+		// shares are checked on receipt
+		shares[int(i)], _ = DecodeSignatureShare(v.Signature)
+	}
+	// the global public key is necessary for verification
+	sig, err := aggregateSignature(n.globalPubKey, target.Hash().Bytes(), n.quorum(), shares)
+	if err != nil {
+		n.logRound(slog.LevelDebug, "failed to aggregate commit signatures", "commits", len(n.commits), "err", err)
+		// wait for another commit message and will not change view
+		return nil
+	}
+	n.metrics.endPhase("commit")
+	n.emit(CommitQuorumEvent{Height: n.height + 1, View: n.view, Commits: len(n.commits)})
+
+	// finish
+	return n.commitBlock(&Block{
+		Header:       target,
+		Transactions: n.locked.final,
+		Signature:    sig.ToBytes(),
+		CarrierNum:   uint64(n.locked.envelopNum),
+		Links:        n.locked.links,
+		KeyDecision:  n.locked.decision,
+	})
+}
+
+// commitBlock stores a block at the next height, either agreed on or synced
+// from peers, and starts the next round
+func (n *Node) commitBlock(block *Block) error {
+	if n.store != nil {
+		if err := n.store.Put(n.height+1, block); err != nil {
+			return fmt.Errorf("failed to store block %d: %w", n.height+1, err)
+		}
+	}
+	n.dbftCommited = true
+	n.addBlock(n.height+1, block)
+	n.commitEnvelopes(n.height+1, block, n.envelopePool)
+	n.height += 1
+	n.view = 0
+	n.viewLock = false
+
+	// reset for next round
+	n.txList = nil
+	n.proposal = nil
+	n.decision = nil
+	n.locked = nil
+	n.legacyPool = make([]*types.Transaction, 0)
+	n.envelopePool = make([]*types.Transaction, 0)
+	n.prepareResponses = make(map[uint16]*message.PrepareResponse)
+	n.finalizes = make(map[uint16]*message.Finalize)
+	n.dbftFinalized = false
+	n.commits = make(map[uint16]*message.Commit)
+	n.earlyCommits = make(map[uint16]*message.Commit)
+	n.earlyFinalizes = make(map[uint16]*message.Payload)
+	n.dbftCommited = false
+	n.changeViews = make(map[uint16]*message.ChangeView)
+	n.sent = nil
+	n.evidence.Prune(n.height + 1)
+	n.metrics.setRound(n.height, n.view)
+	n.metrics.setPools(0, 0)
+	n.logger.Info("committed block", "height", n.height, "hash", block.Header.Hash(),
+		"txs", len(block.Transactions), "envelopes", block.CarrierNum)
+	n.emit(NewBlockEvent{
+		Height:    n.height,
+		Hash:      block.Header.Hash(),
+		Txs:       len(block.Transactions),
+		Envelopes: int(block.CarrierNum),
+	})
+
+	n.announceBlock(block)
+
+	n.onEpochHeight(block.KeyDecision)
+	n.replayFuture()
+	return nil
+}
+
+// cacheFuture keeps a verified message of a future round, the cache is bounded
+// per validator, so a single validator can't push out the messages of others,
+// and messages too far ahead are dropped
+func (n *Node) cacheFuture(m *message.Payload) {
+	if m.BlockIndex > n.height+maxFutureHeights || n.futureSenders[m.ValidatorIndex()] >= maxFutureMessages {
+		return
 	}
+	k := futureKey{height: m.BlockIndex, view: m.ViewNumber()}
+	n.futureMessages[k] = append(n.futureMessages[k], m)
+	n.futureCount += 1
+	n.futureSenders[m.ValidatorIndex()] += 1
 }
 
-func (n *Node) EventLoop() {
+// dropFuture removes cached messages from the counters
+func (n *Node) dropFuture(ms []*message.Payload) {
+	n.futureCount -= len(ms)
+	for _, m := range ms {
+		i := m.ValidatorIndex()
+		n.futureSenders[i] -= 1
+		if n.futureSenders[i] <= 0 {
+			delete(n.futureSenders, i)
+		}
+	}
+}
+
+// replayFuture handles the cached messages of the current round and drops the
+// ones which became stale
+func (n *Node) replayFuture() {
+	for k, ms := range n.futureMessages {
+		if k.height < n.height+1 || k.height == n.height+1 && k.view < n.view {
+			delete(n.futureMessages, k)
+			n.dropFuture(ms)
+			n.staleMessages += len(ms)
+			n.metrics.staleMessage(len(ms))
+		}
+	}
+	k := futureKey{height: n.height + 1, view: n.view}
+	ms := n.futureMessages[k]
+	delete(n.futureMessages, k)
+	n.dropFuture(ms)
+	for _, m := range ms {
+		n.HandleMsg(m)
+	}
+}
+
+// persist committed blocks into the store, the node continues from the latest
+// stored block with the key epochs it had in use
+func (n *Node) SetBlockStore(s *BlockStore) error {
+	height, err := s.Height()
+	if err != nil {
+		return err
+	}
+	var latest *Block
+	if height > 0 {
+		if latest, err = s.Get(height); err != nil {
+			return err
+		}
+		n.addBlock(height, latest)
+		n.height = height
+		n.metrics.setRound(n.height, n.view)
+	}
+	n.store = s
+	if err := n.restoreEpochs(); err != nil {
+		return err
+	}
+	// rotations passed while the node was down are not waited for
+	if n.epochInterval != 0 {
+		n.nextEpochHeight = n.keyEnabledHeight + n.epochInterval
+	}
+	for n.epochInterval != 0 && n.nextEpochHeight <= n.height {
+		n.nextEpochHeight += n.epochInterval
+	}
+	if err := n.restoreKeyDeals(); err != nil {
+		return err
+	}
+	// the node may have stopped before it has dealt or installed the keys
+	// after the latest block
+	if latest != nil {
+		n.onEpochHeight(latest.KeyDecision)
+	}
+	return n.restoreRound()
+}
+
+// set the timers of the event loop, 0 disables a timer
+func (n *Node) SetTimeouts(blockTime, viewTimeout time.Duration) {
+	n.blockTime = blockTime
+	n.viewTimeout = viewTimeout
+}
+
+// EventLoop handles messages and timers until the context is done. The
+// primary proposes once the block time has passed in its round, and validators
+// ask for change view when no block is committed within the view timeout.
+func (n *Node) EventLoop(ctx context.Context) {
+	var proposeTimer, viewTimer *time.Timer
+	var proposeC, viewC <-chan time.Time
+	round := futureKey{height: n.height, view: n.view}
+	reset := func() {
+		for _, t := range []*time.Timer{proposeTimer, viewTimer} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		proposeC, viewC = nil, nil
+		if n.blockTime > 0 && n.isPrimary() {
+			proposeTimer = time.NewTimer(n.blockTime)
+			proposeC = proposeTimer.C
+		}
+		if n.viewTimeout > 0 && n.validator {
+			viewTimer = time.NewTimer(n.viewTimeout)
+			viewC = viewTimer.C
+		}
+	}
+	reset()
+	n.resend()
+	defer func() {
+		for _, t := range []*time.Timer{proposeTimer, viewTimer} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+	}()
+
 	for {
 		select {
-		case m := <-n.messageHandler:
-			n.HandleMsg(m)
-		case <-n.stopSignalHandler:
+		case <-ctx.Done():
 			return
+		case m := <-n.messageHandler:
+			n.receive(m)
+		case r := <-n.txHandler:
+			r.result <- n.pendTx(r.tx)
+		case f := <-n.callHandler:
+			f()
+		case <-proposeC:
+			proposeC = nil
+			n.onBlockTime()
+		case <-viewC:
+			n.onViewTimeout()
+			// keep asking until the view is changed
+			viewTimer.Reset(n.viewTimeout)
+		}
+		if round.height != n.height || round.view != n.view {
+			round = futureKey{height: n.height, view: n.view}
+			reset()
+		}
+	}
+}
+
+// receive handles a message from a peer
+func (n *Node) receive(m *message.Payload) error {
+	n.metrics.message(m.Type(), "in")
+	n.recordMsg(JournalIn, m)
+	return n.HandleMsg(m)
+}
+
+// pendTx pends a submitted tx
+func (n *Node) pendTx(tx *types.Transaction) error {
+	if n.journal != nil {
+		if data, err := tx.MarshalBinary(); err == nil {
+			n.record(JournalTx, data)
 		}
 	}
+	return n.PendTx(tx)
+}
+
+// onBlockTime proposes if this node hasn't got a proposal in its round
+func (n *Node) onBlockTime() {
+	n.record(JournalBlockTime, nil)
+	n.logRound(slog.LevelDebug, "block time elapsed")
+	if n.proposal == nil {
+		n.Propose()
+	}
 }
 
-func (n *Node) StopLoop() {
-	n.stopSignalHandler <- nil
+func (n *Node) onViewTimeout() {
+	n.record(JournalViewTimeout, nil)
+	n.logRound(slog.LevelDebug, "view timed out")
+	n.requestChangeView(payload.CVTimeout)
+}
+
+// primaryIndex returns the validator proposing in the current round
+func (n *Node) primaryIndex() uint16 {
+	ms := n.members()
+	if len(ms) == 0 {
+		return 0
+	}
+	return ms[(n.height+uint64(n.view))%uint64(len(ms))]
+}
+
+// isPrimary reports whether this node proposes in the current round
+func (n *Node) isPrimary() bool {
+	return n.validator && n.primaryIndex() == uint16(n.index)
+}
+
+// sentMsg returns the message of the type this node has sent in the current
+// round, if any
+func (n *Node) sentMsg(t payload.MessageType) *message.Payload {
+	for _, m := range n.sent {
+		if m.Type() == t && m.BlockIndex == n.height+1 && m.ViewNumber() == n.view {
+			return m
+		}
+	}
+	return nil
+}
+
+// requestChangeView asks other validators to leave the current view, a view
+// locked node waits for the others instead
+func (n *Node) requestChangeView(reason payload.ChangeViewReason) {
+	if n.viewLock {
+		n.logRound(slog.LevelDebug, "view locked, not asking for change view", "reason", reason)
+		return
+	}
+	n.logRound(slog.LevelInfo, "requesting change view", "reason", reason)
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           payload.ChangeViewType,
+			ValidatorIndex: n.index,
+			BlockIndex:     n.height + 1,
+			ViewNumber:     n.view,
+		},
+	}
+	msg.SetPayload(message.ChangeView{
+		NewViewNumber: n.view + 1,
+		Timestamp:     uint64(time.Now().Unix()),
+		Reason:        reason,
+	})
+	n.broadcast(msg)
 }
@@ -2,12 +2,17 @@ package dbft
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"crypto/ecdsa"
+	"errors"
 	"math/big"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/nspcc-dev/dbft/payload"
 	"github.com/nspcc-dev/neo-go/pkg/util"
@@ -16,7 +21,6 @@ import (
 	"github.com/txhsl/tpke"
 )
 
-// The scaler works well when the network size is smaller than 9, other wise overflow
 func TestPrepareRequestHandler(t *testing.T) {
 	dkg := tpke.NewDKG(7, 4)
 	dkg.Prepare()
@@ -26,17 +30,19 @@ func TestPrepareRequestHandler(t *testing.T) {
 	}
 	prvs := dkg.GetPrivateKeys()
 	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
 
 	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
 	nodes := make([]*Node, 7)
 	for i := 0; i < 7; i++ {
-		nodes[i] = NewNode(byte(i+1), prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
 	}
-	nodes[0].Connect(nodes)
+	nodes[1].Connect(nodes)
+	nodes[2].Connect(nodes)
 
 	// send a tx
 	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
-	nodes[0].PendLegacyTx(tx)
+	nodes[1].PendLegacyTx(tx)
 
 	// build header and msg
 	txs := make([]*types.Transaction, 1)
@@ -44,14 +50,15 @@ func TestPrepareRequestHandler(t *testing.T) {
 	txs[0] = tx
 	hashes[0] = util.Uint256(tx.Hash())
 	header := &types.Header{
+		Number: big.NewInt(1),
 		TxHash: types.DeriveSha(types.Transactions(txs), trie.NewStackTrie(nil)),
 	}
 
-	// send a message
+	// a request from a backup is rejected
 	prepareRequest := &message.Payload{
 		Message: message.Message{
 			Type:           payload.PrepareRequestType,
-			ValidatorIndex: 2,
+			ValidatorIndex: 3,
 			BlockIndex:     1,
 			ViewNumber:     0,
 		},
@@ -60,8 +67,260 @@ func TestPrepareRequestHandler(t *testing.T) {
 		SealingProposal: header,
 		TxHashes:        hashes,
 	})
-	prepareRequest.Sign(prvs[2])
+	prepareRequest.Sign(signers[3])
+	if err := nodes[1].HandleMsg(prepareRequest); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes[1].proposal != nil {
+		t.Fatalf("request from a backup accepted")
+	}
+
+	// a proposal which doesn't extend the chain of the node is rejected
+	for _, h := range []*types.Header{
+		{Number: big.NewInt(2), TxHash: header.TxHash},
+		{Number: big.NewInt(1), ParentHash: common.Hash{1}, TxHash: header.TxHash},
+	} {
+		mismatched := &message.Payload{
+			Message: message.Message{
+				Type:           payload.PrepareRequestType,
+				ValidatorIndex: 1,
+				BlockIndex:     1,
+				ViewNumber:     0,
+			},
+		}
+		mismatched.SetPayload(message.PrepareRequest{
+			SealingProposal: h,
+			TxHashes:        hashes,
+		})
+		mismatched.Sign(signers[1])
+		if err := nodes[2].HandleMsg(mismatched); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if nodes[2].proposal != nil || nodes[2].sentMsg(payload.PrepareResponseType) != nil {
+			t.Fatalf("mismatched proposal accepted")
+		}
+	}
+
+	// send a message from the primary of view 0
+	prepareRequest.Message.ValidatorIndex = 1
+	prepareRequest.Sign(signers[1])
+	if err := nodes[1].HandleMsg(prepareRequest); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(nodes[1].sent) != 1 || nodes[1].sent[0].Type() != payload.PrepareResponseType {
+		t.Fatalf("prepare request not responded")
+	}
+
+	// another proposal of the primary in the same view isn't responded
+	other := &message.Payload{
+		Message: message.Message{
+			Type:           payload.PrepareRequestType,
+			ValidatorIndex: 1,
+			BlockIndex:     1,
+			ViewNumber:     0,
+		},
+	}
+	other.SetPayload(message.PrepareRequest{
+		SealingProposal: &types.Header{Number: big.NewInt(1), TxHash: header.TxHash, Extra: []byte{1}},
+		TxHashes:        hashes,
+	})
+	other.Sign(signers[1])
+	if err := nodes[1].HandleMsg(other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(nodes[1].sent) != 1 || nodes[1].proposal.Hash() != header.Hash() {
+		t.Fatalf("responded twice in a view")
+	}
+}
+
+func TestMalformedMessage(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	nodes[0].Connect(nodes)
+
+	// send a message without witness
+	prepareRequest := &message.Payload{
+		Message: message.Message{
+			Type:           payload.PrepareRequestType,
+			ValidatorIndex: 2,
+			BlockIndex:     1,
+			ViewNumber:     0,
+		},
+	}
+	prepareRequest.SetPayload(message.PrepareRequest{
+		SealingProposal: &types.Header{},
+	})
+	err = nodes[0].HandleMsg(prepareRequest)
+	if !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes[0].InvalidMessages(2) != 1 {
+		t.Fatalf("invalid message not counted")
+	}
+
+	// send a commit with a garbage signature
+	commit := &message.Payload{
+		Message: message.Message{
+			Type:           payload.CommitType,
+			ValidatorIndex: 2,
+			BlockIndex:     1,
+			ViewNumber:     0,
+		},
+	}
+	commit.SetPayload(message.Commit{
+		Signature: []byte{1, 2, 3},
+	})
+	commit.Sign(signers[2])
+	err = nodes[0].HandleMsg(commit)
+	if !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes[0].InvalidMessages(2) != 2 {
+		t.Fatalf("invalid message not counted")
+	}
+
+	// send a message signed with the signing key of another validator
+	commit.Sign(signers[3])
+	err = nodes[0].HandleMsg(commit)
+	if !errors.Is(err, message.ErrInvalidWitness) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes[0].InvalidMessages(2) != 3 {
+		t.Fatalf("invalid message not counted")
+	}
+
+	// send a message from outside of the validator set
+	commit.Message.ValidatorIndex = 9
+	commit.Sign(signers[2])
+	err = nodes[0].HandleMsg(commit)
+	var unknown *UnknownValidatorError
+	if !errors.As(err, &unknown) || unknown.Index != 9 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes[0].UnknownSenderMessages() != 1 {
+		t.Fatalf("unknown sender not counted")
+	}
+	if _, err := nodes[0].Validators().Lookup(2); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestFutureMessages(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+
+	// send a tx
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	nodes[0].PendLegacyTx(tx)
+
+	// a prepare request of view 1 arrives before the view change
+	prepareRequest := &message.Payload{
+		Message: message.Message{
+			Type:           payload.PrepareRequestType,
+			ValidatorIndex: 2,
+			BlockIndex:     1,
+			ViewNumber:     1,
+		},
+	}
+	prepareRequest.SetPayload(message.PrepareRequest{
+		SealingProposal: &types.Header{
+			Number: big.NewInt(1),
+			TxHash: types.DeriveSha(types.Transactions{tx}, trie.NewStackTrie(nil)),
+		},
+		TxHashes: []util.Uint256{util.Uint256(tx.Hash())},
+	})
+	prepareRequest.Sign(signers[2])
 	nodes[0].HandleMsg(prepareRequest)
+	if nodes[0].FutureMessages() != 1 || nodes[0].proposal != nil {
+		t.Fatalf("future message not cached")
+	}
+
+	// a future message with an invalid signature isn't cached
+	forged := &message.Payload{
+		Message: message.Message{
+			Type:           payload.ChangeViewType,
+			ValidatorIndex: 4,
+			BlockIndex:     1,
+			ViewNumber:     1,
+		},
+	}
+	forged.SetPayload(message.ChangeView{NewViewNumber: 2})
+	forged.Sign(signers[5])
+	nodes[0].HandleMsg(forged)
+	if nodes[0].FutureMessages() != 1 {
+		t.Fatalf("forged future message cached")
+	}
+
+	// a validator flooding the cache doesn't push out the others
+	for i := 0; i < maxFutureMessages+10; i++ {
+		msg := &message.Payload{
+			Message: message.Message{
+				Type:           payload.ChangeViewType,
+				ValidatorIndex: 3,
+				BlockIndex:     1,
+				ViewNumber:     1,
+			},
+		}
+		msg.SetPayload(message.ChangeView{NewViewNumber: 2, Timestamp: uint64(i)})
+		msg.Sign(signers[3])
+		nodes[0].HandleMsg(msg)
+	}
+	forged.Sign(signers[4])
+	nodes[0].HandleMsg(forged)
+	if nodes[0].FutureMessages() != maxFutureMessages+2 {
+		t.Fatalf("unexpected number of cached messages %d", nodes[0].FutureMessages())
+	}
+
+	// a message of a past height is counted
+	stale := &message.Payload{
+		Message: message.Message{
+			Type:           payload.PrepareResponseType,
+			ValidatorIndex: 2,
+			BlockIndex:     0,
+			ViewNumber:     0,
+		},
+	}
+	stale.SetPayload(message.PrepareResponse{})
+	stale.Sign(signers[2])
+	nodes[0].HandleMsg(stale)
+	if nodes[0].StaleMessages() != 1 {
+		t.Fatalf("stale message not counted")
+	}
+
+	// the cached request is replayed once the node changes view
+	changeView(nodes, signers, 0)
+	if nodes[0].FutureMessages() != 0 || nodes[0].proposal == nil {
+		t.Fatalf("future message not replayed")
+	}
 }
 
 func TestEnvelopePool(t *testing.T) {
@@ -73,11 +332,12 @@ func TestEnvelopePool(t *testing.T) {
 	}
 	prvs := dkg.GetPrivateKeys()
 	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
 
 	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
 	nodes := make([]*Node, 7)
 	for i := 0; i < 7; i++ {
-		nodes[i] = NewNode(byte(i+1), prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
 	}
 	nodes[0].Connect(nodes)
 
@@ -129,11 +389,12 @@ func TestOneRoundDBFT(t *testing.T) {
 	}
 	prvs := dkg.GetPrivateKeys()
 	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
 
 	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
 	nodes := make([]*Node, 7)
 	for i := 0; i < 7; i++ {
-		nodes[i] = NewNode(byte(i+1), prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
 	}
 	for i := 0; i < 7; i++ {
 		nodes[i].Connect(nodes)
@@ -211,7 +472,7 @@ func TestOneRoundDBFT(t *testing.T) {
 	}
 }
 
-func TestLoopDBFT(t *testing.T) {
+func TestCommitLockFaultyPrimary(t *testing.T) {
 	dkg := tpke.NewDKG(7, 4)
 	dkg.Prepare()
 	err := dkg.Verify()
@@ -220,60 +481,203 @@ func TestLoopDBFT(t *testing.T) {
 	}
 	prvs := dkg.GetPrivateKeys()
 	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
 
 	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
 	nodes := make([]*Node, 7)
 	for i := 0; i < 7; i++ {
-		nodes[i] = NewNode(byte(i+1), prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
 	}
 	for i := 0; i < 7; i++ {
 		nodes[i].Connect(nodes)
-		go nodes[i].EventLoop()
 	}
 
-	for i := 0; i < 3; i++ {
-		// create an enveloped tx, the nonce number should leave a space for carrier tx
-		tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
-		buf := new(bytes.Buffer)
-		err = tx.EncodeRLP(buf)
-		if err != nil {
-			t.Fatalf(err.Error())
+	// create an enveloped tx, the nonce number should leave a space for carrier tx
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	buf := new(bytes.Buffer)
+	err = tx.EncodeRLP(buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	seed := tpke.RandPG1()
+	es := globalpub.Encrypt(seed)
+	et, err := tpke.AESEncrypt(seed, buf.Bytes())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	envelope := &transaction.Envelope{
+		EncryptHeight:        0,
+		EncryptedSeed:        es,
+		EncryptedTransaction: et,
+	}
+	carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+	for i := 0; i < 7; i++ {
+		nodes[i].PendEnvelopedTx(carrier)
+	}
+
+	// view 0, every node sends commit but no commit is delivered
+	nodes[0].Propose()
+	deliver(nodes, func(m *message.Payload) bool {
+		return m.Type() == payload.CommitType
+	})
+	for i := 0; i < 7; i++ {
+		if nodes[i].locked == nil || nodes[i].height != 0 {
+			t.Fatalf("node %d is not locked", i)
 		}
+	}
+	lockedHash := nodes[0].locked.header.Hash()
 
-		// generate a random key for encryption
-		seed := tpke.RandPG1()
-		es := globalpub.Encrypt(seed)
-		et, err := tpke.AESEncrypt(seed, buf.Bytes())
-		if err != nil {
-			t.Fatalf(err.Error())
+	// the quorum changes view anyway
+	changeView(nodes, signers, 0)
+	for i := 0; i < 7; i++ {
+		if nodes[i].view != 1 || nodes[i].locked == nil {
+			t.Fatalf("node %d lost its lock on view change", i)
 		}
+	}
 
-		// build a envelope
-		envelope := &transaction.Envelope{
-			EncryptHeight:        0,
-			EncryptedSeed:        es,
-			EncryptedTransaction: et,
+	// the primary of view 1 proposes another block, which locked nodes refuse
+	legacy := types.NewTransaction(2, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	for i := 0; i < 7; i++ {
+		nodes[i].PendLegacyTx(legacy)
+	}
+	faulty := &message.Payload{
+		Message: message.Message{
+			Type:           payload.PrepareRequestType,
+			ValidatorIndex: 2,
+			BlockIndex:     1,
+			ViewNumber:     1,
+		},
+	}
+	faulty.SetPayload(message.PrepareRequest{
+		SealingProposal: &types.Header{
+			Number: big.NewInt(1),
+			TxHash: types.DeriveSha(types.Transactions{legacy}, trie.NewStackTrie(nil)),
+		},
+		TxHashes: []util.Uint256{util.Uint256(legacy.Hash())},
+	})
+	faulty.Sign(signers[2])
+	for i := 0; i < 7; i++ {
+		if i != 1 {
+			nodes[i].HandleMsg(faulty)
+		}
+	}
+	deliver(nodes, func(m *message.Payload) bool {
+		if m.Type() == payload.PrepareResponseType {
+			t.Fatalf("locked node accepted a different block")
 		}
+		return false
+	})
+	for i := 0; i < 7; i++ {
+		if nodes[i].view != 2 || nodes[i].height != 0 {
+			t.Fatalf("node %d didn't change view", i)
+		}
+	}
 
-		// wrap the envelope into a normal transfer, the to address of carrier will be specified to a fixed one, here use zero address
-		carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
-		for j := 0; j < 7; j++ {
-			nodes[j].PendEnvelopedTx(carrier)
+	// the primary of view 2 re-proposes the locked block
+	nodes[2].Propose()
+	deliver(nodes, nil)
+	for i := 0; i < 7; i++ {
+		if nodes[i].height != 1 {
+			t.Fatalf("invalid consensus")
 		}
+		if nodes[i].blocks[1].Header.Hash() != lockedHash {
+			t.Fatalf("node %d committed a block different from the locked one", i)
+		}
+	}
+}
+
+func TestLoopDBFT(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		nodes[i].SetTimeouts(100*time.Millisecond, 2*time.Second)
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
 
-		// start a consensus
-		nodes[i].Propose()
-		time.Sleep(time.Second)
+	// create an enveloped tx, the nonce number should leave a space for carrier tx
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	buf := new(bytes.Buffer)
+	err = tx.EncodeRLP(buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// generate a random key for encryption
+	seed := tpke.RandPG1()
+	es := globalpub.Encrypt(seed)
+	et, err := tpke.AESEncrypt(seed, buf.Bytes())
+	if err != nil {
+		t.Fatalf(err.Error())
 	}
 
+	// build a envelope
+	envelope := &transaction.Envelope{
+		EncryptHeight:        0,
+		EncryptedSeed:        es,
+		EncryptedTransaction: et,
+	}
+
+	// wrap the envelope into a normal transfer, the to address of carrier will be specified to a fixed one, here use zero address
+	carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+	for j := 0; j < 7; j++ {
+		nodes[j].PendEnvelopedTx(carrier)
+	}
+
+	// primaries propose by the block timer, every node should commit 3 blocks
+	// before the deadline
+	subs := make([]*Subscription, 7)
+	for i := 0; i < 7; i++ {
+		subs[i] = nodes[i].Subscribe(64)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 7; i++ {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			n.EventLoop(ctx)
+		}(nodes[i])
+	}
+	deadline := time.After(10 * time.Second)
 	for i := 0; i < 7; i++ {
-		nodes[i].StopLoop()
-		for j := 1; j < 4; j++ {
-			fmt.Println(nodes[i].blocks[uint64(j)].Hash())
+		for committed := false; !committed; {
+			select {
+			case e := <-subs[i].C:
+				if b, ok := e.(NewBlockEvent); ok && b.Height >= 3 {
+					committed = true
+				}
+			case <-deadline:
+				cancel()
+				wg.Wait()
+				t.Fatalf("node %d didn't commit 3 blocks in time", i)
+			}
 		}
-		if nodes[i].height != 3 {
+	}
+	cancel()
+	wg.Wait()
+
+	for i := 0; i < 7; i++ {
+		if nodes[i].height < 3 {
 			t.Fatalf("invalid consensus")
 		}
+		for j := uint64(1); j <= 3; j++ {
+			if nodes[i].blocks[j].Hash().CompareTo(nodes[0].blocks[j].Hash()) != 0 {
+				t.Fatalf("invalid block")
+			}
+		}
 	}
 }
 
@@ -284,3 +688,101 @@ func (n *Node) EventLoopOnce() {
 	m := <-n.messageHandler
 	n.HandleMsg(m)
 }
+
+// deliver handles queued messages until the network is idle, messages matched
+// by drop are discarded
+func deliver(nodes []*Node, drop func(m *message.Payload) bool) {
+	for busy := true; busy; {
+		busy = false
+		for _, n := range nodes {
+			for len(n.messageHandler) > 0 {
+				busy = true
+				m := <-n.messageHandler
+				if drop == nil || !drop(m) {
+					n.HandleMsg(m)
+				}
+			}
+		}
+	}
+}
+
+// primary returns the node proposing in the current round of the nodes
+func primary(nodes []*Node) *Node {
+	for _, n := range nodes {
+		if n.isPrimary() {
+			return n
+		}
+	}
+	return nil
+}
+
+// newSigners generates message signing keys for validators 1 to n
+func newSigners(n int) map[int]*ecdsa.PrivateKey {
+	signers := make(map[int]*ecdsa.PrivateKey, n)
+	for i := 1; i <= n; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			panic(err)
+		}
+		signers[i] = key
+	}
+	return signers
+}
+
+// changeView makes every validator ask every node to leave the view
+func changeView(nodes []*Node, signers map[int]*ecdsa.PrivateKey, view byte) {
+	for i := range nodes {
+		msg := &message.Payload{
+			Message: message.Message{
+				Type:           payload.ChangeViewType,
+				ValidatorIndex: byte(i + 1),
+				BlockIndex:     1,
+				ViewNumber:     view,
+			},
+		}
+		msg.SetPayload(message.ChangeView{
+			NewViewNumber: view + 1,
+			Timestamp:     uint64(time.Now().Unix()),
+			Reason:        payload.CVTimeout,
+		})
+		msg.Sign(signers[i+1])
+		for j := range nodes {
+			if j != i {
+				nodes[j].HandleMsg(msg)
+			}
+		}
+	}
+}
+
+func TestSubmitTx(t *testing.T) {
+	n := NewObserver(1, nil, nil, 0, 0)
+	n.maxLegacyTxs = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.EventLoop(ctx)
+		close(done)
+	}()
+
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	if IsCarrier(tx) {
+		t.Fatalf("legacy tx is taken as a carrier")
+	}
+	if err := n.SubmitTx(ctx, tx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := n.SubmitTx(ctx, tx); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// envelope sized data sent to the zero address goes to the envelope pool
+	broken := types.NewTransaction(0, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), make([]byte, transaction.HeaderLen+transaction.SeedLen))
+	if !IsCarrier(broken) {
+		t.Fatalf("carrier is taken as a legacy tx")
+	}
+	cancel()
+	<-done
+	if len(n.legacyPool) != 1 {
+		t.Fatalf("invalid legacy pool")
+	}
+}
@@ -0,0 +1,158 @@
+package dbft
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/txhsl/tpke"
+)
+
+// The keys of an epoch are generated by all validators together. Every
+// validator deals a random polynomial of degree threshold, commits to its
+// coefficients in G1 and sends every member the value at the member's index,
+// encrypted to the member's message signing key. The key share of a member is
+// the sum of the values it gets, the public key shares and the global key
+// follow from the sum of the commitments, so no node learns the secret.
+// Members are evaluated at their validator index, gaps in the set are fine.
+
+// dkgPolynomial is the random polynomial of a dealer
+type dkgPolynomial struct {
+	coeffs      []fr.Element
+	commitments []bls.G1Affine
+}
+
+func newDKGPolynomial(threshold int) (*dkgPolynomial, error) {
+	p := &dkgPolynomial{coeffs: make([]fr.Element, threshold+1)}
+	for k := range p.coeffs {
+		if _, err := p.coeffs[k].SetRandom(); err != nil {
+			return nil, err
+		}
+	}
+	p.commit()
+	return p, nil
+}
+
+// deriveDKGPolynomial derives the polynomial of a dealer from a secret seed,
+// so the same polynomial is dealt again for the same seed
+func deriveDKGPolynomial(seed []byte, threshold int) *dkgPolynomial {
+	p := &dkgPolynomial{coeffs: make([]fr.Element, threshold+1)}
+	for k := range p.coeffs {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+		// 64 bytes are reduced, so the bias is negligible
+		p.coeffs[k].SetBigInt(new(big.Int).SetBytes(crypto.Keccak512(seed, b[:])))
+	}
+	p.commit()
+	return p
+}
+
+// commit computes the commitments to the coefficients
+func (p *dkgPolynomial) commit() {
+	_, _, g1, _ := bls.Generators()
+	p.commitments = make([]bls.G1Affine, len(p.coeffs))
+	for k := range p.coeffs {
+		p.commitments[k].ScalarMultiplication(&g1, p.coeffs[k].BigInt(new(big.Int)))
+	}
+}
+
+// eval returns the value of the polynomial at a validator index
+func (p *dkgPolynomial) eval(index uint16) fr.Element {
+	var x, res fr.Element
+	x.SetUint64(uint64(index))
+	for k := len(p.coeffs) - 1; k >= 0; k-- {
+		res.Mul(&res, &x)
+		res.Add(&res, &p.coeffs[k])
+	}
+	return res
+}
+
+// commitmentAt returns the commitment to the value of a polynomial at a
+// validator index, that is the public key share of the validator
+func commitmentAt(cs []bls.G1Affine, index uint16) bls.G1Affine {
+	x := new(big.Int).SetUint64(uint64(index))
+	var acc bls.G1Jac
+	acc.FromAffine(&cs[len(cs)-1])
+	for k := len(cs) - 2; k >= 0; k-- {
+		acc.ScalarMultiplication(&acc, x)
+		acc.AddMixed(&cs[k])
+	}
+	var res bls.G1Affine
+	res.FromJacobian(&acc)
+	return res
+}
+
+// verifyShare checks a share dealt to a validator index against the commitments
+func verifyShare(s *fr.Element, cs []bls.G1Affine, index uint16) error {
+	_, _, g1, _ := bls.Generators()
+	var p bls.G1Affine
+	p.ScalarMultiplication(&g1, s.BigInt(new(big.Int)))
+	expected := commitmentAt(cs, index)
+	if !p.Equal(&expected) {
+		return errors.New("share doesn't match the commitments")
+	}
+	return nil
+}
+
+func encodeG1(p *bls.G1Affine) []byte {
+	b := p.Bytes()
+	return b[:]
+}
+
+func decodeCommitments(bs [][]byte) ([]bls.G1Affine, error) {
+	cs := make([]bls.G1Affine, len(bs))
+	for k, b := range bs {
+		if _, err := cs[k].SetBytes(b); err != nil {
+			return nil, fmt.Errorf("commitment %d: %w", k, err)
+		}
+	}
+	return cs, nil
+}
+
+// encryptShare encrypts a share to the message signing key of its owner
+func encryptShare(pub *ecdsa.PublicKey, s *fr.Element) ([]byte, error) {
+	b := s.Bytes()
+	return ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pub), b[:], nil, nil)
+}
+
+// decryptShare decrypts a share with the message signing key of this node
+func decryptShare(prv *ecdsa.PrivateKey, c []byte) (*fr.Element, error) {
+	b, err := ecies.ImportECDSA(prv).Decrypt(c, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := new(fr.Element)
+	if err := s.SetBytesCanonical(b); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// tpkePublicKey converts a point to a tpke public key, which is a compressed
+// G1 point
+func tpkePublicKey(p *bls.G1Affine) (*tpke.PublicKey, error) {
+	return tpke.BytesToPublicKey(encodeG1(p))
+}
+
+// tpkePrivateKey converts a share to a tpke private key, which is a big endian
+// scalar. The key is checked against its public key share, so that a change of
+// the encodings of tpke fails here instead of installing unusable keys.
+func tpkePrivateKey(s *fr.Element, pub *bls.G1Affine) (*tpke.PrivateKey, error) {
+	b := s.Bytes()
+	prv, err := tpke.BytesToPrivateKey(b[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prv.GetPublicKey().ToBytes(), encodeG1(pub)) {
+		return nil, errors.New("combined key share doesn't match its public key")
+	}
+	return prv, nil
+}
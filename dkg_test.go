@@ -0,0 +1,86 @@
+package dbft
+
+import (
+	"math/big"
+	"testing"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+)
+
+func TestDKGShares(t *testing.T) {
+	// a validator set with gaps, every member deals a polynomial
+	members := []uint16{2, 5, 9, 12}
+	signers := newSigners(12)
+	threshold := quorumOf(len(members)) - 1
+	shares := make(map[uint16]*fr.Element)
+	sum := make([]bls.G1Jac, threshold+1)
+	for range members {
+		p, err := newDKGPolynomial(threshold)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		encoded := make([][]byte, len(p.commitments))
+		for k := range p.commitments {
+			sum[k].AddMixed(&p.commitments[k])
+			encoded[k] = encodeG1(&p.commitments[k])
+		}
+		cs, err := decodeCommitments(encoded)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, i := range members {
+			s := p.eval(i)
+			c, err := encryptShare(&signers[int(i)].PublicKey, &s)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if _, err := decryptShare(signers[1], c); err == nil {
+				t.Fatalf("share decrypted with another key")
+			}
+			got, err := decryptShare(signers[int(i)], c)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := verifyShare(got, cs, i); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := verifyShare(got, cs, i+1); err == nil {
+				t.Fatalf("share verified at another index")
+			}
+			if shares[i] == nil {
+				shares[i] = new(fr.Element)
+			}
+			shares[i].Add(shares[i], got)
+		}
+	}
+
+	// the combined shares match the combined commitments
+	cs := make([]bls.G1Affine, len(sum))
+	for k := range sum {
+		cs[k].FromJacobian(&sum[k])
+	}
+	for _, i := range members {
+		if err := verifyShare(shares[i], cs, i); err != nil {
+			t.Fatalf("combined share of validator %d: %v", i, err)
+		}
+	}
+
+	// any quorum of the combined shares recovers the secret of the global key
+	_, _, g1, _ := bls.Generators()
+	for _, indexes := range [][]int{{2, 5, 9}, {5, 9, 12}, {2, 9, 12}} {
+		ls := lagrangeCoefficients(indexes)
+		var secret fr.Element
+		for j, i := range indexes {
+			var l, v fr.Element
+			l.SetBigInt(ls[j])
+			v.Mul(&l, shares[uint16(i)])
+			secret.Add(&secret, &v)
+		}
+		var p bls.G1Affine
+		p.ScalarMultiplication(&g1, secret.BigInt(new(big.Int)))
+		if !p.Equal(&cs[0]) {
+			t.Fatalf("shares of %v don't recover the global key", indexes)
+		}
+	}
+}
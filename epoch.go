@@ -0,0 +1,427 @@
+package dbft
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"github.com/txhsl/tpke"
+)
+
+const (
+	// the number of blocks before an epoch boundary the keys are dealt at, so that
+	// complaints are answered before the last block of the epoch decides the keys
+	epochDealLead = 2
+	// the minimum number of blocks in a key epoch
+	minEpochInterval = 2 * epochDealLead
+	// the default number of blocks an old epoch is still accepted after rotation
+	defaultEpochGrace = 8
+)
+
+// ErrEncryptionExpired is returned for envelopes encrypted to a key which is no
+// longer accepted.
+var ErrEncryptionExpired = errors.New("encryption expired")
+
+// KeyEpoch is the threshold key material used for encryption, decryption and
+// block signing from a certain height on.
+type KeyEpoch struct {
+	Number        uint64
+	EnabledHeight uint64
+	PrivateKey    *tpke.PrivateKey
+	GlobalPubKey  *tpke.PublicKey
+	PublicKeys    ValidatorSet // public key shares of all validators, including this node
+	Scaler        int
+	Threshold     int    // the threshold the keys are generated with
+	ExpiryHeight  uint64 // the first height the epoch is no longer accepted, 0 while in use
+}
+
+// sealedEnvelope is an envelope of the proposal with the key it is encrypted to
+type sealedEnvelope struct {
+	envelope *transaction.Envelope
+	key      *KeyEpoch
+	carrier  int // the position of the carrier in the tx list
+}
+
+// set the number of blocks between key rotations, 0 disables rotation
+func (n *Node) SetEpochInterval(interval uint64) error {
+	if interval != 0 && interval < minEpochInterval {
+		return fmt.Errorf("epoch interval should be at least %d", minEpochInterval)
+	}
+	n.epochInterval = interval
+	n.nextEpochHeight = n.keyEnabledHeight + interval
+	return nil
+}
+
+// set the number of blocks the keys of an old epoch are still accepted after rotation
+func (n *Node) SetEpochGrace(grace uint64) {
+	n.epochGrace = grace
+}
+
+// get the number of the key epoch currently in use
+func (n *Node) Epoch() uint64 {
+	return n.epoch
+}
+
+// EncryptionKey is the key users seal envelopes to, envelopes should carry
+// the epoch number and an encryption height from the enabled height on.
+type EncryptionKey struct {
+	GlobalPubKey  *tpke.PublicKey
+	Epoch         uint64
+	EnabledHeight uint64
+}
+
+// get the key envelopes are currently encrypted to
+func (n *Node) EncryptionKey() EncryptionKey {
+	return EncryptionKey{
+		GlobalPubKey:  n.globalPubKey,
+		Epoch:         n.epoch,
+		EnabledHeight: n.keyEnabledHeight,
+	}
+}
+
+// currentEpoch returns the keys currently in use as a KeyEpoch
+func (n *Node) currentEpoch() *KeyEpoch {
+	pubs := make(ValidatorSet, len(n.neighborPubKeys)+1)
+	for i, pub := range n.neighborPubKeys {
+		pubs[i] = pub
+	}
+	if n.validator {
+		pubs[uint16(n.index)] = n.pub
+	}
+	return &KeyEpoch{
+		Number:        n.epoch,
+		EnabledHeight: n.keyEnabledHeight,
+		PrivateKey:    n.prv,
+		GlobalPubKey:  n.globalPubKey,
+		PublicKeys:    pubs,
+		Scaler:        n.scaler,
+		Threshold:     n.quorum() - 1,
+	}
+}
+
+// envelopeKey returns the keys an envelope is encrypted to, cur is the current epoch
+func (n *Node) envelopeKey(e *transaction.Envelope, cur *KeyEpoch) (*KeyEpoch, error) {
+	if e.Epoch == cur.Number {
+		if e.EncryptHeight < cur.EnabledHeight {
+			return nil, ErrEncryptionExpired
+		}
+		return cur, nil
+	}
+	for _, k := range n.oldEpochs {
+		if k.Number == e.Epoch && e.EncryptHeight >= k.EnabledHeight {
+			return k, nil
+		}
+	}
+	return nil, ErrEncryptionExpired
+}
+
+// sealedEnvelopes returns the envelopes of the proposal with their keys,
+// envelopes that can't be decoded or decrypted are skipped by every node, so
+// decryption shares keep aligned
+func (n *Node) sealedEnvelopes() []sealedEnvelope {
+	cur := n.currentEpoch()
+	sealed := make([]sealedEnvelope, 0, n.envelopNum)
+	for i, v := range n.txList[:n.envelopNum] {
+		envelope, err := transaction.BytesToEnvelope(v.Data())
+		if err != nil {
+			continue
+		}
+		key, err := n.envelopeKey(envelope, cur)
+		if err != nil {
+			continue
+		}
+		sealed = append(sealed, sealedEnvelope{envelope: envelope, key: key, carrier: i})
+	}
+	return sealed
+}
+
+// sealedEpochs returns the keys of the sealed envelopes in ascending epoch order
+func sealedEpochs(sealed []sealedEnvelope) []*KeyEpoch {
+	keys := make([]*KeyEpoch, 0, 1)
+	for _, v := range sealed {
+		found := false
+		for _, k := range keys {
+			if k.Number == v.key.Number {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, v.key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Number < keys[j].Number })
+	return keys
+}
+
+// members returns the sorted indexes of all validators, including this node
+// if it is a validator
+func (n *Node) members() []uint16 {
+	ms := make([]uint16, 0, len(n.neighborPubKeys)+1)
+	if n.validator {
+		ms = append(ms, uint16(n.index))
+	}
+	for i := range n.neighborPubKeys {
+		ms = append(ms, i)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	return ms
+}
+
+// nextBoundary returns the height where the next key epoch begins, either by
+// rotation or by a validator set change
+func (n *Node) nextBoundary() (uint64, bool) {
+	if n.pendingChange != nil && (n.epochInterval == 0 || n.pendingChange.height <= n.nextEpochHeight) {
+		return n.pendingChange.height, true
+	}
+	if n.epochInterval != 0 {
+		return n.nextEpochHeight, true
+	}
+	return 0, false
+}
+
+// nextMembers returns the validator set of the next key epoch
+func (n *Node) nextMembers(boundary uint64) []uint16 {
+	if n.pendingChange != nil && n.pendingChange.height == boundary {
+		return n.pendingChange.members
+	}
+	return n.members()
+}
+
+// onEpochHeight is called after every committed block, every validator deals
+// its part of the keys of the next epoch a few blocks before the boundary and
+// the keys decided with the last block of the epoch are installed at the
+// boundary
+func (n *Node) onEpochHeight(decision *message.KeyDecision) {
+	n.dropExpiredEpochs()
+	boundary, ok := n.nextBoundary()
+	if !ok {
+		return
+	}
+	if n.height+1 == boundary {
+		if e, err := n.decidedEpoch(decision, boundary); err == nil {
+			n.installEpoch(e)
+			n.logRound(slog.LevelInfo, "installed key epoch", "epoch", n.epoch, "validator", n.validator)
+		} else {
+			n.logRound(slog.LevelInfo, "keys of the next epoch are missing", "epoch", n.epoch+1, "err", err)
+		}
+		// the keys are missing if too few validators dealt, a rotation is then
+		// retried in the next interval and a validator set change is dropped
+		n.keyDeals = nil
+		n.keyComplaints = nil
+		n.keyDealMsgs = nil
+		if n.pendingChange != nil && n.pendingChange.height == boundary {
+			n.pendingChange = nil
+		}
+		if n.epochInterval != 0 && n.nextEpochHeight == boundary {
+			n.nextEpochHeight += n.epochInterval
+		}
+		return
+	}
+	if n.height+1+epochDealLead == boundary && n.validator {
+		if err := n.dealKeys(boundary); err != nil {
+			n.logRound(slog.LevelWarn, "failed to deal keys", "epoch", n.epoch+1, "err", err)
+			return
+		}
+	}
+}
+
+// installEpoch switches the node to the keys and the validator set of a new
+// epoch. If the validator set is the same, the old keys are still accepted for
+// the grace window, otherwise they are dropped at once, since the new members
+// don't have them. The epochs in use are persisted, so a restarted node
+// doesn't fall back to the keys of its keystore.
+func (n *Node) installEpoch(e *KeyEpoch) {
+	old := n.currentEpoch()
+	if equalMembers(n.members(), e.members()) {
+		old.ExpiryHeight = e.EnabledHeight + n.epochGrace
+		n.oldEpochs = append(n.oldEpochs, old)
+	} else {
+		n.oldEpochs = nil
+	}
+	n.setEpoch(e)
+	n.RefreshEnvelopePool()
+	n.dropExpiredEpochs()
+	if err := n.saveEpochs(); err != nil {
+		n.logRound(slog.LevelError, "failed to save key epochs", "epoch", n.epoch, "err", err)
+	}
+}
+
+// setEpoch sets the keys and the validator set of the node. A member without
+// its key share follows the epoch like an observer, but is still counted in
+// the validator set, so the quorum is the same on every node.
+func (n *Node) setEpoch(e *KeyEpoch) {
+	n.epoch = e.Number
+	n.validator = e.PrivateKey != nil
+	n.prv = e.PrivateKey
+	n.pub = nil
+	if n.validator {
+		n.pub = e.PrivateKey.GetPublicKey()
+	}
+	n.globalPubKey = e.GlobalPubKey
+	n.scaler = e.Scaler
+	n.keyEnabledHeight = e.EnabledHeight
+	n.neighborPubKeys = make(ValidatorSet, len(e.PublicKeys))
+	for i, pub := range e.PublicKeys {
+		if i != uint16(n.index) || !n.validator {
+			n.neighborPubKeys[i] = pub
+		}
+	}
+}
+
+// dropExpiredEpochs forgets the old epochs out of the grace window and evicts
+// the envelopes encrypted to them
+func (n *Node) dropExpiredEpochs() {
+	epochs := make([]*KeyEpoch, 0, len(n.oldEpochs))
+	for _, k := range n.oldEpochs {
+		if k.ExpiryHeight > n.height+1 {
+			epochs = append(epochs, k)
+		}
+	}
+	if len(epochs) != len(n.oldEpochs) {
+		n.oldEpochs = epochs
+		n.RefreshEnvelopePool()
+	}
+}
+
+// members returns the sorted indexes of the validators of the epoch
+func (e *KeyEpoch) members() []uint16 {
+	return sortedIndexes(e.PublicKeys)
+}
+
+// storedEpochs are the key epochs in use as persisted in the block store
+type storedEpochs struct {
+	Current *storedEpoch
+	Old     []*storedEpoch
+}
+
+// storedEpoch is the persisted form of KeyEpoch, the private share is
+// encrypted to the message signing key of the node
+type storedEpoch struct {
+	Number        uint64
+	EnabledHeight uint64
+	Share         []byte
+	GlobalKey     []byte
+	Members       []uint64
+	PublicKeys    [][]byte
+	Scaler        uint64
+	Threshold     uint64
+	ExpiryHeight  uint64
+}
+
+func (n *Node) storeEpoch(e *KeyEpoch) (*storedEpoch, error) {
+	s := &storedEpoch{
+		Number:        e.Number,
+		EnabledHeight: e.EnabledHeight,
+		GlobalKey:     e.GlobalPubKey.ToBytes(),
+		Scaler:        uint64(e.Scaler),
+		Threshold:     uint64(e.Threshold),
+		ExpiryHeight:  e.ExpiryHeight,
+	}
+	for _, i := range e.members() {
+		s.Members = append(s.Members, uint64(i))
+		s.PublicKeys = append(s.PublicKeys, e.PublicKeys[i].ToBytes())
+	}
+	if e.PrivateKey != nil {
+		if n.signer == nil {
+			return nil, errors.New("no signing key to encrypt the share to")
+		}
+		var err error
+		s.Share, err = ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(&n.signer.PublicKey), e.PrivateKey.ToBytes(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (n *Node) loadEpoch(s *storedEpoch) (*KeyEpoch, error) {
+	if len(s.PublicKeys) != len(s.Members) {
+		return nil, errors.New("corrupted key epoch")
+	}
+	global, err := tpke.BytesToPublicKey(s.GlobalKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode global key: %w", err)
+	}
+	e := &KeyEpoch{
+		Number:        s.Number,
+		EnabledHeight: s.EnabledHeight,
+		GlobalPubKey:  global,
+		PublicKeys:    make(ValidatorSet, len(s.Members)),
+		Scaler:        int(s.Scaler),
+		Threshold:     int(s.Threshold),
+		ExpiryHeight:  s.ExpiryHeight,
+	}
+	for j, i := range s.Members {
+		if e.PublicKeys[uint16(i)], err = tpke.BytesToPublicKey(s.PublicKeys[j]); err != nil {
+			return nil, fmt.Errorf("failed to decode public key of validator %d: %w", i, err)
+		}
+	}
+	if len(s.Share) > 0 {
+		if n.signer == nil {
+			return nil, errors.New("no signing key to decrypt the share with")
+		}
+		b, err := ecies.ImportECDSA(n.signer).Decrypt(s.Share, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt share: %w", err)
+		}
+		if e.PrivateKey, err = tpke.BytesToPrivateKey(b); err != nil {
+			return nil, fmt.Errorf("failed to decode share: %w", err)
+		}
+		pub, ok := e.PublicKeys[uint16(n.index)]
+		if !ok || !bytes.Equal(e.PrivateKey.GetPublicKey().ToBytes(), pub.ToBytes()) {
+			return nil, errors.New("share doesn't match its public key")
+		}
+	}
+	return e, nil
+}
+
+// saveEpochs persists the epoch in use and the old epochs still accepted
+func (n *Node) saveEpochs() error {
+	if n.store == nil {
+		return nil
+	}
+	cur, err := n.storeEpoch(n.currentEpoch())
+	if err != nil {
+		return err
+	}
+	s := &storedEpochs{Current: cur}
+	for _, k := range n.oldEpochs {
+		old, err := n.storeEpoch(k)
+		if err != nil {
+			return err
+		}
+		s.Old = append(s.Old, old)
+	}
+	return n.store.putEpochs(s)
+}
+
+// restoreEpochs installs the epochs persisted before a restart
+func (n *Node) restoreEpochs() error {
+	s, err := n.store.epochs()
+	if err != nil || s == nil {
+		return err
+	}
+	cur, err := n.loadEpoch(s.Current)
+	if err != nil {
+		return fmt.Errorf("failed to restore key epoch %d: %w", s.Current.Number, err)
+	}
+	olds := make([]*KeyEpoch, 0, len(s.Old))
+	for _, v := range s.Old {
+		old, err := n.loadEpoch(v)
+		if err != nil {
+			return fmt.Errorf("failed to restore key epoch %d: %w", v.Number, err)
+		}
+		olds = append(olds, old)
+	}
+	n.setEpoch(cur)
+	n.oldEpochs = olds
+	n.dropExpiredEpochs()
+	return nil
+}
@@ -0,0 +1,448 @@
+package dbft
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"github.com/txhsl/tpke"
+)
+
+func TestKeyEpochRotation(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		if err := nodes[i].SetEpochInterval(4); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+
+	for h := 1; h <= 5; h++ {
+		// users encrypt to the key currently in use, except at height 4 where
+		// an envelope sealed before the rotation is still accepted
+		key, epoch, encryptHeight := nodes[0].globalPubKey, nodes[0].Epoch(), nodes[0].keyEnabledHeight
+		if h == 4 {
+			key, epoch, encryptHeight = globalpub, 0, 0
+		}
+		tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		buf := new(bytes.Buffer)
+		err = tx.EncodeRLP(buf)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		seed := tpke.RandPG1()
+		es := key.Encrypt(seed)
+		et, err := tpke.AESEncrypt(seed, buf.Bytes())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		envelope := &transaction.Envelope{
+			EncryptHeight:        encryptHeight,
+			Epoch:                epoch,
+			EncryptedSeed:        es,
+			EncryptedTransaction: et,
+		}
+		carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+		for i := 0; i < 7; i++ {
+			if err := nodes[i].PendEnvelopedTx(carrier); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+
+		primary(nodes).Propose()
+		deliver(nodes, nil)
+		for i := 0; i < 7; i++ {
+			if nodes[i].height != uint64(h) {
+				t.Fatalf("node %d failed to commit height %d", i, h)
+			}
+		}
+
+		// the new keys are installed right before the boundary
+		if h == 3 {
+			for i := 0; i < 7; i++ {
+				if nodes[i].Epoch() != 1 || nodes[i].keyEnabledHeight != 4 {
+					t.Fatalf("node %d didn't rotate keys", i)
+				}
+				if bytes.Equal(nodes[i].globalPubKey.ToBytes(), globalpub.ToBytes()) {
+					t.Fatalf("node %d kept the old global key", i)
+				}
+			}
+		}
+	}
+}
+
+func TestValidatorJoinLeave(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(8)
+
+	// setup 7 validators and a node that is going to join
+	nodes := make([]*Node, 8)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	nodes[7] = NewObserver(8, signers[8], globalpub, 0, dkg.GetScaler())
+	for i := 0; i < 8; i++ {
+		nodes[i].Connect(nodes)
+	}
+
+	// validator 8 replaces validator 1 at height 4
+	for i := 0; i < 8; i++ {
+		if err := nodes[i].ScheduleValidatorChange(4, []uint16{8}, []uint16{1}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	for h := 1; h <= 5; h++ {
+		tx := types.NewTransaction(uint64(h), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		buf := new(bytes.Buffer)
+		if err := tx.EncodeRLP(buf); err != nil {
+			t.Fatalf(err.Error())
+		}
+		seed := tpke.RandPG1()
+		et, err := tpke.AESEncrypt(seed, buf.Bytes())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		envelope := &transaction.Envelope{
+			EncryptHeight:        nodes[1].keyEnabledHeight,
+			Epoch:                nodes[1].Epoch(),
+			EncryptedSeed:        nodes[1].globalPubKey.Encrypt(seed),
+			EncryptedTransaction: et,
+		}
+		carrier := types.NewTransaction(uint64(h), ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+		for i := 0; i < 8; i++ {
+			if err := nodes[i].PendEnvelopedTx(carrier); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+
+		// the set changes at height 4, the primary is picked from the new set and
+		// the node outside of the set follows without sending anything
+		outside, observer := uint16(8), nodes[7]
+		if h >= 4 {
+			outside, observer = 1, nodes[0]
+		}
+		primary(nodes).Propose()
+		deliver(nodes, func(m *message.Payload) bool {
+			if m.ValidatorIndex() == outside {
+				t.Fatalf("validator %d sent %s outside of the set", outside, message.TypeName(m.Type()))
+			}
+			return false
+		})
+		for i := 0; i < 8; i++ {
+			if nodes[i].height != uint64(h) {
+				t.Fatalf("node %d failed to commit height %d", i, h)
+			}
+		}
+
+		// it reaches the finalize quorum, decrypts and commits the same block
+		if observer.blocks[uint64(h)].Hash() != nodes[1].blocks[uint64(h)].Hash() {
+			t.Fatalf("observer committed another block at height %d", h)
+		}
+		if observer.blocks[uint64(h)].CarrierNum != 1 || len(observer.blocks[uint64(h)].Links) != 1 {
+			t.Fatalf("observer didn't decrypt the envelope at height %d", h)
+		}
+
+		if h == 3 {
+			if nodes[0].validator || !nodes[7].validator {
+				t.Fatalf("validator set didn't change")
+			}
+			for i := 0; i < 8; i++ {
+				if _, err := nodes[i].Validators().Lookup(1); err == nil {
+					t.Fatalf("node %d still accepts the leaving validator", i)
+				}
+				if nodes[i].quorum() != 5 {
+					t.Fatalf("node %d has a wrong quorum", i)
+				}
+			}
+		}
+	}
+}
+
+func TestEpochRestart(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		if err := nodes[i].SetEpochInterval(4); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := nodes[1].SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+	commit := func(h int) {
+		tx := types.NewTransaction(uint64(h), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		for i := 0; i < 7; i++ {
+			nodes[i].PendLegacyTx(tx)
+		}
+		primary(nodes).Propose()
+		deliver(nodes, nil)
+		for i := 0; i < 7; i++ {
+			if nodes[i].height != uint64(h) {
+				t.Fatalf("node %d failed to commit height %d", i, h)
+			}
+		}
+	}
+	for h := 1; h <= 3; h++ {
+		commit(h)
+	}
+	if nodes[1].Epoch() != 1 {
+		t.Fatalf("keys not rotated")
+	}
+	s.Close()
+
+	// validator 2 restarts from its keystore and picks up the rotated keys
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	restarted := NewNode(2, signers[2], prvs[2], prvs[2].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	if err := restarted.SetEpochInterval(4); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := restarted.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if restarted.Epoch() != 1 || restarted.keyEnabledHeight != 4 || restarted.nextEpochHeight != 8 {
+		t.Fatalf("key epoch not restored")
+	}
+	if !bytes.Equal(restarted.globalPubKey.ToBytes(), nodes[1].globalPubKey.ToBytes()) ||
+		!bytes.Equal(restarted.prv.ToBytes(), nodes[1].prv.ToBytes()) {
+		t.Fatalf("restored other keys")
+	}
+	if len(restarted.oldEpochs) != 1 || restarted.oldEpochs[0].Number != 0 {
+		t.Fatalf("old epoch not restored")
+	}
+
+	// and keeps validating with them
+	restarted.Connect(nodes)
+	restarted.messageHandler = nodes[1].messageHandler
+	nodes[1] = restarted
+	commit(4)
+}
+
+func TestKeyDealRestart(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		if err := nodes[i].SetEpochInterval(4); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := nodes[1].SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+	commit := func(h int) {
+		tx := types.NewTransaction(uint64(h), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		for i := 0; i < 7; i++ {
+			nodes[i].PendLegacyTx(tx)
+		}
+		primary(nodes).Propose()
+		deliver(nodes, nil)
+		for i := 0; i < 7; i++ {
+			if nodes[i].height != uint64(h) {
+				t.Fatalf("node %d failed to commit height %d", i, h)
+			}
+		}
+	}
+
+	// the keys are dealt after block 1, validator 2 restarts before the
+	// decision and picks up the deals it has handled
+	commit(1)
+	if len(nodes[1].keyDeals) != 7 {
+		t.Fatalf("keys not dealt")
+	}
+	s.Close()
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	restarted := NewNode(2, signers[2], prvs[2], prvs[2].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	if err := restarted.SetEpochInterval(4); err != nil {
+		t.Fatalf(err.Error())
+	}
+	restarted.Connect(nodes)
+	if err := restarted.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(restarted.keyDeals) != 7 || restarted.keyDeals[2].share == nil {
+		t.Fatalf("key deals not restored")
+	}
+	restarted.messageHandler = nodes[1].messageHandler
+	nodes[1] = restarted
+
+	// its deal sent again is no offence, and it takes part in the new epoch
+	restarted.resend()
+	deliver(nodes, nil)
+	for i := 0; i < 7; i++ {
+		if nodes[i].InvalidMessages(2) != 0 {
+			t.Fatalf("node %d rejected the deal sent again", i)
+		}
+	}
+	commit(2)
+	commit(3)
+	for i := 0; i < 7; i++ {
+		if nodes[i].Epoch() != 1 || !nodes[i].validator {
+			t.Fatalf("node %d didn't rotate keys", i)
+		}
+		if !bytes.Equal(nodes[i].globalPubKey.ToBytes(), nodes[0].globalPubKey.ToBytes()) {
+			t.Fatalf("node %d installed another global key", i)
+		}
+	}
+	commit(4)
+}
+
+func TestKeyComplaint(t *testing.T) {
+	for _, dropReveal := range []bool{false, true} {
+		dkg := tpke.NewDKG(7, 4)
+		dkg.Prepare()
+		err := dkg.Verify()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		prvs := dkg.GetPrivateKeys()
+		globalpub := dkg.PublishGlobalPublicKey()
+		signers := newSigners(7)
+
+		nodes := make([]*Node, 7)
+		for i := 0; i < 7; i++ {
+			nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+			if err := nodes[i].SetEpochInterval(4); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		for i := 0; i < 7; i++ {
+			nodes[i].Connect(nodes)
+		}
+
+		// validator 7 deals garbage to validator 1, which complains, and
+		// reveals the share unless the reveal is lost
+		var deal *message.Payload
+		drop := func(m *message.Payload) bool {
+			if m.Type() == message.KeyDealType && m.ValidatorIndex() == 7 {
+				deal = m
+				return true
+			}
+			return dropReveal && m.Type() == message.KeyRevealType
+		}
+		commit := func(h int) {
+			tx := types.NewTransaction(uint64(h), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+			for i := 0; i < 7; i++ {
+				nodes[i].PendLegacyTx(tx)
+			}
+			primary(nodes).Propose()
+			deliver(nodes, drop)
+			for i := 0; i < 7; i++ {
+				if nodes[i].height != uint64(h) {
+					t.Fatalf("node %d failed to commit height %d", i, h)
+				}
+			}
+		}
+
+		commit(1)
+		if deal == nil {
+			t.Fatalf("validator 7 didn't deal")
+		}
+		p := deal.Payload().(message.KeyDeal)
+		var garbage fr.Element
+		garbage.SetRandom()
+		p.Shares[0], err = encryptShare(&signers[1].PublicKey, &garbage)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tampered := &message.Payload{Message: deal.Message}
+		tampered.SetPayload(p)
+		tampered.Sign(signers[7])
+		for i := 0; i < 6; i++ {
+			if err := nodes[i].HandleMsg(tampered); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		deliver(nodes, drop)
+		if !nodes[1].keyComplaints[7][1] {
+			t.Fatalf("complaint about validator 7 not received")
+		}
+
+		commit(2)
+		commit(3)
+		decision := nodes[1].blocks[3].KeyDecision
+		if decision == nil {
+			t.Fatalf("no key decision committed")
+		}
+		if containsIndex(decision.Dealers, 7) != !dropReveal {
+			t.Fatalf("unexpected dealers %v", decision.Dealers)
+		}
+		for i := 0; i < 7; i++ {
+			if nodes[i].Epoch() != 1 || !nodes[i].validator {
+				t.Fatalf("node %d didn't rotate keys", i)
+			}
+			if !bytes.Equal(nodes[i].globalPubKey.ToBytes(), nodes[0].globalPubKey.ToBytes()) {
+				t.Fatalf("node %d installed another global key", i)
+			}
+		}
+		commit(4)
+	}
+}
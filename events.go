@@ -0,0 +1,136 @@
+package dbft
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nspcc-dev/dbft/payload"
+)
+
+// Event is a step of the consensus reported to subscribers.
+type Event interface {
+	EventName() string
+}
+
+// ProposalEvent is emitted when the node gets the proposal of a round.
+type ProposalEvent struct {
+	Height    uint64 `json:"height"`
+	View      byte   `json:"view"`
+	Primary   uint16 `json:"primary"`
+	Txs       int    `json:"txs"`
+	Envelopes int    `json:"envelopes"`
+}
+
+// PrepareQuorumEvent is emitted when a quorum of validators accepts the proposal.
+type PrepareQuorumEvent struct {
+	Height    uint64 `json:"height"`
+	View      byte   `json:"view"`
+	Responses int    `json:"responses"`
+}
+
+// DecryptionEvent is emitted when the envelopes of the proposal are decrypted.
+type DecryptionEvent struct {
+	Height    uint64 `json:"height"`
+	View      byte   `json:"view"`
+	Envelopes int    `json:"envelopes"` // the number of carriers in the proposal
+	Decrypted int    `json:"decrypted"` // the number of transactions decrypted from them
+	Invalid   int    `json:"invalid"`   // the number of envelopes failed to decrypt or decode
+}
+
+// CommitQuorumEvent is emitted when the commit signatures are aggregated.
+type CommitQuorumEvent struct {
+	Height  uint64 `json:"height"`
+	View    byte   `json:"view"`
+	Commits int    `json:"commits"`
+}
+
+// NewBlockEvent is emitted when a block is committed.
+type NewBlockEvent struct {
+	Height    uint64      `json:"height"`
+	Hash      common.Hash `json:"hash"`
+	Txs       int         `json:"txs"`
+	Envelopes int         `json:"envelopes"`
+}
+
+// ViewChangeEvent is emitted when the validators move to a new view.
+type ViewChangeEvent struct {
+	Height uint64                   `json:"height"`
+	View   byte                     `json:"view"` // the new view
+	Reason payload.ChangeViewReason `json:"reason"`
+}
+
+func (ProposalEvent) EventName() string      { return "proposal" }
+func (PrepareQuorumEvent) EventName() string { return "prepareQuorum" }
+func (DecryptionEvent) EventName() string    { return "decryption" }
+func (CommitQuorumEvent) EventName() string  { return "commitQuorum" }
+func (NewBlockEvent) EventName() string      { return "newBlock" }
+func (ViewChangeEvent) EventName() string    { return "viewChange" }
+
+// Subscription delivers events to a subscriber. Events are never waited for,
+// they are dropped while the channel is full.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	node    *Node
+	dropped int
+}
+
+// feed keeps the subscriptions of a node, it is shared with other goroutines
+type feed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscribe returns a subscription to the consensus events, it is safe to
+// call from other goroutines
+func (n *Node) Subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, node: n}
+	n.feed.mu.Lock()
+	defer n.feed.mu.Unlock()
+	if n.feed.subs == nil {
+		n.feed.subs = make(map[*Subscription]struct{})
+	}
+	n.feed.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe stops the delivery and closes the channel
+func (s *Subscription) Unsubscribe() {
+	s.node.feed.mu.Lock()
+	defer s.node.feed.mu.Unlock()
+	if _, ok := s.node.feed.subs[s]; ok {
+		delete(s.node.feed.subs, s)
+		close(s.c)
+	}
+}
+
+// get the number of events dropped for a full channel
+func (s *Subscription) Dropped() int {
+	s.node.feed.mu.Lock()
+	defer s.node.feed.mu.Unlock()
+	return s.dropped
+}
+
+// emit sends an event to all subscribers without blocking the consensus
+func (n *Node) emit(e Event) {
+	n.feed.mu.Lock()
+	defer n.feed.mu.Unlock()
+	for s := range n.feed.subs {
+		select {
+		case s.c <- e:
+		default:
+			s.dropped += 1
+		}
+	}
+}
+
+func (n *Node) emitProposal(primary uint16) {
+	n.emit(ProposalEvent{
+		Height:    n.height + 1,
+		View:      n.view,
+		Primary:   primary,
+		Txs:       len(n.txList),
+		Envelopes: n.envelopNum,
+	})
+}
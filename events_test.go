@@ -0,0 +1,59 @@
+package dbft
+
+import (
+	"testing"
+
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/txhsl/tpke"
+)
+
+func TestSubscribe(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+	sub := nodes[1].Subscribe(16)
+
+	// the second validator is the primary of view 1
+	changeView(nodes, signers, 0)
+	nodes[1].Propose()
+	deliver(nodes, nil)
+
+	sub.Unsubscribe()
+	events := make([]Event, 0)
+	for e := range sub.C {
+		events = append(events, e)
+	}
+	if len(events) != 6 || sub.Dropped() != 0 {
+		t.Fatalf("unexpected number of events %d", len(events))
+	}
+	if e, ok := events[0].(ViewChangeEvent); !ok || e.View != 1 || e.Reason != payload.CVTimeout {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+	if e, ok := events[1].(ProposalEvent); !ok || e.Height != 1 || e.View != 1 || e.Primary != 2 {
+		t.Fatalf("unexpected event %+v", events[1])
+	}
+	if e, ok := events[5].(NewBlockEvent); !ok || e.Height != 1 || e.Hash != nodes[1].blocks[1].Header.Hash() {
+		t.Fatalf("unexpected event %+v", events[5])
+	}
+	seen := make(map[string]bool)
+	for _, e := range events {
+		seen[e.EventName()] = true
+	}
+	if len(seen) != 6 {
+		t.Fatalf("missing events %v", seen)
+	}
+}
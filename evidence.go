@@ -0,0 +1,200 @@
+package dbft
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/nspcc-dev/neo-go/pkg/io"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// Evidence proves that a validator has signed two conflicting messages of the
+// same type for the same height and view. It carries both signed payloads, so
+// anyone knowing the validator signing key can verify it.
+type Evidence struct {
+	First  *message.Payload
+	Second *message.Payload
+}
+
+// evidenceKey identifies the slot a validator is allowed to sign only once
+type evidenceKey struct {
+	height    uint64
+	view      byte
+	validator uint16
+	msgType   payload.MessageType
+}
+
+func slotOf(m *message.Payload) evidenceKey {
+	return evidenceKey{
+		height:    m.BlockIndex,
+		view:      m.ViewNumber(),
+		validator: m.ValidatorIndex(),
+		msgType:   m.Type(),
+	}
+}
+
+// EvidencePool keeps the signed votes seen per height, view, validator and type
+// and collects evidence of equivocation.
+type EvidencePool struct {
+	votes    map[evidenceKey]*message.Payload
+	reported map[evidenceKey]bool
+	pending  []*Evidence
+}
+
+func NewEvidencePool() *EvidencePool {
+	return &EvidencePool{
+		votes:    make(map[evidenceKey]*message.Payload),
+		reported: make(map[evidenceKey]bool),
+		pending:  make([]*Evidence, 0),
+	}
+}
+
+// Add records a verified payload, it returns the evidence if the payload
+// conflicts with one signed before by the same validator. Only one evidence
+// is produced for each slot.
+func (p *EvidencePool) Add(m *message.Payload) *Evidence {
+	if !isVote(m.Type()) {
+		return nil
+	}
+	k := slotOf(m)
+	prev, ok := p.votes[k]
+	if !ok {
+		p.votes[k] = m
+		return nil
+	}
+	if p.reported[k] || !conflicting(prev, m) {
+		return nil
+	}
+	e := &Evidence{First: prev, Second: m}
+	p.reported[k] = true
+	p.pending = append(p.pending, e)
+	return e
+}
+
+// Pending returns the evidence not yet included into a block.
+func (p *EvidencePool) Pending() []*Evidence {
+	return append([]*Evidence(nil), p.pending...)
+}
+
+// MarkIncluded removes the evidence from the pending list once it has been
+// included into a block. Evidence is matched by its slot, so evidence decoded
+// from a block removes the pending one.
+func (p *EvidencePool) MarkIncluded(es []*Evidence) {
+	for _, e := range es {
+		if e == nil || e.First == nil {
+			continue
+		}
+		k := slotOf(e.First)
+		for i, v := range p.pending {
+			if slotOf(v.First) == k {
+				p.pending = append(p.pending[:i], p.pending[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Prune drops the votes below the given height, pending evidence is kept.
+func (p *EvidencePool) Prune(height uint64) {
+	for k := range p.votes {
+		if k.height < height {
+			delete(p.votes, k)
+		}
+	}
+	for k := range p.reported {
+		if k.height < height {
+			delete(p.reported, k)
+		}
+	}
+}
+
+// Validator returns the index of the equivocating validator.
+func (e *Evidence) Validator() uint16 {
+	return e.First.ValidatorIndex()
+}
+
+// Height returns the block height where the equivocation happened.
+func (e *Evidence) Height() uint64 {
+	return e.First.BlockIndex
+}
+
+// Verify checks that both payloads are signed by the validator owning the
+// message signing key pub and are conflicting votes for the same slot.
+func (e *Evidence) Verify(pub *ecdsa.PublicKey) error {
+	if e.First == nil || e.Second == nil {
+		return errors.New("incomplete evidence")
+	}
+	a, b := e.First, e.Second
+	if a.BlockIndex != b.BlockIndex || a.ViewNumber() != b.ViewNumber() ||
+		a.ValidatorIndex() != b.ValidatorIndex() || a.Type() != b.Type() {
+		return errors.New("payloads are for different slots")
+	}
+	if !isVote(a.Type()) {
+		return fmt.Errorf("unexpected message type 0x%02x", byte(a.Type()))
+	}
+	if !conflicting(a, b) {
+		return errors.New("payloads are not conflicting")
+	}
+	if err := a.Verify(pub); err != nil {
+		return fmt.Errorf("first payload: %w", err)
+	}
+	if err := b.Verify(pub); err != nil {
+		return fmt.Errorf("second payload: %w", err)
+	}
+	return nil
+}
+
+// EncodeBinary implements the io.Serializable interface.
+func (e *Evidence) EncodeBinary(w *io.BinWriter) {
+	e.First.EncodeBinary(w)
+	e.Second.EncodeBinary(w)
+}
+
+// DecodeBinary implements the io.Serializable interface.
+func (e *Evidence) DecodeBinary(r *io.BinReader) {
+	e.First = new(message.Payload)
+	e.First.DecodeBinary(r)
+	e.Second = new(message.Payload)
+	e.Second.DecodeBinary(r)
+}
+
+func (e *Evidence) ToBytes() []byte {
+	w := io.NewBufBinWriter()
+	e.EncodeBinary(w.BinWriter)
+	if w.Err != nil {
+		panic("failed to encode evidence: " + w.Err.Error())
+	}
+	return w.Bytes()
+}
+
+func BytesToEvidence(b []byte) (*Evidence, error) {
+	e := new(Evidence)
+	r := io.NewBinReaderFromBuf(b)
+	e.DecodeBinary(r)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return e, nil
+}
+
+// isVote reports whether a validator must sign only one message of the type per view
+func isVote(t payload.MessageType) bool {
+	return t == payload.PrepareResponseType || t == payload.CommitType
+}
+
+// conflicting reports whether two votes of the same slot are for different hashes
+func conflicting(a, b *message.Payload) bool {
+	switch a.Type() {
+	case payload.PrepareResponseType:
+		x, ok1 := a.Payload().(message.PrepareResponse)
+		y, ok2 := b.Payload().(message.PrepareResponse)
+		return ok1 && ok2 && x.PreparationHash != y.PreparationHash
+	case payload.CommitType:
+		x, ok1 := a.Payload().(message.Commit)
+		y, ok2 := b.Payload().(message.Commit)
+		return ok1 && ok2 && x.FinalHash != y.FinalHash
+	}
+	return false
+}
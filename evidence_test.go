@@ -0,0 +1,72 @@
+package dbft
+
+import (
+	"testing"
+
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+func TestEquivocationEvidence(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	// setup node, note that dkg index start from 1 to 7, due to mathematical reason
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	nodes[0].Connect(nodes)
+
+	// validator 2 signs two different preparation hashes in the same view
+	for i := 0; i < 2; i++ {
+		msg := &message.Payload{
+			Message: message.Message{
+				Type:           payload.PrepareResponseType,
+				ValidatorIndex: 2,
+				BlockIndex:     1,
+				ViewNumber:     0,
+			},
+		}
+		msg.SetPayload(message.PrepareResponse{
+			PreparationHash: util.Uint256{byte(i)},
+		})
+		msg.Sign(signers[2])
+		nodes[0].HandleMsg(msg)
+	}
+
+	evidence := nodes[0].PendingEvidence()
+	if len(evidence) != 1 {
+		t.Fatalf("equivocation not detected")
+	}
+	if evidence[0].Validator() != 2 || evidence[0].Height() != 1 {
+		t.Fatalf("wrong evidence slot")
+	}
+
+	// the evidence can be verified by anyone after decoding
+	decoded, err := BytesToEvidence(evidence[0].ToBytes())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := decoded.Verify(&signers[2].PublicKey); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := decoded.Verify(&signers[3].PublicKey); err == nil {
+		t.Fatalf("evidence verified with a wrong key")
+	}
+
+	// evidence decoded from a block removes the pending one
+	nodes[0].MarkEvidenceIncluded([]*Evidence{decoded})
+	if len(nodes[0].PendingEvidence()) != 0 {
+		t.Fatalf("evidence not removed")
+	}
+}
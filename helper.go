@@ -1,6 +1,7 @@
 package dbft
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -15,20 +16,20 @@ func EncodeSignatureShare(s *tpke.SignatureShare) []byte {
 	return s.ToBytes()
 }
 
-func DecodeSignatureShare(b []byte) *tpke.SignatureShare {
+func DecodeSignatureShare(b []byte) (*tpke.SignatureShare, error) {
 	s, err := tpke.BytesToSigShare(b)
 	if err != nil {
-		panic("failed to decode sig share")
+		return nil, fmt.Errorf("failed to decode sig share: %w", err)
 	}
-	return s
+	return s, nil
 }
 
-func DecodeSignature(b []byte) *tpke.Signature {
+func DecodeSignature(b []byte) (*tpke.Signature, error) {
 	s, err := tpke.BytesToSig(b)
 	if err != nil {
-		panic("failed to decode sig")
+		return nil, fmt.Errorf("failed to decode sig: %w", err)
 	}
-	return s
+	return s, nil
 }
 
 func EncodeDecryptionShare(ss []*tpke.DecryptionShare) [][]byte {
@@ -39,16 +40,16 @@ func EncodeDecryptionShare(ss []*tpke.DecryptionShare) [][]byte {
 	return bs
 }
 
-func DecodeDecryptionShare(bs [][]byte) []*tpke.DecryptionShare {
+func DecodeDecryptionShare(bs [][]byte) ([]*tpke.DecryptionShare, error) {
 	ss := make([]*tpke.DecryptionShare, len(bs))
 	for i := 0; i < len(bs); i++ {
 		s, err := tpke.BytesToDecryptionShare(bs[i])
 		if err != nil {
-			panic("failed to decode share")
+			return nil, fmt.Errorf("failed to decode share %d: %w", i, err)
 		}
 		ss[i] = s
 	}
-	return ss
+	return ss, nil
 }
 
 // WorkerSealHash returns the hash of a header prior to it being sealed. WorkerSealHash is
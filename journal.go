@@ -0,0 +1,195 @@
+package dbft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// JournalKind is the kind of a journal record.
+type JournalKind byte
+
+const (
+	JournalStart       JournalKind = iota + 1 // the round of the node when journaling starts
+	JournalIn                                 // a message received from a peer
+	JournalOut                                // a message sent by the node
+	JournalTx                                 // a transaction submitted to the node
+	JournalBlockTime                          // the block time of the primary elapsed
+	JournalViewTimeout                        // the view timed out
+)
+
+var journalKindNames = map[JournalKind]string{
+	JournalStart:       "start",
+	JournalIn:          "in",
+	JournalOut:         "out",
+	JournalTx:          "tx",
+	JournalBlockTime:   "blockTime",
+	JournalViewTimeout: "viewTimeout",
+}
+
+func (k JournalKind) String() string {
+	if name, ok := journalKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("JournalKind(%d)", byte(k))
+}
+
+// the size of the record head: kind, unix nano time and data length
+const journalHeadSize = 1 + 8 + 4
+
+// JournalRecord is an input or output of the event loop.
+type JournalRecord struct {
+	Kind    JournalKind
+	Time    time.Time
+	Height  uint64             // the height being agreed on, for start records
+	View    byte               // for start records
+	Payload *message.Payload   // for in and out records
+	Tx      *types.Transaction // for tx records
+}
+
+// Journal appends the inputs and outputs of a node, so that a stall can be
+// reproduced by replaying the inputs into a fresh node. Every record is
+// written before the node acts on it.
+type Journal struct {
+	w io.Writer
+}
+
+// NewJournal writes a journal to w
+func NewJournal(w io.Writer) *Journal {
+	return &Journal{w: w}
+}
+
+// OpenJournal appends to the journal file at path, the file is only readable
+// by its owner
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{w: f}, nil
+}
+
+// Close closes the underlying file, if any
+func (j *Journal) Close() error {
+	if c, ok := j.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (j *Journal) append(kind JournalKind, data []byte) error {
+	if len(data) > maxFrameSize {
+		return errors.New("journal record is too large")
+	}
+	buf := make([]byte, journalHeadSize, journalHeadSize+len(data))
+	buf[0] = byte(kind)
+	binary.BigEndian.PutUint64(buf[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(buf[9:], uint32(len(data)))
+	// a single write, so that a record is never interleaved
+	_, err := j.w.Write(append(buf, data...))
+	return err
+}
+
+// JournalReader reads the records of a journal in order.
+type JournalReader struct {
+	r io.Reader
+}
+
+func NewJournalReader(r io.Reader) *JournalReader {
+	return &JournalReader{r: r}
+}
+
+// Next returns the next record, io.EOF at the end of the journal and
+// io.ErrUnexpectedEOF for a record cut off by a crash
+func (r *JournalReader) Next() (*JournalRecord, error) {
+	var head [journalHeadSize]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[9:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("journal record of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rec := &JournalRecord{
+		Kind: JournalKind(head[0]),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(head[1:]))),
+	}
+	var err error
+	switch rec.Kind {
+	case JournalStart:
+		if len(data) != 9 {
+			return nil, errors.New("invalid journal start record")
+		}
+		rec.Height = binary.BigEndian.Uint64(data)
+		rec.View = data[8]
+	case JournalIn, JournalOut:
+		rec.Payload, err = message.BytesToPayload(data)
+	case JournalTx:
+		rec.Tx = new(types.Transaction)
+		err = rec.Tx.UnmarshalBinary(data)
+	case JournalBlockTime, JournalViewTimeout:
+	default:
+		return nil, fmt.Errorf("unknown journal record %s", rec.Kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal %s record: %w", rec.Kind, err)
+	}
+	return rec, nil
+}
+
+// set the journal of the node, the current round is recorded first
+func (n *Node) SetJournal(j *Journal) error {
+	n.journal = j
+	data := binary.BigEndian.AppendUint64(nil, n.height+1)
+	return j.append(JournalStart, append(data, n.view))
+}
+
+// record an input or output, a failing journal doesn't stop the consensus
+func (n *Node) record(kind JournalKind, data []byte) {
+	if n.journal == nil {
+		return
+	}
+	if err := n.journal.append(kind, data); err != nil {
+		n.logRound(slog.LevelWarn, "failed to write journal", "kind", kind, "err", err)
+	}
+}
+
+// recordMsg records a message as it is sent or received. The shares of a key
+// deal are encrypted to the members, so only the journaled node decrypts its
+// share again on replay and installs the same keys.
+func (n *Node) recordMsg(kind JournalKind, m *message.Payload) {
+	if n.journal == nil {
+		return
+	}
+	n.record(kind, m.ToBytes())
+}
+
+// Apply handles an input record the same way the event loop does, outputs
+// and start records are skipped
+func (n *Node) Apply(rec *JournalRecord) error {
+	switch rec.Kind {
+	case JournalIn:
+		return n.receive(rec.Payload)
+	case JournalTx:
+		return n.pendTx(rec.Tx)
+	case JournalBlockTime:
+		n.onBlockTime()
+	case JournalViewTimeout:
+		n.onViewTimeout()
+	}
+	return nil
+}
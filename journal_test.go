@@ -0,0 +1,92 @@
+package dbft
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+func TestJournal(t *testing.T) {
+	n := NewObserver(1, nil, nil, 0, 0)
+	var buf bytes.Buffer
+	if err := n.SetJournal(NewJournal(&buf)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	if err := n.pendTx(tx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           message.FinalizeType,
+			ValidatorIndex: 5,
+			BlockIndex:     1,
+		},
+	}
+	msg.SetPayload(message.Finalize{})
+	n.receive(msg)
+	n.onViewTimeout()
+	data := buf.Bytes()
+
+	// replay the journal into a fresh node
+	replayed := NewObserver(1, nil, nil, 0, 0)
+	r := NewJournalReader(bytes.NewReader(data))
+	kinds := []JournalKind{}
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		kinds = append(kinds, rec.Kind)
+		if rec.Kind == JournalStart && (rec.Height != 1 || rec.View != 0) {
+			t.Fatalf("unexpected start round %d %d", rec.Height, rec.View)
+		}
+		replayed.Apply(rec)
+	}
+	expected := []JournalKind{JournalStart, JournalTx, JournalIn, JournalViewTimeout}
+	if len(kinds) != len(expected) {
+		t.Fatalf("unexpected records %v", kinds)
+	}
+	for i := range kinds {
+		if kinds[i] != expected[i] {
+			t.Fatalf("unexpected records %v", kinds)
+		}
+	}
+	if len(replayed.legacyPool) != 1 || replayed.legacyPool[0].Hash() != tx.Hash() {
+		t.Fatalf("tx not replayed")
+	}
+	if replayed.UnknownSenderMessages() != 1 {
+		t.Fatalf("message not replayed")
+	}
+
+	// a record cut off by a crash
+	r = NewJournalReader(bytes.NewReader(data[:len(data)-journalHeadSize-1]))
+	var err error
+	for err == nil {
+		_, err = r.Next()
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the encrypted shares are journaled, so a replayed deal installs keys
+	buf.Reset()
+	deal := &message.Payload{Message: message.Message{Type: message.KeyDealType}}
+	deal.SetPayload(message.KeyDeal{Epoch: 1, Shares: [][]byte{{1, 2, 3}}})
+	n.recordMsg(JournalOut, deal)
+	rec, err := NewJournalReader(&buf).Next()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if d := rec.Payload.Payload().(message.KeyDeal); d.Epoch != 1 || len(d.Shares) != 1 || !bytes.Equal(d.Shares[0], []byte{1, 2, 3}) {
+		t.Fatalf("share not journaled")
+	}
+}
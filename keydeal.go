@@ -0,0 +1,490 @@
+package dbft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+// Every validator deals its part of the keys of the next epoch a few blocks
+// before the boundary, see dkg.go. A member whose share of a deal fails to
+// decrypt or to match the commitments complains, and the dealer answers by
+// revealing the share, which every node checks against the commitments. The
+// primary of the last block of the epoch proposes the dealers without an
+// unanswered complaint together with the sums of their commitments, and
+// validators only respond if the decision matches their own view of the deals.
+// Every node installs the keys of the committed decision at the boundary, a
+// member missing the share of a decided dealer follows the epoch without a
+// key share.
+
+// errKnownKeyDeal is returned for a key deal, complaint or reveal handled
+// before, peers send them again after a restart
+var errKnownKeyDeal = errors.New("known key deal")
+
+// keyDeal is a checked deal of the next epoch
+type keyDeal struct {
+	commitments []bls.G1Affine
+	share       *fr.Element     // the share of this node, nil if it is not a member or its share is invalid
+	revealed    map[uint16]bool // members whose shares the dealer has revealed
+}
+
+// isKeyDeal reports whether a message type belongs to the key deals
+func isKeyDeal(t payload.MessageType) bool {
+	return t == message.KeyDealType || t == message.KeyComplaintType || t == message.KeyRevealType
+}
+
+// isNextMember reports whether a node is a member of the next epoch, members
+// joining with the next epoch complain about their shares too
+func (n *Node) isNextMember(index uint16) bool {
+	boundary, ok := n.nextBoundary()
+	return ok && containsIndex(n.nextMembers(boundary), index)
+}
+
+// handleKeyDeal handles a key deal, complaint or reveal. The ones for another
+// epoch are dropped without counting them against the sender, since they
+// arrive late or this node is behind.
+func (n *Node) handleKeyDeal(m *message.Payload) error {
+	var epoch, enabledHeight uint64
+	switch p := m.Payload().(type) {
+	case message.KeyDeal:
+		epoch, enabledHeight = p.Epoch, p.EnabledHeight
+	case message.KeyComplaint:
+		epoch, enabledHeight = p.Epoch, p.EnabledHeight
+	case message.KeyReveal:
+		epoch, enabledHeight = p.Epoch, p.EnabledHeight
+	default:
+		return n.reject(m, fmt.Errorf("malformed %s", message.TypeName(m.Type())))
+	}
+	boundary, ok := n.nextBoundary()
+	if !ok || epoch != n.epoch+1 || enabledHeight != boundary {
+		n.staleMessages += 1
+		n.metrics.staleMessage(1)
+		n.logMsg(slog.LevelDebug, "dropped key deal of another epoch", m, "epoch", epoch, "enabledHeight", enabledHeight)
+		return nil
+	}
+
+	var err error
+	switch p := m.Payload().(type) {
+	case message.KeyDeal:
+		err = n.acceptKeyDeal(m.ValidatorIndex(), p, boundary)
+	case message.KeyComplaint:
+		err = n.acceptKeyComplaint(m.ValidatorIndex(), p, boundary)
+	case message.KeyReveal:
+		err = n.acceptKeyReveal(m.ValidatorIndex(), p, boundary)
+	}
+	if errors.Is(err, errKnownKeyDeal) {
+		return nil
+	}
+	if err != nil {
+		return n.reject(m, err)
+	}
+	n.logMsg(slog.LevelDebug, "handled key deal", m, "epoch", epoch)
+	n.keyDealMsgs = append(n.keyDealMsgs, m)
+	if err := n.saveKeyDeals(); err != nil {
+		n.logRound(slog.LevelError, "failed to save key deals", "err", err)
+	}
+	return nil
+}
+
+// sendKeyDeal signs a key deal, complaint or reveal, persists it and sends it
+// to all neighbors. Unlike broadcast, members outside of the validator set
+// send their complaints too.
+func (n *Node) sendKeyDeal(t payload.MessageType, p any) {
+	if n.signer == nil {
+		return
+	}
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           t,
+			ValidatorIndex: n.index,
+			BlockIndex:     n.height + 1,
+			ViewNumber:     n.view,
+		},
+	}
+	msg.SetPayload(p)
+	msg.Sign(n.signer)
+	n.keyDealMsgs = append(n.keyDealMsgs, msg)
+	if err := n.saveKeyDeals(); err != nil {
+		n.logRound(slog.LevelError, "failed to save key deals", "err", err)
+		return
+	}
+	n.metrics.message(msg.Type(), "out")
+	n.recordMsg(JournalOut, msg)
+	for i := 0; i < len(n.neighbors); i++ {
+		n.neighbors[i] <- msg
+	}
+}
+
+// dealSeed is the secret the polynomial of this node for the next epoch is
+// derived from, so the node can reveal a share later without keeping the
+// polynomial
+func (n *Node) dealSeed(boundary uint64) []byte {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], n.epoch+1)
+	binary.BigEndian.PutUint64(b[8:], boundary)
+	return crypto.Keccak256([]byte("dbft key deal"), crypto.FromECDSA(n.signer), b[:])
+}
+
+// dealKeys deals the part of this validator in the keys of the next epoch to
+// all nodes, a restarted node doesn't deal again
+func (n *Node) dealKeys(boundary uint64) error {
+	if _, ok := n.keyDeals[uint16(n.index)]; ok {
+		return nil
+	}
+	ms := n.nextMembers(boundary)
+	if len(ms) == 0 || ms[0] == 0 {
+		return errors.New("validator indexes should start from 1")
+	}
+	if n.signer == nil {
+		return errors.New("no message signing key")
+	}
+	threshold := quorumOf(len(ms)) - 1
+	p := deriveDKGPolynomial(n.dealSeed(boundary), threshold)
+	deal := message.KeyDeal{
+		Epoch:         n.epoch + 1,
+		EnabledHeight: boundary,
+		Threshold:     uint64(threshold),
+		Members:       ms,
+		Commitments:   make([][]byte, len(p.commitments)),
+		Shares:        make([][]byte, len(ms)),
+	}
+	for k := range p.commitments {
+		deal.Commitments[k] = encodeG1(&p.commitments[k])
+	}
+	var err error
+	for j, i := range ms {
+		pub := &n.signer.PublicKey
+		if i != uint16(n.index) {
+			if pub, err = n.signers.Lookup(i); err != nil {
+				return fmt.Errorf("no signing key to encrypt the share to: %w", err)
+			}
+		}
+		s := p.eval(i)
+		if deal.Shares[j], err = encryptShare(pub, &s); err != nil {
+			return err
+		}
+	}
+	if err := n.acceptKeyDeal(uint16(n.index), deal, boundary); err != nil {
+		return err
+	}
+	n.sendKeyDeal(message.KeyDealType, deal)
+
+	// complaints may arrive before the deal
+	for c := range n.keyComplaints[uint16(n.index)] {
+		n.revealShare(c, boundary)
+	}
+	return nil
+}
+
+// acceptKeyDeal checks the deal of a validator for the next epoch and keeps it
+// until the boundary. A deal with an invalid share for this node is kept too,
+// the node complains about it.
+func (n *Node) acceptKeyDeal(dealer uint16, deal message.KeyDeal, boundary uint64) error {
+	if d, ok := n.keyDeals[dealer]; ok {
+		// the shares are encrypted again when a deal is resent
+		if len(d.commitments) != len(deal.Commitments) {
+			return errors.New("conflicting key deal")
+		}
+		for k := range d.commitments {
+			if !bytes.Equal(encodeG1(&d.commitments[k]), deal.Commitments[k]) {
+				return errors.New("conflicting key deal")
+			}
+		}
+		return errKnownKeyDeal
+	}
+	ms := n.nextMembers(boundary)
+	if !equalMembers(ms, deal.Members) {
+		return errors.New("unexpected validator set")
+	}
+	threshold := quorumOf(len(ms)) - 1
+	if deal.Threshold != uint64(threshold) {
+		return fmt.Errorf("unexpected threshold %d", deal.Threshold)
+	}
+	if len(deal.Commitments) != threshold+1 || len(deal.Shares) != len(ms) {
+		return fmt.Errorf("%d commitments and %d shares for %d members", len(deal.Commitments), len(deal.Shares), len(ms))
+	}
+	cs, err := decodeCommitments(deal.Commitments)
+	if err != nil {
+		return err
+	}
+
+	// only the members of the next epoch get a share
+	d := &keyDeal{commitments: cs, revealed: make(map[uint16]bool)}
+	complain := false
+	for j, i := range ms {
+		if i != uint16(n.index) {
+			continue
+		}
+		if d.share, err = n.openShare(deal.Shares[j], cs); err != nil {
+			n.logRound(slog.LevelWarn, "invalid share in key deal, complaining", "dealer", dealer, "err", err)
+			complain = true
+		}
+	}
+	if n.keyDeals == nil {
+		n.keyDeals = make(map[uint16]*keyDeal)
+	}
+	n.keyDeals[dealer] = d
+	if complain && n.addKeyComplaint(dealer, uint16(n.index)) {
+		n.sendKeyDeal(message.KeyComplaintType, message.KeyComplaint{
+			Epoch:         n.epoch + 1,
+			EnabledHeight: boundary,
+			Dealer:        dealer,
+		})
+	}
+	return nil
+}
+
+// openShare decrypts the share of this node in a deal and checks it against
+// the commitments
+func (n *Node) openShare(c []byte, cs []bls.G1Affine) (*fr.Element, error) {
+	if n.signer == nil {
+		return nil, errors.New("no signing key to decrypt the share with")
+	}
+	s, err := decryptShare(n.signer, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt share: %w", err)
+	}
+	if err := verifyShare(s, cs, uint16(n.index)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// addKeyComplaint keeps a complaint about a dealer, it returns false for a
+// complaint already known
+func (n *Node) addKeyComplaint(dealer, complainer uint16) bool {
+	if n.keyComplaints == nil {
+		n.keyComplaints = make(map[uint16]map[uint16]bool)
+	}
+	if n.keyComplaints[dealer] == nil {
+		n.keyComplaints[dealer] = make(map[uint16]bool)
+	}
+	if n.keyComplaints[dealer][complainer] {
+		return false
+	}
+	n.keyComplaints[dealer][complainer] = true
+	return true
+}
+
+// acceptKeyComplaint keeps the complaint of a member of the next epoch, a
+// complaint about this node is answered at once
+func (n *Node) acceptKeyComplaint(complainer uint16, c message.KeyComplaint, boundary uint64) error {
+	if !containsIndex(n.nextMembers(boundary), complainer) {
+		return errors.New("complaint from outside of the next validator set")
+	}
+	if c.Dealer == complainer || !containsIndex(n.members(), c.Dealer) {
+		return fmt.Errorf("complaint about validator %d", c.Dealer)
+	}
+	if !n.addKeyComplaint(c.Dealer, complainer) {
+		return errKnownKeyDeal
+	}
+	if d, ok := n.keyDeals[c.Dealer]; ok && c.Dealer == uint16(n.index) && !d.revealed[complainer] {
+		n.revealShare(complainer, boundary)
+	}
+	return nil
+}
+
+// revealShare answers a complaint about the deal of this node with the share
+// of the complaining member
+func (n *Node) revealShare(complainer uint16, boundary uint64) {
+	ms := n.nextMembers(boundary)
+	p := deriveDKGPolynomial(n.dealSeed(boundary), quorumOf(len(ms))-1)
+	s := p.eval(complainer)
+	b := s.Bytes()
+	n.keyDeals[uint16(n.index)].revealed[complainer] = true
+	n.logRound(slog.LevelInfo, "revealing key share of a complaining member", "member", complainer)
+	n.sendKeyDeal(message.KeyRevealType, message.KeyReveal{
+		Epoch:         n.epoch + 1,
+		EnabledHeight: boundary,
+		Complainer:    complainer,
+		Share:         b[:],
+	})
+}
+
+// acceptKeyReveal checks a revealed share against the deal of the dealer,
+// this node takes the share if it has complained itself
+func (n *Node) acceptKeyReveal(dealer uint16, r message.KeyReveal, boundary uint64) error {
+	d, ok := n.keyDeals[dealer]
+	if !ok {
+		// the deal comes before the reveal, unless this node has missed it
+		n.logRound(slog.LevelDebug, "dropped key reveal without the deal", "dealer", dealer)
+		return nil
+	}
+	if !containsIndex(n.nextMembers(boundary), r.Complainer) {
+		return fmt.Errorf("revealed share of validator %d", r.Complainer)
+	}
+	if d.revealed[r.Complainer] {
+		return errKnownKeyDeal
+	}
+	s := new(fr.Element)
+	if err := s.SetBytesCanonical(r.Share); err != nil {
+		return err
+	}
+	if err := verifyShare(s, d.commitments, r.Complainer); err != nil {
+		return fmt.Errorf("revealed share: %w", err)
+	}
+	d.revealed[r.Complainer] = true
+	if r.Complainer == uint16(n.index) && d.share == nil {
+		d.share = s
+	}
+	return nil
+}
+
+// qualifiedDealers returns the sorted dealers this node holds a deal of with
+// every known complaint about it answered
+func (n *Node) qualifiedDealers() []uint16 {
+	ds := make([]uint16, 0, len(n.keyDeals))
+	for i, d := range n.keyDeals {
+		answered := true
+		for c := range n.keyComplaints[i] {
+			answered = answered && d.revealed[c]
+		}
+		if answered {
+			ds = append(ds, i)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds
+}
+
+// keyDecision sums the commitments of the deals of the given dealers
+func (n *Node) keyDecision(boundary uint64, dealers []uint16) *message.KeyDecision {
+	ms := n.nextMembers(boundary)
+	sum := make([]bls.G1Jac, quorumOf(len(ms)))
+	for _, i := range dealers {
+		cs := n.keyDeals[i].commitments
+		for k := range cs {
+			sum[k].AddMixed(&cs[k])
+		}
+	}
+	d := &message.KeyDecision{
+		Epoch:         n.epoch + 1,
+		EnabledHeight: boundary,
+		Members:       ms,
+		Dealers:       dealers,
+		Commitments:   make([][]byte, len(sum)),
+	}
+	for k := range sum {
+		var c bls.G1Affine
+		c.FromJacobian(&sum[k])
+		d.Commitments[k] = encodeG1(&c)
+	}
+	return d
+}
+
+// decideKeys returns the key decision the primary proposes with the last
+// block of an epoch, nil for other blocks or if too few dealers qualify. At
+// least a quorum of validators should qualify, so that an honest one is among
+// them and no coalition of faulty dealers knows the secret.
+func (n *Node) decideKeys() *message.KeyDecision {
+	boundary, ok := n.nextBoundary()
+	if !ok || n.height+2 != boundary {
+		return nil
+	}
+	dealers := n.qualifiedDealers()
+	if len(dealers) < n.quorum() {
+		n.logRound(slog.LevelWarn, "too few qualified key deals", "epoch", n.epoch+1, "dealers", len(dealers), "quorum", n.quorum())
+		return nil
+	}
+	return n.keyDecision(boundary, dealers)
+}
+
+// checkKeyDecision checks a proposed key decision against the deals and
+// complaints this node knows
+func (n *Node) checkKeyDecision(d *message.KeyDecision) error {
+	boundary, ok := n.nextBoundary()
+	if !ok || n.height+2 != boundary || d.Epoch != n.epoch+1 || d.EnabledHeight != boundary {
+		return fmt.Errorf("unexpected key decision for epoch %d at height %d", d.Epoch, d.EnabledHeight)
+	}
+	if !equalMembers(d.Members, n.nextMembers(boundary)) {
+		return errors.New("unexpected validator set")
+	}
+	if len(d.Dealers) < n.quorum() {
+		return fmt.Errorf("%d dealers, the quorum is %d", len(d.Dealers), n.quorum())
+	}
+	qualified := n.qualifiedDealers()
+	for j, i := range d.Dealers {
+		if j > 0 && i <= d.Dealers[j-1] {
+			return errors.New("dealers are not sorted")
+		}
+		if !containsIndex(qualified, i) {
+			return fmt.Errorf("no qualified deal of validator %d", i)
+		}
+	}
+	expected := n.keyDecision(boundary, d.Dealers)
+	if len(d.Commitments) != len(expected.Commitments) {
+		return errors.New("commitments don't match the deals")
+	}
+	for k := range expected.Commitments {
+		if !bytes.Equal(d.Commitments[k], expected.Commitments[k]) {
+			return errors.New("commitments don't match the deals")
+		}
+	}
+	return nil
+}
+
+// decidedEpoch builds the keys of the next epoch from the committed key
+// decision, the share of this node is the sum of its shares of the decided
+// dealers
+func (n *Node) decidedEpoch(d *message.KeyDecision, boundary uint64) (*KeyEpoch, error) {
+	if d == nil {
+		return nil, errors.New("no key decision")
+	}
+	if d.Epoch != n.epoch+1 || d.EnabledHeight != boundary || len(d.Members) == 0 || len(d.Commitments) != quorumOf(len(d.Members)) {
+		return nil, fmt.Errorf("unexpected key decision for epoch %d at height %d", d.Epoch, d.EnabledHeight)
+	}
+	cs, err := decodeCommitments(d.Commitments)
+	if err != nil {
+		return nil, err
+	}
+	global, err := tpkePublicKey(&cs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert global key: %w", err)
+	}
+	pubs := make(ValidatorSet, len(d.Members))
+	var prv *tpke.PrivateKey
+	for _, i := range d.Members {
+		p := commitmentAt(cs, i)
+		if pubs[i], err = tpkePublicKey(&p); err != nil {
+			return nil, fmt.Errorf("failed to convert public key of validator %d: %w", i, err)
+		}
+		if i != uint16(n.index) {
+			continue
+		}
+		if prv, err = n.decidedShare(d.Dealers, &p); err != nil {
+			n.logRound(slog.LevelWarn, "no key share of the next epoch, following it without one", "epoch", d.Epoch, "err", err)
+		}
+	}
+	return &KeyEpoch{
+		Number:        d.Epoch,
+		EnabledHeight: boundary,
+		PrivateKey:    prv,
+		GlobalPubKey:  global,
+		PublicKeys:    pubs,
+		Scaler:        1, // there is no tpke scaler, shares are combined in lagrange.go
+		Threshold:     len(cs) - 1,
+	}, nil
+}
+
+// decidedShare sums the shares of this node dealt by the decided dealers
+func (n *Node) decidedShare(dealers []uint16, pub *bls.G1Affine) (*tpke.PrivateKey, error) {
+	share := new(fr.Element)
+	for _, i := range dealers {
+		d, ok := n.keyDeals[i]
+		if !ok || d.share == nil {
+			return nil, fmt.Errorf("no valid share of dealer %d", i)
+		}
+		share.Add(share, d.share)
+	}
+	return tpkePrivateKey(share, pub)
+}
@@ -0,0 +1,330 @@
+package dbft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/tpke"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keystoreVersion = 1
+
+	// scrypt parameters, the light ones are for tests and local networks
+	StandardScryptN = 1 << 18
+	StandardScryptP = 1
+	LightScryptN    = 1 << 12
+	LightScryptP    = 6
+
+	scryptR     = 8
+	scryptDKLen = 32
+)
+
+var ErrDecrypt = errors.New("could not decrypt key with given password")
+
+// KeyBundle is the key material a validator gets from the DKG.
+type KeyBundle struct {
+	Index            byte
+	PrivateKey       *tpke.PrivateKey
+	GlobalPubKey     *tpke.PublicKey
+	Scaler           int
+	KeyEnabledHeight uint64
+}
+
+// keystoreJSON is the file format, the private key is sealed with AES-GCM
+// under a scrypt derived key and the public fields are authenticated with it.
+type keystoreJSON struct {
+	Version int                `json:"version"`
+	Public  keystorePublicJSON `json:"public"`
+	Crypto  keystoreCryptoJSON `json:"crypto"`
+}
+
+type keystorePublicJSON struct {
+	Index            byte   `json:"index"`
+	GlobalPubKey     string `json:"globalPubKey"`
+	Scaler           int    `json:"scaler"`
+	KeyEnabledHeight uint64 `json:"keyEnabledHeight"`
+}
+
+// signerKeystoreJSON is the file format of a message signing key, it is kept
+// in its own file so it can be rotated without a new DKG.
+type signerKeystoreJSON struct {
+	Version int                `json:"version"`
+	Public  signerPublicJSON   `json:"public"`
+	Crypto  keystoreCryptoJSON `json:"crypto"`
+}
+
+type signerPublicJSON struct {
+	Index   byte           `json:"index"`
+	Address common.Address `json:"address"`
+}
+
+type keystoreCryptoJSON struct {
+	Cipher     string           `json:"cipher"`
+	CipherText string           `json:"ciphertext"`
+	Nonce      string           `json:"nonce"`
+	KDF        string           `json:"kdf"`
+	KDFParams  scryptParamsJSON `json:"kdfparams"`
+}
+
+type scryptParamsJSON struct {
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	DKLen int    `json:"dklen"`
+	Salt  string `json:"salt"`
+}
+
+// EncryptKey seals the key bundle with the password into the keystore format
+func EncryptKey(b *KeyBundle, password string, scryptN, scryptP int) ([]byte, error) {
+	if b.PrivateKey == nil || b.GlobalPubKey == nil {
+		return nil, errors.New("incomplete key bundle")
+	}
+	public := keystorePublicJSON{
+		Index:            b.Index,
+		GlobalPubKey:     hex.EncodeToString(b.GlobalPubKey.ToBytes()),
+		Scaler:           b.Scaler,
+		KeyEnabledHeight: b.KeyEnabledHeight,
+	}
+	c, err := seal(b.PrivateKey.ToBytes(), public, password, scryptN, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(keystoreJSON{
+		Version: keystoreVersion,
+		Public:  public,
+		Crypto:  c,
+	}, "", "  ")
+}
+
+// DecryptKey opens a keystore with the password
+func DecryptKey(data []byte, password string) (*KeyBundle, error) {
+	var k keystoreJSON
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	if k.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", k.Version)
+	}
+	plain, err := open(k.Crypto, k.Public, password)
+	if err != nil {
+		return nil, err
+	}
+
+	prv, err := tpke.BytesToPrivateKey(plain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	pub, err := hex.DecodeString(k.Public.GlobalPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global public key: %w", err)
+	}
+	globalPub, err := tpke.BytesToPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid global public key: %w", err)
+	}
+	return &KeyBundle{
+		Index:            k.Public.Index,
+		PrivateKey:       prv,
+		GlobalPubKey:     globalPub,
+		Scaler:           k.Public.Scaler,
+		KeyEnabledHeight: k.Public.KeyEnabledHeight,
+	}, nil
+}
+
+// EncryptSigningKey seals the message signing key of a validator
+func EncryptSigningKey(index byte, key *ecdsa.PrivateKey, password string, scryptN, scryptP int) ([]byte, error) {
+	public := signerPublicJSON{
+		Index:   index,
+		Address: crypto.PubkeyToAddress(key.PublicKey),
+	}
+	c, err := seal(crypto.FromECDSA(key), public, password, scryptN, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(signerKeystoreJSON{
+		Version: keystoreVersion,
+		Public:  public,
+		Crypto:  c,
+	}, "", "  ")
+}
+
+// DecryptSigningKey opens a signing key keystore with the password
+func DecryptSigningKey(data []byte, password string) (byte, *ecdsa.PrivateKey, error) {
+	var k signerKeystoreJSON
+	if err := json.Unmarshal(data, &k); err != nil {
+		return 0, nil, err
+	}
+	if k.Version != keystoreVersion {
+		return 0, nil, fmt.Errorf("unsupported keystore version %d", k.Version)
+	}
+	plain, err := open(k.Crypto, k.Public, password)
+	if err != nil {
+		return 0, nil, err
+	}
+	key, err := crypto.ToECDSA(plain)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	if crypto.PubkeyToAddress(key.PublicKey) != k.Public.Address {
+		return 0, nil, errors.New("signing key doesn't match the address")
+	}
+	return k.Public.Index, key, nil
+}
+
+// SaveKeystore writes the sealed key bundle to a file readable by the owner only
+func SaveKeystore(path string, b *KeyBundle, password string) error {
+	data, err := EncryptKey(b, password, StandardScryptN, StandardScryptP)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, data)
+}
+
+// LoadKeystore reads a key bundle from a keystore file
+func LoadKeystore(path, password string) (*KeyBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptKey(data, password)
+}
+
+// SaveSigningKey writes the sealed signing key to a file readable by the owner only
+func SaveSigningKey(path string, index byte, key *ecdsa.PrivateKey, password string) error {
+	data, err := EncryptSigningKey(index, key, password, StandardScryptN, StandardScryptP)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, data)
+}
+
+// LoadSigningKey reads a signing key from a keystore file
+func LoadSigningKey(path, password string) (byte, *ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	return DecryptSigningKey(data, password)
+}
+
+// set up a node with the key share and the signing key in keystore files,
+// each opened with its own password
+func NewNodeFromKeystore(keyPath, signerPath, keyPassword, signerPassword string) (*Node, error) {
+	b, err := LoadKeystore(keyPath, keyPassword)
+	if err != nil {
+		return nil, err
+	}
+	index, signer, err := LoadSigningKey(signerPath, signerPassword)
+	if err != nil {
+		return nil, err
+	}
+	if index != b.Index {
+		return nil, fmt.Errorf("signing key of validator %d for validator %d", index, b.Index)
+	}
+	return NewNode(b.Index, signer, b.PrivateKey, b.PrivateKey.GetPublicKey(), b.GlobalPubKey, b.KeyEnabledHeight, b.Scaler), nil
+}
+
+// seal encrypts a secret under a password derived key, the public fields are
+// authenticated as additional data
+func seal(secret []byte, public any, password string, scryptN, scryptP int) (keystoreCryptoJSON, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return keystoreCryptoJSON{}, err
+	}
+	key, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, scryptDKLen)
+	if err != nil {
+		return keystoreCryptoJSON{}, err
+	}
+	aad, err := json.Marshal(public)
+	if err != nil {
+		return keystoreCryptoJSON{}, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return keystoreCryptoJSON{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keystoreCryptoJSON{}, err
+	}
+	return keystoreCryptoJSON{
+		Cipher:     "aes-256-gcm",
+		CipherText: hex.EncodeToString(gcm.Seal(nil, nonce, secret, aad)),
+		Nonce:      hex.EncodeToString(nonce),
+		KDF:        "scrypt",
+		KDFParams: scryptParamsJSON{
+			N:     scryptN,
+			R:     scryptR,
+			P:     scryptP,
+			DKLen: scryptDKLen,
+			Salt:  hex.EncodeToString(salt),
+		},
+	}, nil
+}
+
+// open decrypts a sealed secret and checks the public fields
+func open(c keystoreCryptoJSON, public any, password string) ([]byte, error) {
+	if c.Cipher != "aes-256-gcm" || c.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported cipher %s with kdf %s", c.Cipher, c.KDF)
+	}
+	params := c.KDFParams
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+	ct, err := hex.DecodeString(c.CipherText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	key, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, params.DKLen)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	aad, err := json.Marshal(public)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeKeyFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
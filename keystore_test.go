@@ -0,0 +1,102 @@
+package dbft
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/tpke"
+)
+
+func TestKeystore(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+
+	bundle := &KeyBundle{
+		Index:            3,
+		PrivateKey:       prvs[3],
+		GlobalPubKey:     globalpub,
+		Scaler:           dkg.GetScaler(),
+		KeyEnabledHeight: 10,
+	}
+	data, err := EncryptKey(bundle, "secret", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if bytes.Contains(data, []byte(`"privateKey"`)) {
+		t.Fatalf("private key is stored in plain")
+	}
+
+	// wrong password
+	_, err = DecryptKey(data, "wrong")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected decryption failure, got %v", err)
+	}
+
+	// tampered public fields are detected
+	tampered := bytes.Replace(data, []byte(`"keyEnabledHeight": 10`), []byte(`"keyEnabledHeight": 11`), 1)
+	_, err = DecryptKey(tampered, "secret")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected decryption failure, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys", "validator3.json")
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	loaded, err := LoadKeystore(path, "secret")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if loaded.Index != 3 || loaded.Scaler != bundle.Scaler || loaded.KeyEnabledHeight != 10 {
+		t.Fatalf("invalid key bundle")
+	}
+	if !bytes.Equal(loaded.PrivateKey.ToBytes(), prvs[3].ToBytes()) ||
+		!bytes.Equal(loaded.GlobalPubKey.ToBytes(), globalpub.ToBytes()) {
+		t.Fatalf("invalid keys")
+	}
+
+	// the signing key is kept in its own keystore
+	signer, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	data, err = EncryptSigningKey(3, signer, "secret", LightScryptN, LightScryptP)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	signerPath := filepath.Join(filepath.Dir(path), "signer3.json")
+	err = os.WriteFile(signerPath, data, 0600)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	index, key, err := LoadSigningKey(signerPath, "secret")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if index != 3 || !key.Equal(signer) {
+		t.Fatalf("invalid signing key")
+	}
+
+	node, err := NewNodeFromKeystore(path, signerPath, "secret", "secret")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if node.GetIndex() != 3 || !node.validator || !node.GetSigningKey().Equal(&signer.PublicKey) {
+		t.Fatalf("invalid node")
+	}
+}
@@ -0,0 +1,252 @@
+package dbft
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/txhsl/tpke"
+)
+
+// The integer scaler of tpke overflows once the network has more than 8
+// validators. Shares are combined here with big integer Lagrange coefficients
+// over the scalar field instead, the combined share is the value of the
+// polynomial at 0 and is handed to tpke as the only share of a degree 0
+// polynomial, so tpke still does the decryption and the verification.
+
+var ErrNotEnoughShares = errors.New("not enough shares")
+
+// combinedIndex is the index the combined share is given to tpke with, the
+// Lagrange coefficient of a single share is always 1
+const combinedIndex = 1
+
+// coefficients caches the Lagrange coefficients per quorum subset
+var coefficients sync.Map
+
+// quorumSubset picks the lowest size indexes of the shares
+func quorumSubset[T any](shares map[int]T, size int) ([]int, error) {
+	if size <= 0 || len(shares) < size {
+		return nil, ErrNotEnoughShares
+	}
+	indexes := make([]int, 0, len(shares))
+	for i := range shares {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes[:size], nil
+}
+
+// consistentShares picks the decryption shares of at least size validators
+// agreeing with each other, for a node without a key share of its own to check
+// them against. With the key proofs checked on receipt, the shares D_i and D_j
+// of validators i and j agree if e(D_i, s_j*H) == e(D_j, s_i*H). A wrong share
+// doesn't agree with the shares of the honest validators, which are more than
+// the faulty ones.
+func consistentShares(inputs map[int][]*tpke.DecryptionShare, proofs map[int]*tpke.SignatureShare, size int) (map[int][]*tpke.DecryptionShare, error) {
+	indexes := make([]int, 0, len(inputs))
+	for i := range inputs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		agreeing := map[int][]*tpke.DecryptionShare{i: inputs[i]}
+		for _, j := range indexes {
+			if j != i && verifyDecryptionShares(inputs[j], inputs[i], proofs[j], proofs[i]) == nil {
+				agreeing[j] = inputs[j]
+			}
+		}
+		if len(agreeing) >= size {
+			return agreeing, nil
+		}
+	}
+	return nil, ErrNotEnoughShares
+}
+
+// lagrangeCoefficients computes the coefficients at 0 for the sorted indexes
+func lagrangeCoefficients(indexes []int) []*big.Int {
+	keys := make([]string, len(indexes))
+	for i, v := range indexes {
+		keys[i] = strconv.Itoa(v)
+	}
+	key := strings.Join(keys, ",")
+	if v, ok := coefficients.Load(key); ok {
+		return v.([]*big.Int)
+	}
+
+	xs := make([]fr.Element, len(indexes))
+	for i, v := range indexes {
+		xs[i].SetUint64(uint64(v))
+	}
+	res := make([]*big.Int, len(indexes))
+	for i := range xs {
+		var num, den, diff fr.Element
+		num.SetOne()
+		den.SetOne()
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// l_i(0) = prod (0 - x_j) / (x_i - x_j)
+			num.Mul(&num, &xs[j])
+			diff.Sub(&xs[j], &xs[i])
+			den.Mul(&den, &diff)
+		}
+		den.Inverse(&den)
+		num.Mul(&num, &den)
+		res[i] = num.BigInt(new(big.Int))
+	}
+	coefficients.Store(key, res)
+	return res
+}
+
+// combineG1 interpolates compressed G1 shares at 0
+func combineG1(indexes []int, shares [][]byte) ([]byte, error) {
+	ls := lagrangeCoefficients(indexes)
+	var acc bls.G1Jac
+	for i, b := range shares {
+		var p bls.G1Affine
+		if _, err := p.SetBytes(b); err != nil {
+			return nil, fmt.Errorf("share of validator %d: %w", indexes[i], err)
+		}
+		var t bls.G1Jac
+		t.ScalarMultiplicationAffine(&p, ls[i])
+		acc.AddAssign(&t)
+	}
+	var res bls.G1Affine
+	res.FromJacobian(&acc)
+	b := res.Bytes()
+	return b[:], nil
+}
+
+// combineG2 interpolates compressed G2 shares at 0
+func combineG2(indexes []int, shares [][]byte) ([]byte, error) {
+	ls := lagrangeCoefficients(indexes)
+	var acc bls.G2Jac
+	for i, b := range shares {
+		var p bls.G2Affine
+		if _, err := p.SetBytes(b); err != nil {
+			return nil, fmt.Errorf("share of validator %d: %w", indexes[i], err)
+		}
+		var t bls.G2Jac
+		t.FromAffine(&p)
+		t.ScalarMultiplication(&t, ls[i])
+		acc.AddAssign(&t)
+	}
+	var res bls.G2Affine
+	res.FromJacobian(&acc)
+	b := res.Bytes()
+	return b[:], nil
+}
+
+// decryptSeeds recovers the seeds of the cipher texts from the decryption
+// shares of at least threshold+1 validators
+func decryptSeeds(cs []*tpke.CipherText, inputs map[int][]*tpke.DecryptionShare, pub *tpke.PublicKey, threshold int) ([]*tpke.PointG1, error) {
+	indexes, err := quorumSubset(inputs, threshold+1)
+	if err != nil {
+		return nil, err
+	}
+	combined := make([]*tpke.DecryptionShare, len(cs))
+	for j := range cs {
+		shares := make([][]byte, len(indexes))
+		for i, v := range indexes {
+			if len(inputs[v]) != len(cs) {
+				return nil, fmt.Errorf("validator %d: %w", v, ErrNotEnoughShares)
+			}
+			shares[i] = inputs[v][j].ToBytes()
+		}
+		b, err := combineG1(indexes, shares)
+		if err != nil {
+			return nil, err
+		}
+		combined[j], err = tpke.BytesToDecryptionShare(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tpke.Decrypt(cs, map[int][]*tpke.DecryptionShare{combinedIndex: combined}, pub, 0, 1)
+}
+
+// aggregateSignature builds the threshold signature from the signature shares
+// of at least quorum validators and verifies it against the global public key
+func aggregateSignature(pub *tpke.PublicKey, msg []byte, quorum int, inputs map[int]*tpke.SignatureShare) (*tpke.Signature, error) {
+	indexes, err := quorumSubset(inputs, quorum)
+	if err != nil {
+		return nil, err
+	}
+	shares := make([][]byte, len(indexes))
+	for i, v := range indexes {
+		shares[i] = inputs[v].ToBytes()
+	}
+	b, err := combineG2(indexes, shares)
+	if err != nil {
+		return nil, err
+	}
+	combined, err := tpke.BytesToSigShare(b)
+	if err != nil {
+		return nil, err
+	}
+	return tpke.AggregateAndVerifySig(pub, msg, 1, map[int]*tpke.SignatureShare{combinedIndex: combined}, 1)
+}
+
+// keyProofMessage is signed with a key share to get the share in G2. With the
+// key proofs s_i*H of a peer and s*H of this node, a decryption share
+// D_i = s_i*U of the peer is checked against the share D = s*U of this node
+// for the same cipher text by e(D_i, s*H) == e(D, s_i*H).
+var keyProofMessage = []byte("dbft-anti-mev decryption key proof")
+
+// verifyDecryptionShares checks the decryption shares of a peer against the
+// shares of this node for the same cipher texts. The shares are weighted at
+// random and summed up, so a single pairing check covers all of them.
+func verifyDecryptionShares(shares, own []*tpke.DecryptionShare, proof, ownProof *tpke.SignatureShare) error {
+	if len(shares) != len(own) {
+		return fmt.Errorf("%d shares for %d cipher texts", len(shares), len(own))
+	}
+	if len(shares) == 0 {
+		return nil
+	}
+	var peerSum, ownSum bls.G1Jac
+	for j := range shares {
+		var a, b bls.G1Affine
+		if _, err := a.SetBytes(shares[j].ToBytes()); err != nil {
+			return fmt.Errorf("share %d: %w", j, err)
+		}
+		if _, err := b.SetBytes(own[j].ToBytes()); err != nil {
+			return fmt.Errorf("own share %d: %w", j, err)
+		}
+		var w fr.Element
+		if _, err := w.SetRandom(); err != nil {
+			return err
+		}
+		weight := w.BigInt(new(big.Int))
+		var t bls.G1Jac
+		t.ScalarMultiplicationAffine(&a, weight)
+		peerSum.AddAssign(&t)
+		t.ScalarMultiplicationAffine(&b, weight)
+		ownSum.AddAssign(&t)
+	}
+	var p, q bls.G1Affine
+	p.FromJacobian(&peerSum)
+	q.FromJacobian(&ownSum)
+	q.Neg(&q)
+	var x, y bls.G2Affine
+	if _, err := x.SetBytes(ownProof.ToBytes()); err != nil {
+		return fmt.Errorf("own key proof: %w", err)
+	}
+	if _, err := y.SetBytes(proof.ToBytes()); err != nil {
+		return fmt.Errorf("key proof: %w", err)
+	}
+	ok, err := bls.PairingCheck([]bls.G1Affine{p, q}, []bls.G2Affine{x, y})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid decryption shares")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package dbft
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"github.com/txhsl/tpke"
+)
+
+func TestLagrangeCoefficients(t *testing.T) {
+	// f(x) = 5 + 3x + 7x^2, any 3 points recover f(0)
+	f := func(x int) *big.Int {
+		v := big.NewInt(int64(7 * x * x))
+		v.Add(v, big.NewInt(int64(3*x+5)))
+		return v
+	}
+	for _, indexes := range [][]int{{1, 2, 3}, {2, 5, 31}, {7, 19, 21}} {
+		ls := lagrangeCoefficients(indexes)
+		sum := new(big.Int)
+		for i, v := range indexes {
+			sum.Add(sum, new(big.Int).Mul(ls[i], f(v)))
+		}
+		sum.Mod(sum, fr.Modulus())
+		if sum.Cmp(big.NewInt(5)) != 0 {
+			t.Fatalf("wrong interpolation for %v: %s", indexes, sum)
+		}
+	}
+}
+
+// the integer scaler of tpke overflows beyond 8 validators
+func TestLargeNetwork(t *testing.T) {
+	for _, size := range []int{21, 31} {
+		dkg := tpke.NewDKG(size, quorumOf(size)-1)
+		dkg.Prepare()
+		err := dkg.Verify()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		prvs := dkg.GetPrivateKeys()
+		globalpub := dkg.PublishGlobalPublicKey()
+		signers := newSigners(size)
+
+		nodes := make([]*Node, size)
+		for i := 0; i < size; i++ {
+			nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		}
+		for i := 0; i < size; i++ {
+			nodes[i].Connect(nodes)
+		}
+
+		// send an enveloped tx
+		tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		buf := new(bytes.Buffer)
+		err = tx.EncodeRLP(buf)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		seed := tpke.RandPG1()
+		et, err := tpke.AESEncrypt(seed, buf.Bytes())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		envelope := &transaction.Envelope{
+			EncryptHeight:        0,
+			EncryptedSeed:        globalpub.Encrypt(seed),
+			EncryptedTransaction: et,
+		}
+		carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+		for i := 0; i < size; i++ {
+			nodes[i].PendEnvelopedTx(carrier)
+		}
+
+		nodes[0].Propose()
+		deliver(nodes, nil)
+
+		block := nodes[0].blocks[1]
+		if block == nil {
+			t.Fatalf("no block with %d validators", size)
+		}
+		// the final tx hash covers the carrier and the decrypted tx
+		final := types.DeriveSha(types.Transactions{carrier, tx}, trie.NewStackTrie(nil))
+		if block.Header.TxHash != final {
+			t.Fatalf("envelope not decrypted with %d validators", size)
+		}
+		if len(block.Transactions) != 2 || block.CarrierNum != 1 || len(block.Links) != 1 || block.Links[0] != (CarrierLink{Carrier: 0, Inner: 1}) {
+			t.Fatalf("invalid carrier links with %d validators", size)
+		}
+		r, err := nodes[size-1].GetEnvelopeStatus(carrier.Hash())
+		if err != nil || r.Status != EnvelopeIncluded || r.Height != 1 || *r.Inner != tx.Hash() {
+			t.Fatalf("invalid envelope status with %d validators", size)
+		}
+		for i := 1; i < size; i++ {
+			if nodes[i].height < 1 || nodes[i].blocks[1].Hash().CompareTo(block.Hash()) != 0 {
+				t.Fatalf("invalid block on node %d of %d", i+1, size)
+			}
+		}
+	}
+}
+
+func TestCorruptedDecryptionShare(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(8)
+
+	// 7 validators and an observer
+	nodes := make([]*Node, 8)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	nodes[7] = NewObserver(8, signers[8], globalpub, 0, dkg.GetScaler())
+	for i := 0; i < 8; i++ {
+		nodes[i].Connect(nodes)
+	}
+
+	// send an enveloped tx
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	buf := new(bytes.Buffer)
+	if err := tx.EncodeRLP(buf); err != nil {
+		t.Fatalf(err.Error())
+	}
+	seed := tpke.RandPG1()
+	et, err := tpke.AESEncrypt(seed, buf.Bytes())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	envelope := &transaction.Envelope{
+		EncryptHeight:        0,
+		EncryptedSeed:        globalpub.Encrypt(seed),
+		EncryptedTransaction: et,
+	}
+	carrier := types.NewTransaction(0, ZeroAddress, envelope.ComputeFee(), 0, big.NewInt(0), envelope.ToBytes())
+	for i := 0; i < 8; i++ {
+		nodes[i].PendEnvelopedTx(carrier)
+	}
+
+	// validator 3 sends a valid point instead of its decryption share
+	_, _, g1, _ := bls.Generators()
+	corrupted := g1.Bytes()
+	nodes[0].Propose()
+	deliver(nodes, func(m *message.Payload) bool {
+		if m.Type() == message.FinalizeType && m.ValidatorIndex() == 3 {
+			f := m.Payload().(message.Finalize)
+			if !bytes.Equal(f.DecryptShare[0], corrupted[:]) {
+				f.DecryptShare = [][]byte{corrupted[:]}
+				m.SetPayload(f)
+				m.Sign(signers[3])
+			}
+		}
+		return false
+	})
+
+	// the share is rejected and the others decrypt the envelope, the observer
+	// leaves it out since it doesn't agree with the other shares
+	for i := 0; i < 8; i++ {
+		if i == 2 {
+			continue
+		}
+		if i != 7 && nodes[i].InvalidMessages(3) != 1 {
+			t.Fatalf("corrupted share not rejected by node %d", i+1)
+		}
+		block := nodes[i].blocks[1]
+		if block == nil || len(block.Links) != 1 || block.Transactions[block.Links[0].Inner].Hash() != tx.Hash() {
+			t.Fatalf("envelope not decrypted by node %d", i+1)
+		}
+	}
+}
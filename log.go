@@ -0,0 +1,45 @@
+package dbft
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// discardHandler drops all records, nodes log nothing until a logger is set
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// set the logger of the node, records carry the node index
+func (n *Node) SetLogger(l *slog.Logger) {
+	n.logger = l.With("node", n.index)
+}
+
+// logRound logs with the height and view of the current round
+func (n *Node) logRound(level slog.Level, msg string, args ...any) {
+	if !n.logger.Enabled(context.Background(), level) {
+		return
+	}
+	args = append([]any{"height", n.height + 1, "view", n.view}, args...)
+	n.logger.Log(context.Background(), level, msg, args...)
+}
+
+// logMsg logs a decision on a message with the round of this node and the
+// sender, type and round of the message
+func (n *Node) logMsg(level slog.Level, msg string, m *message.Payload, args ...any) {
+	if !n.logger.Enabled(context.Background(), level) {
+		return
+	}
+	args = append([]any{
+		"validator", m.ValidatorIndex(),
+		"type", message.TypeName(m.Type()),
+		"msgHeight", m.BlockIndex,
+		"msgView", m.ViewNumber(),
+	}, args...)
+	n.logRound(level, msg, args...)
+}
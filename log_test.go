@@ -0,0 +1,42 @@
+package dbft
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+func TestLogger(t *testing.T) {
+	n := NewObserver(1, nil, nil, 0, 0)
+	// nothing is logged by default
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           message.FinalizeType,
+			ValidatorIndex: 5,
+			BlockIndex:     1,
+		},
+	}
+	msg.SetPayload(message.Finalize{})
+	n.HandleMsg(msg)
+
+	var buf bytes.Buffer
+	n.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	n.HandleMsg(msg)
+	out := buf.String()
+	for _, s := range []string{"dropped message from unknown sender", "node=1", "height=1", "view=0", "validator=5", "type=Finalize", "msgHeight=1"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("%q not logged in %q", s, out)
+		}
+	}
+
+	// debug records are filtered out at info level
+	buf.Reset()
+	n.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	n.HandleMsg(msg)
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
@@ -0,0 +1,183 @@
+package dbft
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// Metrics instruments the consensus of a node, a nil Metrics records nothing.
+type Metrics struct {
+	height           prometheus.Gauge
+	view             prometheus.Gauge
+	phaseDuration    *prometheus.HistogramVec // by phase: prepare, finalize, commit
+	viewChanges      *prometheus.CounterVec   // by reason
+	poolSize         *prometheus.GaugeVec     // by pool: legacy, envelope
+	shareFailures    prometheus.Counter
+	envelopeFailures prometheus.Counter
+	messages         *prometheus.CounterVec // by type and direction: in, out
+	invalidMessages  *prometheus.CounterVec // by validator
+	staleMessages    prometheus.Counter
+	unknownSenders   prometheus.Counter
+
+	phaseStart time.Time // the beginning of the current phase, zero if no round is running
+}
+
+// NewMetrics creates the collectors and registers them
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		height: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dbft",
+			Name:      "height",
+			Help:      "The height of the latest committed block.",
+		}),
+		view: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "dbft",
+			Name:      "view",
+			Help:      "The view number of the current round.",
+		}),
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dbft",
+			Name:      "phase_duration_seconds",
+			Help:      "The time from the proposal to the prepare quorum, to the decryption and to the commit.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"phase"}),
+		viewChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "view_changes_total",
+			Help:      "The number of view changes by the reason of the last vote.",
+		}, []string{"reason"}),
+		poolSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "dbft",
+			Name:      "pool_size",
+			Help:      "The number of transactions in the legacy and envelope pools.",
+		}, []string{"pool"}),
+		shareFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "decryption_share_failures_total",
+			Help:      "The number of finalize messages rejected for decryption shares failing verification.",
+		}),
+		envelopeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "envelope_decryption_failures_total",
+			Help:      "The number of envelopes failed to decrypt or decode.",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "messages_total",
+			Help:      "The number of consensus messages by type and direction.",
+		}, []string{"type", "direction"}),
+		invalidMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "invalid_messages_total",
+			Help:      "The number of malformed messages rejected by the validator sending them.",
+		}, []string{"validator"}),
+		staleMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "stale_messages_total",
+			Help:      "The number of messages dropped for past heights, views or key epochs.",
+		}),
+		unknownSenders: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dbft",
+			Name:      "unknown_sender_messages_total",
+			Help:      "The number of messages dropped for coming from outside of the validator set.",
+		}),
+	}
+	reg.MustRegister(m.height, m.view, m.phaseDuration, m.viewChanges, m.poolSize,
+		m.shareFailures, m.envelopeFailures, m.messages, m.invalidMessages, m.staleMessages, m.unknownSenders)
+	return m
+}
+
+// instrument the node with metrics
+func (n *Node) SetMetrics(m *Metrics) {
+	n.metrics = m
+	n.metrics.setRound(n.height, n.view)
+	n.metrics.setPools(len(n.legacyPool), len(n.envelopePool))
+}
+
+func (m *Metrics) setRound(height uint64, view byte) {
+	if m == nil {
+		return
+	}
+	m.height.Set(float64(height))
+	m.view.Set(float64(view))
+}
+
+func (m *Metrics) setPools(legacy, envelopes int) {
+	if m == nil {
+		return
+	}
+	m.poolSize.WithLabelValues("legacy").Set(float64(legacy))
+	m.poolSize.WithLabelValues("envelope").Set(float64(envelopes))
+}
+
+// startRound begins the prepare phase on a proposal
+func (m *Metrics) startRound() {
+	if m == nil {
+		return
+	}
+	m.phaseStart = time.Now()
+}
+
+// endPhase records a phase and begins the next one
+func (m *Metrics) endPhase(phase string) {
+	if m == nil || m.phaseStart.IsZero() {
+		return
+	}
+	now := time.Now()
+	m.phaseDuration.WithLabelValues(phase).Observe(now.Sub(m.phaseStart).Seconds())
+	m.phaseStart = now
+}
+
+func (m *Metrics) viewChanged(reason payload.ChangeViewReason) {
+	if m == nil {
+		return
+	}
+	m.viewChanges.WithLabelValues(reason.String()).Inc()
+	m.phaseStart = time.Time{}
+}
+
+func (m *Metrics) shareFailed() {
+	if m == nil {
+		return
+	}
+	m.shareFailures.Inc()
+}
+
+func (m *Metrics) envelopeFailed() {
+	if m == nil {
+		return
+	}
+	m.envelopeFailures.Inc()
+}
+
+func (m *Metrics) message(t payload.MessageType, direction string) {
+	if m == nil {
+		return
+	}
+	m.messages.WithLabelValues(message.TypeName(t), direction).Inc()
+}
+
+func (m *Metrics) invalidMessage(validator uint16) {
+	if m == nil {
+		return
+	}
+	m.invalidMessages.WithLabelValues(strconv.Itoa(int(validator))).Inc()
+}
+
+func (m *Metrics) staleMessage(count int) {
+	if m == nil {
+		return
+	}
+	m.staleMessages.Add(float64(count))
+}
+
+func (m *Metrics) unknownSender() {
+	if m == nil {
+		return
+	}
+	m.unknownSenders.Inc()
+}
@@ -0,0 +1,62 @@
+package dbft
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	n := NewObserver(1, nil, nil, 0, 0)
+	n.SetMetrics(m)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.EventLoop(ctx)
+	for i := 0; i < 2; i++ {
+		tx := types.NewTransaction(uint64(i), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		if err := n.SubmitTx(ctx, tx); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// a message from an unknown sender is still counted
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           message.FinalizeType,
+			ValidatorIndex: 5,
+			BlockIndex:     1,
+		},
+	}
+	msg.SetPayload(message.Finalize{})
+	n.GetHandler() <- msg
+	// the loop has handled the message once a call after it returns
+	for len(n.messageHandler) > 0 {
+		n.Call(ctx, func() {})
+	}
+	if err := n.Call(ctx, func() {}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if v := testutil.ToFloat64(m.poolSize.WithLabelValues("legacy")); v != 2 {
+		t.Fatalf("unexpected legacy pool size %v", v)
+	}
+	if v := testutil.ToFloat64(m.messages.WithLabelValues("Finalize", "in")); v != 1 {
+		t.Fatalf("unexpected message count %v", v)
+	}
+	if v := testutil.ToFloat64(m.unknownSenders); v != 1 {
+		t.Fatalf("unexpected unknown sender count %v", v)
+	}
+	if v := testutil.ToFloat64(m.height); v != 0 {
+		t.Fatalf("unexpected height %v", v)
+	}
+	if n, err := testutil.GatherAndCount(reg); err != nil || n == 0 {
+		t.Fatalf("no metrics gathered: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package dbft
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+// NetworkConfig is the public outcome of a DKG ceremony shared by all nodes.
+type NetworkConfig struct {
+	GlobalPubKey     string             `json:"globalPubKey"`
+	Threshold        int                `json:"threshold"`
+	Scaler           int                `json:"scaler"`
+	KeyEnabledHeight uint64             `json:"keyEnabledHeight"`
+	Validators       []ValidatorKeyJSON `json:"validators"`
+}
+
+// ValidatorKeyJSON is the public key share and the message signing key of a
+// validator.
+type ValidatorKeyJSON struct {
+	Index      byte   `json:"index"`
+	PublicKey  string `json:"publicKey"`
+	SigningKey string `json:"signingKey"`
+}
+
+// KeyThreshold returns the threshold the keys of a network of the given size
+// are generated with, any quorum of validators can decrypt and sign
+func KeyThreshold(size int) int {
+	return quorumOf(size) - 1
+}
+
+// NewNetworkConfig describes the keys generated by a DKG
+func NewNetworkConfig(globalPub *tpke.PublicKey, pubs ValidatorSet, signers SignerSet, threshold, scaler int, keyEnabledHeight uint64) *NetworkConfig {
+	c := &NetworkConfig{
+		GlobalPubKey:     hex.EncodeToString(globalPub.ToBytes()),
+		Threshold:        threshold,
+		Scaler:           scaler,
+		KeyEnabledHeight: keyEnabledHeight,
+		Validators:       make([]ValidatorKeyJSON, 0, len(pubs)),
+	}
+	for _, i := range sortedIndexes(pubs) {
+		v := ValidatorKeyJSON{
+			Index:     byte(i),
+			PublicKey: hex.EncodeToString(pubs[i].ToBytes()),
+		}
+		if signers[i] != nil {
+			v.SigningKey = hex.EncodeToString(crypto.CompressPubkey(signers[i]))
+		}
+		c.Validators = append(c.Validators, v)
+	}
+	return c
+}
+
+// Keys decodes the global public key and the validator set
+func (c *NetworkConfig) Keys() (*tpke.PublicKey, ValidatorSet, error) {
+	b, err := hex.DecodeString(c.GlobalPubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid global public key: %w", err)
+	}
+	globalPub, err := tpke.BytesToPublicKey(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid global public key: %w", err)
+	}
+	pubs := make(ValidatorSet, len(c.Validators))
+	for _, v := range c.Validators {
+		if v.Index == 0 {
+			return nil, nil, errors.New("validator index starts from 1")
+		}
+		if _, ok := pubs[uint16(v.Index)]; ok {
+			return nil, nil, fmt.Errorf("duplicated validator %d", v.Index)
+		}
+		b, err := hex.DecodeString(v.PublicKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid public key of validator %d: %w", v.Index, err)
+		}
+		pub, err := tpke.BytesToPublicKey(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid public key of validator %d: %w", v.Index, err)
+		}
+		pubs[uint16(v.Index)] = pub
+	}
+	if c.Threshold != KeyThreshold(len(pubs)) {
+		return nil, nil, fmt.Errorf("threshold %d does not match %d validators", c.Threshold, len(pubs))
+	}
+	return globalPub, pubs, nil
+}
+
+// Signers decodes the message signing keys of the validators
+func (c *NetworkConfig) Signers() (SignerSet, error) {
+	signers := make(SignerSet, len(c.Validators))
+	for _, v := range c.Validators {
+		b, err := hex.DecodeString(v.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key of validator %d: %w", v.Index, err)
+		}
+		pub, err := crypto.DecompressPubkey(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key of validator %d: %w", v.Index, err)
+		}
+		signers[uint16(v.Index)] = pub
+	}
+	return signers, nil
+}
+
+// the file names written by SetupNetwork and FinishCeremony
+const NetworkConfigFile = "network.json"
+
+func KeystoreFile(index byte) string {
+	return fmt.Sprintf("validator%d.json", index)
+}
+
+func SignerKeystoreFile(index byte) string {
+	return fmt.Sprintf("signer%d.json", index)
+}
+
+// SetupNetwork runs a DKG for a new network of the given size as a trusted
+// dealer, and writes the keystores of every validator and the network config
+// into the directory, the keystores of validator i are sealed with
+// passwords[i-1]
+func SetupNetwork(dir string, size int, keyEnabledHeight uint64, passwords []string, scryptN, scryptP int) (*NetworkConfig, error) {
+	if size < 1 || size > message.MaxKeyDealSize {
+		return nil, fmt.Errorf("invalid number of validators %d", size)
+	}
+	if len(passwords) != size {
+		return nil, fmt.Errorf("%d passwords for %d validators", len(passwords), size)
+	}
+	// dkg index starts from 1
+	threshold := KeyThreshold(size)
+	dkg := tpke.NewDKG(size, threshold)
+	dkg.Prepare()
+	if err := dkg.Verify(); err != nil {
+		return nil, fmt.Errorf("dkg verification failed: %w", err)
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalPub := dkg.PublishGlobalPublicKey()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	pubs := make(ValidatorSet, size)
+	signers := make(SignerSet, size)
+	for i := 1; i <= size; i++ {
+		pubs[uint16(i)] = prvs[i].GetPublicKey()
+		signer, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		signers[uint16(i)] = &signer.PublicKey
+
+		data, err := EncryptKey(&KeyBundle{
+			Index:            byte(i),
+			PrivateKey:       prvs[i],
+			GlobalPubKey:     globalPub,
+			Scaler:           dkg.GetScaler(),
+			KeyEnabledHeight: keyEnabledHeight,
+		}, passwords[i-1], scryptN, scryptP)
+		if err != nil {
+			return nil, fmt.Errorf("validator %d: %w", i, err)
+		}
+		if err := writeKeyFile(filepath.Join(dir, KeystoreFile(byte(i))), data); err != nil {
+			return nil, err
+		}
+		data, err = EncryptSigningKey(byte(i), signer, passwords[i-1], scryptN, scryptP)
+		if err != nil {
+			return nil, fmt.Errorf("validator %d: %w", i, err)
+		}
+		if err := writeKeyFile(filepath.Join(dir, SignerKeystoreFile(byte(i))), data); err != nil {
+			return nil, err
+		}
+	}
+
+	c := NewNetworkConfig(globalPub, pubs, signers, threshold, dkg.GetScaler(), keyEnabledHeight)
+	if err := c.Save(filepath.Join(dir, NetworkConfigFile)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *NetworkConfig) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func LoadNetworkConfig(path string) (*NetworkConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(NetworkConfig)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,66 @@
+package dbft
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/txhsl/tpke"
+)
+
+func TestNetworkConfig(t *testing.T) {
+	dkg := tpke.NewDKG(7, KeyThreshold(7))
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+
+	signers := newSigners(7)
+	pubs := make(ValidatorSet)
+	signerPubs := make(SignerSet)
+	for i := 1; i <= 7; i++ {
+		pubs[uint16(i)] = prvs[i].GetPublicKey()
+		signerPubs[uint16(i)] = &signers[i].PublicKey
+	}
+	path := filepath.Join(t.TempDir(), "network.json")
+	err = NewNetworkConfig(globalpub, pubs, signerPubs, KeyThreshold(7), dkg.GetScaler(), 0).Save(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadNetworkConfig(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	gp, ps, err := c.Keys()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !bytes.Equal(gp.ToBytes(), globalpub.ToBytes()) || len(ps) != 7 {
+		t.Fatalf("invalid network keys")
+	}
+	for i, pub := range pubs {
+		if !bytes.Equal(ps[i].ToBytes(), pub.ToBytes()) {
+			t.Fatalf("invalid key of validator %d", i)
+		}
+	}
+
+	ss, err := c.Signers()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i, pub := range signerPubs {
+		if !ss[i].Equal(pub) {
+			t.Fatalf("invalid signing key of validator %d", i)
+		}
+	}
+
+	// the threshold should match the validator set
+	c.Threshold = 3
+	if _, _, err = c.Keys(); err == nil {
+		t.Fatalf("threshold mismatch is accepted")
+	}
+}
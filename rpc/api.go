@@ -0,0 +1,301 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	dbft "github.com/txhsl/dbft-anti-mev"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+)
+
+// RegisterEthAPI adds the Ethereum methods served by the node
+func RegisterEthAPI(s *Server, n *dbft.Node) {
+	s.Register("eth_sendRawTransaction", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var b hexutil.Bytes
+		if err := parseParams(params, &b); err != nil {
+			return nil, err
+		}
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(b); err != nil {
+			return nil, InvalidParams(err)
+		}
+		// carriers go to the envelope pool, anything else to the legacy pool
+		if err := n.SubmitTx(ctx, tx); err != nil {
+			return nil, txError(err)
+		}
+		return tx.Hash(), nil
+	})
+	s.Register("eth_subscribe", subscribe(n))
+	s.Register("eth_blockNumber", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var height uint64
+		if err := n.Call(ctx, func() { height = n.GetHeight() }); err != nil {
+			return nil, err
+		}
+		return hexutil.Uint64(height), nil
+	})
+	s.Register("eth_getBlockByNumber", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var (
+			number BlockNumber
+			fullTx bool
+		)
+		if err := parseParams(params, &number, &fullTx); err != nil {
+			return nil, err
+		}
+		b, height, err := blockByNumber(ctx, n, number)
+		if b == nil {
+			return nil, err
+		}
+		return newBlock(b, height, fullTx), nil
+	})
+	s.Register("eth_getBlockByHash", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var (
+			hash   common.Hash
+			fullTx bool
+		)
+		if err := parseParams(params, &hash, &fullTx); err != nil {
+			return nil, err
+		}
+		var (
+			b      *dbft.Block
+			height uint64
+			err    error
+		)
+		if err := n.Call(ctx, func() { b, height, err = n.GetBlockByHash(hash) }); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, dbft.ErrBlockNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newBlock(b, height, fullTx), nil
+	})
+	s.Register("eth_getTransactionByHash", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var hash common.Hash
+		if err := parseParams(params, &hash); err != nil {
+			return nil, err
+		}
+		var (
+			tx  *types.Transaction
+			b   *dbft.Block
+			loc dbft.TxLocation
+			err error
+		)
+		if err := n.Call(ctx, func() {
+			if tx, loc, err = n.GetTransaction(hash); err == nil {
+				b, err = n.GetBlock(loc.Height)
+			}
+		}); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, dbft.ErrTxNotFound) || errors.Is(err, dbft.ErrBlockNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newTransaction(tx, b, loc), nil
+	})
+}
+
+// ConsensusEvent is a notification of the consensus subscription.
+type ConsensusEvent struct {
+	Type  string     `json:"type"`
+	Event dbft.Event `json:"event"`
+}
+
+// the capacity of a subscription, events are dropped for slow subscribers
+const subscriptionBuffer = 256
+
+// subscribe streams the consensus events of the node over websocket
+func subscribe(n *dbft.Node) Method {
+	return func(ctx context.Context, params []json.RawMessage) (any, error) {
+		nt, ok := NotifierFromContext(ctx)
+		if !ok {
+			return nil, ErrNotificationsUnsupported
+		}
+		var kind string
+		if err := parseParams(params, &kind); err != nil {
+			return nil, err
+		}
+		if kind != "consensus" {
+			return nil, InvalidParams(fmt.Errorf("unknown subscription %q", kind))
+		}
+		sub := n.Subscribe(subscriptionBuffer)
+		return nt.Subscribe("eth", func(ctx context.Context, notify func(any) error) {
+			defer sub.Unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case e, ok := <-sub.C:
+					if !ok {
+						return
+					}
+					if err := notify(&ConsensusEvent{Type: e.EventName(), Event: e}); err != nil {
+						return
+					}
+				}
+			}
+		}), nil
+	}
+}
+
+// blockByNumber reads a block in the event loop, a missing block is nil
+// without an error
+func blockByNumber(ctx context.Context, n *dbft.Node, number BlockNumber) (*dbft.Block, uint64, error) {
+	var (
+		b      *dbft.Block
+		height uint64
+		err    error
+	)
+	if err := n.Call(ctx, func() {
+		height = number.height(n.GetHeight())
+		b, err = n.GetBlock(height)
+	}); err != nil {
+		return nil, 0, err
+	}
+	if errors.Is(err, dbft.ErrBlockNotFound) {
+		return nil, 0, nil
+	}
+	return b, height, err
+}
+
+// EncryptionKey is the key a wallet seals envelopes to.
+type EncryptionKey struct {
+	GlobalPubKey  hexutil.Bytes  `json:"globalPubKey"`
+	Epoch         hexutil.Uint64 `json:"epoch"`
+	EnabledHeight hexutil.Uint64 `json:"enabledHeight"` // the minimum encryption height
+	BlockNumber   hexutil.Uint64 `json:"blockNumber"`   // the latest committed block
+}
+
+// FeeParams is the rule envelope fees are checked with, the fee is the base
+// fee plus the byte fee per byte of the encrypted transaction.
+type FeeParams struct {
+	BaseFee *hexutil.Big `json:"baseFee"`
+	ByteFee *hexutil.Big `json:"byteFee"`
+}
+
+// RegisterAntiMEVAPI adds the methods wallets need to seal transactions
+func RegisterAntiMEVAPI(s *Server, n *dbft.Node) {
+	s.Register("antimev_getEncryptionKey", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var (
+			key    dbft.EncryptionKey
+			height uint64
+		)
+		if err := n.Call(ctx, func() {
+			key = n.EncryptionKey()
+			height = n.GetHeight()
+		}); err != nil {
+			return nil, err
+		}
+		return &EncryptionKey{
+			GlobalPubKey:  key.GlobalPubKey.ToBytes(),
+			Epoch:         hexutil.Uint64(key.Epoch),
+			EnabledHeight: hexutil.Uint64(key.EnabledHeight),
+			BlockNumber:   hexutil.Uint64(height),
+		}, nil
+	})
+	s.Register("antimev_getFeeParams", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var p transaction.FeeParams
+		if err := n.Call(ctx, func() { p = n.FeeParams() }); err != nil {
+			return nil, err
+		}
+		return &FeeParams{
+			BaseFee: (*hexutil.Big)(p.BaseFee),
+			ByteFee: (*hexutil.Big)(p.ByteFee),
+		}, nil
+	})
+	// the size is the length of the encrypted transaction in bytes
+	s.Register("antimev_estimateEnvelopeFee", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var size hexutil.Uint64
+		if err := parseParams(params, &size); err != nil {
+			return nil, err
+		}
+		if size > maxRequestSize {
+			return nil, InvalidParams(fmt.Errorf("envelope size %d too large", size))
+		}
+		var p transaction.FeeParams
+		if err := n.Call(ctx, func() { p = n.FeeParams() }); err != nil {
+			return nil, err
+		}
+		e := transaction.Envelope{EncryptedTransaction: make([]byte, size)}
+		return (*hexutil.Big)(e.ComputeFeeWith(p)), nil
+	})
+	// the carriers of a block with the transactions decrypted from them
+	s.Register("antimev_getBlockEnvelopes", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var number BlockNumber
+		if err := parseParams(params, &number); err != nil {
+			return nil, err
+		}
+		b, height, err := blockByNumber(ctx, n, number)
+		if b == nil {
+			return nil, err
+		}
+		return newBlockEnvelopes(b, height), nil
+	})
+	// pending, proposed, decrypted, invalid-inner, included, expired or dropped
+	s.Register("antimev_getEnvelopeStatus", func(ctx context.Context, params []json.RawMessage) (any, error) {
+		var hash common.Hash
+		if err := parseParams(params, &hash); err != nil {
+			return nil, err
+		}
+		var (
+			r   *dbft.EnvelopeRecord
+			err error
+		)
+		if err := n.Call(ctx, func() { r, err = n.GetEnvelopeStatus(hash) }); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, dbft.ErrEnvelopeNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &EnvelopeStatus{
+			Status: r.Status.String(),
+			Height: hexutil.Uint64(r.Height),
+			Inner:  r.Inner,
+		}, nil
+	})
+}
+
+// txError reports why a tx is rejected, the reason is kept in data
+func txError(err error) error {
+	for _, reason := range []error{
+		dbft.ErrEncryptionExpired,
+		dbft.ErrNotEnoughFee,
+		dbft.ErrWrongPaymentTarget,
+		dbft.ErrInvalidEnvelope,
+		dbft.ErrPoolFull,
+	} {
+		if errors.Is(err, reason) {
+			return &Error{Code: CodeServerError, Message: err.Error(), Data: reason.Error()}
+		}
+	}
+	return err
+}
+
+// parseParams decodes positional params into the targets, the first one is
+// required and the others may be omitted by the caller
+func parseParams(params []json.RawMessage, targets ...any) error {
+	if len(params) > len(targets) {
+		return InvalidParams(fmt.Errorf("too many arguments, want at most %d", len(targets)))
+	}
+	if len(params) == 0 && len(targets) > 0 {
+		return InvalidParams(errors.New("missing value for required argument 0"))
+	}
+	for i, p := range params {
+		if err := json.Unmarshal(p, targets[i]); err != nil {
+			return InvalidParams(fmt.Errorf("argument %d: %w", i, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Package rpc serves the node over JSON-RPC 2.0 on HTTP and websocket, in the
+// format of Ethereum clients.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const maxRequestSize = 5 << 20
+
+// standard JSON-RPC error codes, -32000 is used by Ethereum clients for
+// rejected transactions
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeServerError    = -32000
+)
+
+// Error is a JSON-RPC error, handlers return it to choose the code, any other
+// error is reported as a server error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// InvalidParams wraps a decoding error of the params
+func InvalidParams(err error) *Error {
+	return &Error{Code: CodeInvalidParams, Message: "invalid params: " + err.Error()}
+}
+
+// Method handles the positional params of a call.
+type Method func(ctx context.Context, params []json.RawMessage) (any, error)
+
+// Server dispatches JSON-RPC calls to the registered methods.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]Method
+	origins []string // origins allowed to open websocket connections
+}
+
+func NewServer() *Server {
+	s := &Server{methods: make(map[string]Method)}
+	s.Register("eth_unsubscribe", unsubscribe)
+	return s
+}
+
+// Register adds a method, names follow the namespace_method convention
+func (s *Server) Register(name string, m Method) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[name] = m
+}
+
+// SetAllowedOrigins sets the origins allowed to open websocket connections
+// from a browser, "*" allows any origin. Only localhost is allowed if none is
+// set. Connections without an origin don't come from a browser and are always
+// allowed.
+func (s *Server) SetAllowedOrigins(origins []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.origins = append([]string(nil), origins...)
+}
+
+type request struct {
+	Version string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"` // null for a missing object
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// ServeHTTP handles a single call or a batch posted as JSON, or upgrades the
+// connection to websocket for subscriptions
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) {
+		s.mu.RLock()
+		allowed := originAllowed(r.Header.Get("Origin"), s.origins)
+		s.mu.RUnlock()
+		if !allowed {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		s.serveWebSocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Handle(r.Context(), body))
+}
+
+// Handle runs the calls in a raw request and returns the responses
+func (s *Server) Handle(ctx context.Context, body []byte) any {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+			return errorResponse(nil, &Error{Code: CodeParseError, Message: "invalid batch"})
+		}
+		res := make([]*response, len(batch))
+		for i, b := range batch {
+			res[i] = s.call(ctx, b)
+		}
+		return res
+	}
+	return s.call(ctx, body)
+}
+
+func (s *Server) call(ctx context.Context, b []byte) *response {
+	var req request
+	if err := json.Unmarshal(b, &req); err != nil {
+		return errorResponse(nil, &Error{Code: CodeParseError, Message: err.Error()})
+	}
+	if req.Version != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, &Error{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+	s.mu.RLock()
+	m, ok := s.methods[req.Method]
+	s.mu.RUnlock()
+	if !ok {
+		return errorResponse(req.ID, &Error{Code: CodeMethodNotFound, Message: "the method " + req.Method + " does not exist"})
+	}
+	result, err := m(ctx, req.Params)
+	if err != nil {
+		var e *Error
+		if !errors.As(err, &e) {
+			e = &Error{Code: CodeServerError, Message: err.Error()}
+		}
+		return errorResponse(req.ID, e)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, &Error{Code: CodeServerError, Message: err.Error()})
+	}
+	return &response{Version: "2.0", ID: req.ID, Result: data}
+}
+
+func errorResponse(id json.RawMessage, e *Error) *response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &response{Version: "2.0", ID: id, Error: e}
+}
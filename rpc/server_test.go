@@ -0,0 +1,237 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	dbft "github.com/txhsl/dbft-anti-mev"
+	"github.com/txhsl/dbft-anti-mev/util/transaction"
+	"github.com/txhsl/tpke"
+)
+
+type testResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+func call(t *testing.T, url string, body string) []byte {
+	res, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer res.Body.Close()
+	b := new(bytes.Buffer)
+	b.ReadFrom(res.Body)
+	return b.Bytes()
+}
+
+func rawTx(t *testing.T, tx *types.Transaction) string {
+	b, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return hexutil.Encode(b)
+}
+
+func TestSendRawTransaction(t *testing.T) {
+	n := dbft.NewObserver(1, nil, nil, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.EventLoop(ctx)
+
+	s := NewServer()
+	RegisterEthAPI(s, n)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// a legacy tx is accepted
+	tx := types.NewTransaction(1, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	var res testResponse
+	err := json.Unmarshal(call(t, srv.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["`+rawTx(t, tx)+`"]}`), &res)
+	if err != nil || res.Error != nil {
+		t.Fatalf("unexpected response: %v %v", err, res.Error)
+	}
+	if string(res.Result) != `"`+tx.Hash().Hex()+`"` {
+		t.Fatalf("unexpected result %s", res.Result)
+	}
+
+	// every call of a batch is answered
+	batch := `[{"jsonrpc":"2.0","id":2,"method":"eth_sendRawTransaction","params":["0x1234"]},` +
+		`{"jsonrpc":"2.0","id":3,"method":"eth_sendRawTransaction","params":[]},` +
+		`{"jsonrpc":"2.0","id":4,"method":"eth_unknown","params":[]}]`
+	var results []testResponse
+	err = json.Unmarshal(call(t, srv.URL, batch), &results)
+	if err != nil || len(results) != 3 {
+		t.Fatalf("unexpected batch response: %v", err)
+	}
+	for i, code := range []int{CodeInvalidParams, CodeInvalidParams, CodeMethodNotFound} {
+		if results[i].Error == nil || results[i].Error.Code != code {
+			t.Fatalf("unexpected error of call %d: %+v", results[i].ID, results[i].Error)
+		}
+	}
+
+	// rejected txs keep the reason in data
+	e, ok := txError(fmt.Errorf("%w: %w", dbft.ErrInvalidEnvelope, errors.New("bad seed"))).(*Error)
+	if !ok || e.Code != CodeServerError || e.Data != dbft.ErrInvalidEnvelope.Error() {
+		t.Fatalf("unexpected error: %+v", e)
+	}
+}
+
+func TestAntiMEVAPI(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	globalpub := dkg.PublishGlobalPublicKey()
+	n := dbft.NewObserver(1, nil, globalpub, 5, dkg.GetScaler())
+	n.SetFeeParams(transaction.FeeParams{BaseFee: big.NewInt(100), ByteFee: big.NewInt(2)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.EventLoop(ctx)
+
+	s := NewServer()
+	RegisterAntiMEVAPI(s, n)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	var res struct {
+		Result EncryptionKey `json:"result"`
+		Error  *Error        `json:"error"`
+	}
+	err = json.Unmarshal(call(t, srv.URL, `{"jsonrpc":"2.0","id":1,"method":"antimev_getEncryptionKey","params":[]}`), &res)
+	if err != nil || res.Error != nil {
+		t.Fatalf("unexpected response: %v %v", err, res.Error)
+	}
+	if !bytes.Equal(res.Result.GlobalPubKey, globalpub.ToBytes()) || res.Result.Epoch != 0 || res.Result.EnabledHeight != 5 {
+		t.Fatalf("unexpected encryption key %+v", res.Result)
+	}
+
+	// the fee is the same as the one of a sealed envelope
+	var fee testResponse
+	err = json.Unmarshal(call(t, srv.URL, `{"jsonrpc":"2.0","id":2,"method":"antimev_estimateEnvelopeFee","params":["0x10"]}`), &fee)
+	if err != nil || fee.Error != nil {
+		t.Fatalf("unexpected response: %v %v", err, fee.Error)
+	}
+	if string(fee.Result) != `"0x84"` {
+		t.Fatalf("unexpected fee %s", fee.Result)
+	}
+}
+
+func TestBlockQueries(t *testing.T) {
+	s, err := dbft.OpenBlockStore(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	carrier := types.NewTransaction(0, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), []byte{1})
+	inner := types.NewTransaction(1, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	legacy := types.NewTransaction(2, dbft.ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	block := &dbft.Block{
+		Header:       &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0)},
+		Transactions: []*types.Transaction{carrier, inner, legacy},
+		Signature:    []byte{1, 2, 3},
+		CarrierNum:   1,
+		Links:        []dbft.CarrierLink{{Carrier: 0, Inner: 1}},
+	}
+	if err := s.Put(1, block); err != nil {
+		t.Fatalf(err.Error())
+	}
+	n := dbft.NewObserver(1, nil, nil, 0, 0)
+	if err := n.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.EventLoop(ctx)
+
+	rs := NewServer()
+	RegisterEthAPI(rs, n)
+	RegisterAntiMEVAPI(rs, n)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	hash := block.Header.Hash().Hex()
+	batch := `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]},` +
+		`{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByNumber","params":["latest",false]},` +
+		`{"jsonrpc":"2.0","id":3,"method":"eth_getBlockByHash","params":["` + hash + `",true]},` +
+		`{"jsonrpc":"2.0","id":4,"method":"eth_getTransactionByHash","params":["` + legacy.Hash().Hex() + `"]},` +
+		`{"jsonrpc":"2.0","id":5,"method":"antimev_getBlockEnvelopes","params":["0x1"]},` +
+		`{"jsonrpc":"2.0","id":6,"method":"eth_getBlockByNumber","params":["0x2",false]},` +
+		`{"jsonrpc":"2.0","id":7,"method":"antimev_getEnvelopeStatus","params":["` + carrier.Hash().Hex() + `"]}]`
+	var results []testResponse
+	err = json.Unmarshal(call(t, srv.URL, batch), &results)
+	if err != nil || len(results) != 7 {
+		t.Fatalf("unexpected batch response: %v", err)
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			t.Fatalf("unexpected error of call %d: %+v", r.ID, r.Error)
+		}
+	}
+	if string(results[0].Result) != `"0x1"` {
+		t.Fatalf("unexpected block number %s", results[0].Result)
+	}
+
+	var b Block
+	if err := json.Unmarshal(results[1].Result, &b); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if b.Hash.Hex() != hash || len(b.Transactions) != 3 || b.Transactions[2] != legacy.Hash().Hex() {
+		t.Fatalf("unexpected block %+v", b)
+	}
+	var full struct {
+		Number       hexutil.Uint64 `json:"number"`
+		Transactions []Transaction  `json:"transactions"`
+	}
+	if err := json.Unmarshal(results[2].Result, &full); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if full.Number != 1 || len(full.Transactions) != 3 || full.Transactions[1].Hash != inner.Hash() {
+		t.Fatalf("unexpected full block %+v", full)
+	}
+
+	var tx Transaction
+	if err := json.Unmarshal(results[3].Result, &tx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tx.Hash != legacy.Hash() || tx.BlockNumber != 1 || tx.TransactionIndex != 2 || tx.Nonce != 2 {
+		t.Fatalf("unexpected tx %+v", tx)
+	}
+
+	// the carrier is mapped to the transaction decrypted from it
+	var envelopes BlockEnvelopes
+	if err := json.Unmarshal(results[4].Result, &envelopes); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(envelopes.Envelopes) != 1 || envelopes.Envelopes[0].Carrier != carrier.Hash() ||
+		envelopes.Envelopes[0].Inner == nil || *envelopes.Envelopes[0].Inner != inner.Hash() ||
+		!bytes.Equal(envelopes.Signature, block.Signature) {
+		t.Fatalf("unexpected envelopes %+v", envelopes)
+	}
+
+	// a missing block is null
+	if string(results[5].Result) != "null" {
+		t.Fatalf("unexpected result %s", results[5].Result)
+	}
+
+	// the status of a committed carrier is found in its block
+	var status EnvelopeStatus
+	if err := json.Unmarshal(results[6].Result, &status); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if status.Status != "included" || status.Height != 1 || status.Inner == nil || *status.Inner != inner.Hash() {
+		t.Fatalf("unexpected envelope status %+v", status)
+	}
+}
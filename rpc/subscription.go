@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ErrNotificationsUnsupported is returned for subscriptions over HTTP
+var ErrNotificationsUnsupported = &Error{Code: CodeMethodNotFound, Message: "notifications not supported"}
+
+// Notifier runs the subscriptions of a websocket connection and pushes their
+// results as notifications.
+type Notifier struct {
+	conn *wsConn
+	ctx  context.Context // done once the connection is closed
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+}
+
+type notifierKey struct{}
+
+// NotifierFromContext returns the notifier of the connection a call arrived on
+func NotifierFromContext(ctx context.Context) (*Notifier, bool) {
+	n, ok := ctx.Value(notifierKey{}).(*Notifier)
+	return n, ok
+}
+
+type notification struct {
+	Version string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  subscriptionResult `json:"params"`
+}
+
+type subscriptionResult struct {
+	ID     string `json:"subscription"`
+	Result any    `json:"result"`
+}
+
+// Subscribe starts run in a new goroutine, it sends results with notify until
+// its context is done by unsubscription or disconnection. Notifications are
+// sent as the namespace_subscription method.
+func (nt *Notifier) Subscribe(namespace string, run func(ctx context.Context, notify func(any) error)) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hexutil.Encode(b)
+	ctx, cancel := context.WithCancel(nt.ctx)
+	nt.mu.Lock()
+	nt.subs[id] = cancel
+	nt.mu.Unlock()
+
+	notify := func(result any) error {
+		data, err := json.Marshal(&notification{
+			Version: "2.0",
+			Method:  namespace + "_subscription",
+			Params:  subscriptionResult{ID: id, Result: result},
+		})
+		if err != nil {
+			return err
+		}
+		return nt.conn.WriteMessage(data)
+	}
+	go func() {
+		defer nt.Unsubscribe(id)
+		run(ctx, notify)
+	}()
+	return id
+}
+
+// Unsubscribe stops a subscription, it reports whether the subscription existed
+func (nt *Notifier) Unsubscribe(id string) bool {
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+	cancel, ok := nt.subs[id]
+	if ok {
+		cancel()
+		delete(nt.subs, id)
+	}
+	return ok
+}
+
+// unsubscribe is the eth_unsubscribe method shared by all subscriptions
+func unsubscribe(ctx context.Context, params []json.RawMessage) (any, error) {
+	nt, ok := NotifierFromContext(ctx)
+	if !ok {
+		return nil, ErrNotificationsUnsupported
+	}
+	var id string
+	if err := parseParams(params, &id); err != nil {
+		return nil, err
+	}
+	return nt.Unsubscribe(id), nil
+}
+
+// serveWebSocket handles the calls of a websocket connection in order, the
+// subscriptions made on it end with the connection
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nt := &Notifier{conn: conn, ctx: ctx, subs: make(map[string]context.CancelFunc)}
+	ctx = context.WithValue(ctx, notifierKey{}, nt)
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				conn.write(opClose, nil)
+			}
+			return
+		}
+		data, err := json.Marshal(s.Handle(ctx, msg))
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(data); err != nil {
+			return
+		}
+	}
+}
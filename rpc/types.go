@@ -0,0 +1,172 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	dbft "github.com/txhsl/dbft-anti-mev"
+)
+
+// BlockNumber is a block height or one of the tags latest, pending and
+// earliest. Pending blocks are not served, the tag is read as latest.
+type BlockNumber int64
+
+const LatestBlockNumber BlockNumber = -1
+
+func (b *BlockNumber) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	switch strings.TrimSpace(s) {
+	case "latest", "pending":
+		*b = LatestBlockNumber
+		return nil
+	case "earliest":
+		*b = 0
+		return nil
+	}
+	n, err := hexutil.DecodeUint64(s)
+	if err != nil {
+		return err
+	}
+	if n > 1<<62 {
+		return errors.New("block number too large")
+	}
+	*b = BlockNumber(n)
+	return nil
+}
+
+// height resolves the block number against the latest height
+func (b BlockNumber) height(latest uint64) uint64 {
+	if b == LatestBlockNumber {
+		return latest
+	}
+	return uint64(b)
+}
+
+// Transaction is a committed transaction in the format of Ethereum clients.
+type Transaction struct {
+	Hash             common.Hash     `json:"hash"`
+	BlockHash        common.Hash     `json:"blockHash"`
+	BlockNumber      hexutil.Uint64  `json:"blockNumber"`
+	TransactionIndex hexutil.Uint64  `json:"transactionIndex"`
+	Type             hexutil.Uint64  `json:"type"`
+	From             *common.Address `json:"from,omitempty"` // missing if the sender can't be recovered
+	To               *common.Address `json:"to"`
+	Nonce            hexutil.Uint64  `json:"nonce"`
+	Value            *hexutil.Big    `json:"value"`
+	Gas              hexutil.Uint64  `json:"gas"`
+	GasPrice         *hexutil.Big    `json:"gasPrice"`
+	Input            hexutil.Bytes   `json:"input"`
+}
+
+func newTransaction(tx *types.Transaction, block *dbft.Block, loc dbft.TxLocation) *Transaction {
+	t := &Transaction{
+		Hash:             tx.Hash(),
+		BlockHash:        block.Header.Hash(),
+		BlockNumber:      hexutil.Uint64(loc.Height),
+		TransactionIndex: hexutil.Uint64(loc.Index),
+		Type:             hexutil.Uint64(tx.Type()),
+		To:               tx.To(),
+		Nonce:            hexutil.Uint64(tx.Nonce()),
+		Value:            (*hexutil.Big)(tx.Value()),
+		Gas:              hexutil.Uint64(tx.Gas()),
+		GasPrice:         (*hexutil.Big)(tx.GasPrice()),
+		Input:            tx.Data(),
+	}
+	if from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx); err == nil {
+		t.From = &from
+	}
+	return t
+}
+
+// Block is a committed block in the format of Ethereum clients, the
+// transactions are hashes or full objects.
+type Block struct {
+	Number           hexutil.Uint64 `json:"number"`
+	Hash             common.Hash    `json:"hash"`
+	ParentHash       common.Hash    `json:"parentHash"`
+	Miner            common.Address `json:"miner"`
+	StateRoot        common.Hash    `json:"stateRoot"`
+	TransactionsRoot common.Hash    `json:"transactionsRoot"`
+	GasLimit         hexutil.Uint64 `json:"gasLimit"`
+	GasUsed          hexutil.Uint64 `json:"gasUsed"`
+	Timestamp        hexutil.Uint64 `json:"timestamp"`
+	ExtraData        hexutil.Bytes  `json:"extraData"`
+	Transactions     []any          `json:"transactions"`
+}
+
+func newBlock(b *dbft.Block, height uint64, fullTx bool) *Block {
+	h := b.Header
+	block := &Block{
+		Number:           hexutil.Uint64(height),
+		Hash:             h.Hash(),
+		ParentHash:       h.ParentHash,
+		Miner:            h.Coinbase,
+		StateRoot:        h.Root,
+		TransactionsRoot: h.TxHash,
+		GasLimit:         hexutil.Uint64(h.GasLimit),
+		GasUsed:          hexutil.Uint64(h.GasUsed),
+		Timestamp:        hexutil.Uint64(h.Time),
+		ExtraData:        h.Extra,
+		Transactions:     make([]any, len(b.Transactions)),
+	}
+	for i, tx := range b.Transactions {
+		if fullTx {
+			block.Transactions[i] = newTransaction(tx, b, dbft.TxLocation{Height: height, Index: uint64(i)})
+		} else {
+			block.Transactions[i] = tx.Hash()
+		}
+	}
+	return block
+}
+
+// BlockEnvelopes shows which transactions of a block arrived encrypted.
+type BlockEnvelopes struct {
+	Number    hexutil.Uint64 `json:"number"`
+	Hash      common.Hash    `json:"hash"`
+	Signature hexutil.Bytes  `json:"signature"` // the aggregated threshold signature of the header hash
+	Envelopes []Envelope     `json:"envelopes"`
+}
+
+// Envelope is a carrier with the transaction decrypted from it, the inner
+// transaction is null if the envelope failed to decrypt.
+type Envelope struct {
+	Carrier common.Hash  `json:"carrier"`
+	Inner   *common.Hash `json:"inner"`
+}
+
+func newBlockEnvelopes(b *dbft.Block, height uint64) *BlockEnvelopes {
+	inners := make(map[uint64]uint64, len(b.Links))
+	for _, l := range b.Links {
+		inners[l.Carrier] = l.Inner
+	}
+	res := &BlockEnvelopes{
+		Number:    hexutil.Uint64(height),
+		Hash:      b.Header.Hash(),
+		Signature: b.Signature,
+		Envelopes: make([]Envelope, 0, b.CarrierNum),
+	}
+	for i := uint64(0); i < b.CarrierNum && i < uint64(len(b.Transactions)); i++ {
+		e := Envelope{Carrier: b.Transactions[i].Hash()}
+		if j, ok := inners[i]; ok && j < uint64(len(b.Transactions)) {
+			hash := b.Transactions[j].Hash()
+			e.Inner = &hash
+		}
+		res.Envelopes = append(res.Envelopes, e)
+	}
+	return res
+}
+
+// EnvelopeStatus is the lifecycle step of a carrier, the inner transaction
+// is set once the envelope is decrypted.
+type EnvelopeStatus struct {
+	Status string         `json:"status"`
+	Height hexutil.Uint64 `json:"height"`
+	Inner  *common.Hash   `json:"inner"`
+}
@@ -0,0 +1,251 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a minimal server side of RFC 6455, enough for JSON-RPC over text messages
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	wsWriteTimeout = 10 * time.Second
+)
+
+var errMessageTooLarge = errors.New("websocket message too large")
+
+// isWebSocket reports whether the request asks for a websocket upgrade
+func isWebSocket(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// originAllowed reports whether a websocket handshake with the origin header
+// is allowed, entries match either the whole origin or its host name
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil {
+		return false
+	}
+	if len(allowed) == 0 {
+		allowed = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == "*" || a == strings.ToLower(origin) || a == u.Hostname() {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn is a websocket connection, messages can be written concurrently
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // guards writes
+}
+
+// upgrade completes the handshake and takes over the connection
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("bad websocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.Sum([]byte(key + wsGUID))
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(h[:]))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// ReadMessage returns the next data message, control frames are handled on
+// the way, io.EOF is returned once the peer closes
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, op, payload, err := readWSFrame(c.r, true)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.write(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.write(opClose, nil)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, errors.New("unexpected data frame in a fragmented message")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errors.New("unexpected continuation frame")
+			}
+		default:
+			return nil, fmt.Errorf("unknown opcode 0x%x", op)
+		}
+		if len(msg)+len(payload) > maxRequestSize {
+			return nil, errMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// WriteMessage sends a text message
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.write(opText, data)
+}
+
+func (c *wsConn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return writeWSFrame(c.conn, op, payload, nil)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// readWSFrame reads a frame, frames from clients have to be masked
+func readWSFrame(r *bufio.Reader, masked bool) (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("unexpected reserved bits")
+	}
+	if (head[1]&0x80 != 0) != masked {
+		return false, 0, nil, errors.New("unexpected frame masking")
+	}
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= opClose && (size > 125 || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if size > maxRequestSize {
+		return false, 0, nil, errMessageTooLarge
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	// the payload grows as it arrives, a frame only claiming a large size
+	// doesn't allocate it
+	payload, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if uint64(len(payload)) != size {
+		return false, 0, nil, io.ErrUnexpectedEOF
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// writeWSFrame writes a single final frame, servers send unmasked frames
+func writeWSFrame(w io.Writer, op byte, payload []byte, mask []byte) error {
+	frame := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if mask != nil {
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dbft "github.com/txhsl/dbft-anti-mev"
+)
+
+// dialWebSocket opens a websocket connection to a test server
+func dialWebSocket(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	addr := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", addr)
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(status, "101") {
+		t.Fatalf("unexpected handshake %q: %v", status, err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		// the accept key of the sample nonce in RFC 6455
+		if strings.HasPrefix(line, "Sec-WebSocket-Accept") && !strings.Contains(line, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=") {
+			t.Fatalf("unexpected accept key %q", line)
+		}
+		if line == "\r\n" {
+			return conn, r
+		}
+	}
+}
+
+func wsCall(t *testing.T, conn net.Conn, r *bufio.Reader, body string) testResponse {
+	if err := writeWSFrame(conn, opText, []byte(body), []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, op, data, err := readWSFrame(r, false)
+	if err != nil || op != opText {
+		t.Fatalf("unexpected frame 0x%x: %v", op, err)
+	}
+	var res testResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return res
+}
+
+func TestWebSocket(t *testing.T) {
+	n := dbft.NewObserver(1, nil, nil, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.EventLoop(ctx)
+
+	s := NewServer()
+	RegisterEthAPI(s, n)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// subscriptions need websocket
+	var res testResponse
+	err := json.Unmarshal(call(t, srv.URL, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["consensus"]}`), &res)
+	if err != nil || res.Error == nil || res.Error.Message != ErrNotificationsUnsupported.Message {
+		t.Fatalf("unexpected response: %v %+v", err, res.Error)
+	}
+
+	conn, r := dialWebSocket(t, srv.URL)
+	defer conn.Close()
+	res = wsCall(t, conn, r, `{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]}`)
+	if res.Error != nil || string(res.Result) != `"0x0"` {
+		t.Fatalf("unexpected response %s %+v", res.Result, res.Error)
+	}
+	res = wsCall(t, conn, r, `{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["newPendingTransactions"]}`)
+	if res.Error == nil || res.Error.Code != CodeInvalidParams {
+		t.Fatalf("unexpected response %+v", res.Error)
+	}
+	res = wsCall(t, conn, r, `{"jsonrpc":"2.0","id":4,"method":"eth_subscribe","params":["consensus"]}`)
+	var id string
+	if res.Error != nil || json.Unmarshal(res.Result, &id) != nil {
+		t.Fatalf("unexpected response %s %+v", res.Result, res.Error)
+	}
+	res = wsCall(t, conn, r, `{"jsonrpc":"2.0","id":5,"method":"eth_unsubscribe","params":["`+id+`"]}`)
+	if res.Error != nil || string(res.Result) != "true" {
+		t.Fatalf("unexpected response %s %+v", res.Result, res.Error)
+	}
+
+	// the server answers pings and closes
+	if err := writeWSFrame(conn, opPing, []byte("ping"), []byte{5, 6, 7, 8}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, op, data, err := readWSFrame(r, false); err != nil || op != opPong || string(data) != "ping" {
+		t.Fatalf("unexpected pong 0x%x %q: %v", op, data, err)
+	}
+	if err := writeWSFrame(conn, opClose, nil, []byte{5, 6, 7, 8}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, op, _, err := readWSFrame(r, false); err != nil || op != opClose {
+		t.Fatalf("unexpected close 0x%x: %v", op, err)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := NewServer()
+	handshake := func(origin string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the recorder can't be hijacked, so an allowed handshake fails later
+	for _, c := range []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{nil, "", true},
+		{nil, "http://localhost:3000", true},
+		{nil, "https://evil.example", false},
+		{[]string{"https://app.example"}, "https://app.example", true},
+		{[]string{"app.example"}, "https://APP.example:8443", true},
+		{[]string{"app.example"}, "http://localhost", false},
+		{[]string{"*"}, "https://evil.example", true},
+	} {
+		s.SetAllowedOrigins(c.origins)
+		code := handshake(c.origin)
+		if (code != http.StatusForbidden) != c.allowed {
+			t.Fatalf("origin %q with %v: status %d", c.origin, c.origins, code)
+		}
+	}
+}
+
+func FuzzReadWSFrame(f *testing.F) {
+	for _, payload := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte{1}, 200), bytes.Repeat([]byte{2}, 70000)} {
+		var buf bytes.Buffer
+		writeWSFrame(&buf, opText, payload, []byte{1, 2, 3, 4})
+		f.Add(buf.Bytes(), true)
+		buf.Reset()
+		writeWSFrame(&buf, opBinary, payload, nil)
+		f.Add(buf.Bytes(), false)
+	}
+	f.Add([]byte{0x89, 0xfe, 0, 0}, true)
+	f.Add([]byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true)
+
+	f.Fuzz(func(t *testing.T, data []byte, masked bool) {
+		fin, op, payload, err := readWSFrame(bufio.NewReader(bytes.NewReader(data)), masked)
+		if err != nil {
+			return
+		}
+		if len(payload) > maxRequestSize {
+			t.Fatalf("payload of %d bytes accepted", len(payload))
+		}
+		if op >= opClose && (len(payload) > 125 || !fin) {
+			t.Fatalf("invalid control frame accepted")
+		}
+		// a final frame read back after writing it again
+		if !fin {
+			return
+		}
+		var mask []byte
+		if masked {
+			mask = []byte{5, 6, 7, 8}
+		}
+		var buf bytes.Buffer
+		if err := writeWSFrame(&buf, op, payload, mask); err != nil {
+			t.Fatalf(err.Error())
+		}
+		fin2, op2, payload2, err := readWSFrame(bufio.NewReader(&buf), masked)
+		if err != nil || !fin2 || op2 != op || !bytes.Equal(payload, payload2) {
+			t.Fatalf("frame changed after writing it again: %v", err)
+		}
+	})
+}
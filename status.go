@@ -0,0 +1,144 @@
+package dbft
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// the number of blocks the final status of an envelope is kept in memory,
+// included envelopes can still be found in committed blocks afterwards
+const envelopeStatusRetention = 1024
+
+// ErrEnvelopeNotFound is returned for a carrier the node has never seen
+var ErrEnvelopeNotFound = errors.New("envelope not found")
+
+// EnvelopeStatus is a step in the lifecycle of a carrier.
+type EnvelopeStatus byte
+
+const (
+	EnvelopePending      EnvelopeStatus = iota + 1 // waiting in the envelope pool
+	EnvelopeProposed                               // in the proposal of the current round
+	EnvelopeDecrypted                              // decrypted in the current round, not committed yet
+	EnvelopeInvalidInner                           // the envelope failed to decrypt or decode, it is never included
+	EnvelopeIncluded                               // committed with the decrypted transaction
+	EnvelopeExpired                                // dropped since its key is no longer accepted
+	EnvelopeDropped                                // dropped from the pool without being committed
+)
+
+var envelopeStatusNames = map[EnvelopeStatus]string{
+	EnvelopePending:      "pending",
+	EnvelopeProposed:     "proposed",
+	EnvelopeDecrypted:    "decrypted",
+	EnvelopeInvalidInner: "invalid-inner",
+	EnvelopeIncluded:     "included",
+	EnvelopeExpired:      "expired",
+	EnvelopeDropped:      "dropped",
+}
+
+func (s EnvelopeStatus) String() string {
+	if name, ok := envelopeStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("EnvelopeStatus(%d)", byte(s))
+}
+
+func (s EnvelopeStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// final reports whether the envelope has left the consensus
+func (s EnvelopeStatus) final() bool {
+	return s >= EnvelopeInvalidInner
+}
+
+// EnvelopeRecord is the latest status of a carrier.
+type EnvelopeRecord struct {
+	Status EnvelopeStatus
+	Height uint64       // the height the status is reached at
+	Inner  *common.Hash // the decrypted transaction, if any
+}
+
+// get the status of a carrier by its hash
+func (n *Node) GetEnvelopeStatus(carrier common.Hash) (*EnvelopeRecord, error) {
+	if r, ok := n.envelopes[carrier]; ok {
+		c := *r
+		return &c, nil
+	}
+	// the record may be pruned, look up committed blocks instead
+	_, loc, err := n.GetTransaction(carrier)
+	if errors.Is(err, ErrTxNotFound) {
+		return nil, ErrEnvelopeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.GetBlock(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Index >= b.CarrierNum {
+		return nil, ErrEnvelopeNotFound
+	}
+	for _, l := range b.Links {
+		if l.Carrier == loc.Index && l.Inner < uint64(len(b.Transactions)) {
+			inner := b.Transactions[l.Inner].Hash()
+			return &EnvelopeRecord{Status: EnvelopeIncluded, Height: loc.Height, Inner: &inner}, nil
+		}
+	}
+	return &EnvelopeRecord{Status: EnvelopeInvalidInner, Height: loc.Height}, nil
+}
+
+// setEnvelopeStatus moves a carrier to a new status, a final status is kept
+func (n *Node) setEnvelopeStatus(carrier common.Hash, status EnvelopeStatus, height uint64, inner *common.Hash) {
+	if r, ok := n.envelopes[carrier]; ok && r.Status.final() {
+		return
+	}
+	n.envelopes[carrier] = &EnvelopeRecord{Status: status, Height: height, Inner: inner}
+}
+
+// proposeEnvelopes marks the carriers of the current proposal
+func (n *Node) proposeEnvelopes() {
+	for _, tx := range n.txList[:n.envelopNum] {
+		n.setEnvelopeStatus(tx.Hash(), EnvelopeProposed, n.height+1, nil)
+	}
+}
+
+// unproposeEnvelopes moves the carriers of a failed round back to pending
+func (n *Node) unproposeEnvelopes() {
+	for _, tx := range n.txList[:n.envelopNum] {
+		n.setEnvelopeStatus(tx.Hash(), EnvelopePending, n.height, nil)
+	}
+}
+
+// commitEnvelopes finalizes the carriers of a committed block and the ones
+// left in the pool, which is cleared after every block
+func (n *Node) commitEnvelopes(height uint64, b *Block, pool []*types.Transaction) {
+	inners := make(map[uint64]common.Hash, len(b.Links))
+	for _, l := range b.Links {
+		inners[l.Carrier] = b.Transactions[l.Inner].Hash()
+	}
+	committed := make(map[common.Hash]bool, b.CarrierNum)
+	for i, tx := range b.Transactions[:b.CarrierNum] {
+		committed[tx.Hash()] = true
+		if inner, ok := inners[uint64(i)]; ok {
+			n.setEnvelopeStatus(tx.Hash(), EnvelopeIncluded, height, &inner)
+		} else {
+			n.setEnvelopeStatus(tx.Hash(), EnvelopeInvalidInner, height, nil)
+		}
+	}
+	for _, tx := range pool {
+		if !committed[tx.Hash()] {
+			n.setEnvelopeStatus(tx.Hash(), EnvelopeDropped, height, nil)
+		}
+	}
+
+	// forget old final records
+	for h, r := range n.envelopes {
+		if r.Status.final() && r.Height+envelopeStatusRetention < height {
+			delete(n.envelopes, h)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package dbft
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	blockPrefix     = []byte("b") // block prefix + height -> block
+	blockHashPrefix = []byte("n") // block hash prefix + header hash -> height
+	txPrefix        = []byte("t") // tx prefix + tx hash -> height + index
+	heightKey       = []byte("h") // the height of the latest block
+	roundKey        = []byte("r") // the state of the round in progress
+	epochKey        = []byte("e") // the key epochs in use
+	keyDealKey      = []byte("k") // the key deals of the next epoch
+)
+
+// ErrBlockNotFound is returned by BlockStore.Get for a missing block
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockStore persists committed blocks in a leveldb database.
+type BlockStore struct {
+	db *leveldb.DB
+}
+
+func OpenBlockStore(path string) (*BlockStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockStore{db: db}, nil
+}
+
+func (s *BlockStore) Close() error {
+	return s.db.Close()
+}
+
+// Put stores a block with its indexes and moves the latest height to it, the
+// state of the finished round is dropped
+func (s *BlockStore) Put(height uint64, b *Block) error {
+	data, err := rlp.EncodeToBytes(b)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(blockKey(height), data)
+	batch.Put(hashKey(blockHashPrefix, b.Header.Hash()), binary.BigEndian.AppendUint64(nil, height))
+	for i, tx := range b.Transactions {
+		loc := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, height), uint64(i))
+		batch.Put(hashKey(txPrefix, tx.Hash()), loc)
+	}
+	batch.Put(heightKey, binary.BigEndian.AppendUint64(nil, height))
+	batch.Delete(roundKey)
+	return s.db.Write(batch, nil)
+}
+
+func (s *BlockStore) Get(height uint64) (*Block, error) {
+	data, err := s.db.Get(blockKey(height), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := new(Block)
+	if err := rlp.DecodeBytes(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BlockHeight returns the height of a block by the hash of its header
+func (s *BlockStore) BlockHeight(hash common.Hash) (uint64, error) {
+	data, err := s.db.Get(hashKey(blockHashPrefix, hash), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, ErrBlockNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, errors.New("corrupted block index")
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// TxLocation returns the position of a committed transaction
+func (s *BlockStore) TxLocation(hash common.Hash) (TxLocation, error) {
+	data, err := s.db.Get(hashKey(txPrefix, hash), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return TxLocation{}, ErrTxNotFound
+	}
+	if err != nil {
+		return TxLocation{}, err
+	}
+	if len(data) != 16 {
+		return TxLocation{}, errors.New("corrupted tx index")
+	}
+	return TxLocation{
+		Height: binary.BigEndian.Uint64(data[:8]),
+		Index:  binary.BigEndian.Uint64(data[8:]),
+	}, nil
+}
+
+// Height returns the height of the latest block, 0 if the store is empty
+func (s *BlockStore) Height() (uint64, error) {
+	data, err := s.db.Get(heightKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, errors.New("corrupted height")
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// putRound persists the state of the round in progress, it is synced to disk
+// before the node sends anything
+func (s *BlockStore) putRound(r *roundState) error {
+	data, err := rlp.EncodeToBytes(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(roundKey, data, &opt.WriteOptions{Sync: true})
+}
+
+// round returns the state of the round in progress, nil if there is none
+func (s *BlockStore) round() (*roundState, error) {
+	data, err := s.db.Get(roundKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := new(roundState)
+	if err := rlp.DecodeBytes(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// putKeyDeals persists the key deal messages of the next epoch, it is synced
+// to disk before the node sends anything
+func (s *BlockStore) putKeyDeals(k *keyDealState) error {
+	data, err := rlp.EncodeToBytes(k)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(keyDealKey, data, &opt.WriteOptions{Sync: true})
+}
+
+// keyDeals returns the persisted key deal messages, nil if there are none
+func (s *BlockStore) keyDeals() (*keyDealState, error) {
+	data, err := s.db.Get(keyDealKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k := new(keyDealState)
+	if err := rlp.DecodeBytes(data, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// putEpochs persists the key epochs in use, it is synced to disk
+func (s *BlockStore) putEpochs(e *storedEpochs) error {
+	data, err := rlp.EncodeToBytes(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(epochKey, data, &opt.WriteOptions{Sync: true})
+}
+
+// epochs returns the persisted key epochs, nil if the node never rotated keys
+func (s *BlockStore) epochs() (*storedEpochs, error) {
+	data, err := s.db.Get(epochKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := new(storedEpochs)
+	if err := rlp.DecodeBytes(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func blockKey(height uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), blockPrefix...), height)
+}
+
+func hashKey(prefix []byte, hash common.Hash) []byte {
+	return append(append([]byte(nil), prefix...), hash.Bytes()...)
+}
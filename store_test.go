@@ -0,0 +1,76 @@
+package dbft
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestBlockStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if h, err := s.Height(); err != nil || h != 0 {
+		t.Fatalf("unexpected height of empty store")
+	}
+
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	b := &Block{
+		Header:       &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0)},
+		Transactions: []*types.Transaction{tx},
+		Signature:    []byte{1, 2, 3},
+	}
+	if err := s.Put(1, b); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := s.Get(2); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Close()
+
+	// blocks survive a restart
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	n := NewObserver(1, nil, nil, 0, 0)
+	if err := n.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n.height != 1 || n.blocks[1].Hash() != b.Hash() || n.blocks[1].Transactions[0].Hash() != tx.Hash() {
+		t.Fatalf("invalid stored block")
+	}
+
+	// only the latest blocks are kept in memory, older blocks are looked up in
+	// the store
+	parent := b.Header.Hash()
+	for h := uint64(2); h <= blockWindow+1; h++ {
+		next := &Block{Header: &types.Header{ParentHash: parent, Number: new(big.Int).SetUint64(h), Difficulty: big.NewInt(0)}}
+		if err := s.Put(h, next); err != nil {
+			t.Fatalf(err.Error())
+		}
+		n.addBlock(h, next)
+		n.height = h
+		parent = next.Header.Hash()
+	}
+	if len(n.blocks) != blockWindow || len(n.blockIndex) != blockWindow || len(n.txIndex) != 0 {
+		t.Fatalf("%d blocks kept in memory", len(n.blocks))
+	}
+	found, height, err := n.GetBlockByHash(b.Header.Hash())
+	if err != nil || height != 1 || found.Hash() != b.Hash() {
+		t.Fatalf("block not found by hash: %v", err)
+	}
+	got, loc, err := n.GetTransaction(tx.Hash())
+	if err != nil || got.Hash() != tx.Hash() || loc.Height != 1 || loc.Index != 0 {
+		t.Fatalf("tx not found: %v", err)
+	}
+	if _, _, err := n.GetTransaction(common.Hash{}); !errors.Is(err, ErrTxNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
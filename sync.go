@@ -0,0 +1,259 @@
+package dbft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+// a block request without response is sent again after this time
+const syncTimeout = 5 * time.Second
+
+// a peer is served a burst of block requests, then a request per interval,
+// further requests are dropped
+const (
+	syncServeBurst    = 4
+	syncServeInterval = time.Second
+)
+
+// serveLimit is the token bucket of the block requests of a peer
+type serveLimit struct {
+	tokens float64
+	last   time.Time
+}
+
+// isSync reports whether a message type belongs to block sync
+func isSync(t payload.MessageType) bool {
+	return t == message.BlockAnnounceType || t == message.BlockRequestType || t == message.BlockResponseType
+}
+
+// sendSync signs a block sync message and sends it without blocking, sync
+// messages are dropped while a peer's queue is full and requested again later.
+// A node without a signer takes no part in block sync, since unsigned
+// messages are dropped.
+func (n *Node) sendSync(msg *message.Payload, peers ...chan<- *message.Payload) {
+	if n.signer == nil {
+		return
+	}
+	msg.Message.ValidatorIndex = n.index
+	msg.Message.BlockIndex = n.height
+	msg.Sign(n.signer)
+	n.metrics.message(msg.Type(), "out")
+	n.recordMsg(JournalOut, msg)
+	for _, ch := range peers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// announceBlock tells peers about a committed block, announces are only
+// accepted from validators
+func (n *Node) announceBlock(b *Block) {
+	if !n.validator || n.signer == nil {
+		return
+	}
+	msg := &message.Payload{Message: message.Message{Type: message.BlockAnnounceType}}
+	msg.SetPayload(message.BlockAnnounce{
+		Height: n.height,
+		Hash:   util.Uint256(b.Header.Hash()),
+	})
+	n.sendSync(msg, n.neighbors...)
+}
+
+// handleSync handles a block sync message, block requests are signed by any
+// known signer and the others by validators
+func (n *Node) handleSync(m *message.Payload) error {
+	switch p := m.Payload().(type) {
+	case message.BlockAnnounce:
+		// a peer a single block ahead usually commits the same block as this
+		// node, so only a node further behind starts syncing
+		if p.Height > n.syncTarget {
+			n.syncTarget = p.Height
+		}
+		if n.syncTarget > n.height+1 {
+			n.requestBlocks(m.ValidatorIndex())
+		}
+	case message.BlockRequest:
+		return n.serveBlocks(m.ValidatorIndex(), p)
+	case message.BlockResponse:
+		n.syncRequested = time.Time{}
+		// the announced height is only trusted as far as the peer backs it
+		// with verified blocks
+		start := n.height
+		for i, data := range p.Blocks {
+			height := p.Start + uint64(i)
+			if height <= n.height {
+				continue
+			}
+			if height != n.height+1 {
+				break
+			}
+			b := new(Block)
+			if err := rlp.DecodeBytes(data, b); err != nil {
+				n.syncTarget = n.height
+				return n.reject(m, err)
+			}
+			if err := n.verifyBlock(b); err != nil {
+				n.syncTarget = n.height
+				return n.reject(m, fmt.Errorf("block %d: %w", height, err))
+			}
+			n.logMsg(slog.LevelInfo, "synced block", m, "block", height, "hash", b.Header.Hash())
+			if err := n.commitBlock(b); err != nil {
+				return err
+			}
+		}
+		if n.height == start {
+			n.syncTarget = n.height
+		}
+		n.requestBlocks(m.ValidatorIndex())
+	default:
+		return n.reject(m, fmt.Errorf("malformed %s", message.TypeName(m.Type())))
+	}
+	return nil
+}
+
+// requestBlocks asks a peer for the next blocks up to the announced height,
+// a single request is pending at a time
+func (n *Node) requestBlocks(from uint16) {
+	if n.signer == nil || n.syncTarget <= n.height {
+		return
+	}
+	if !n.syncRequested.IsZero() && time.Since(n.syncRequested) < syncTimeout {
+		return
+	}
+	peer, ok := n.peers[from]
+	if !ok {
+		return
+	}
+	count := n.syncTarget - n.height
+	if count > message.MaxSyncBlocks {
+		count = message.MaxSyncBlocks
+	}
+	msg := &message.Payload{Message: message.Message{Type: message.BlockRequestType}}
+	msg.SetPayload(message.BlockRequest{Start: n.height + 1, Count: count})
+	n.logRound(slog.LevelDebug, "requesting blocks", "peer", from, "start", n.height+1, "count", count)
+	n.syncRequested = time.Now()
+	n.sendSync(msg, peer)
+}
+
+// serveBlocks answers a block request with the committed blocks in range,
+// the response goes to the configured peer of the signer of the request
+func (n *Node) serveBlocks(to uint16, r message.BlockRequest) error {
+	peer, ok := n.peers[to]
+	if !ok || r.Start == 0 || r.Start > n.height {
+		return nil
+	}
+	if !n.allowServe(to) {
+		n.logRound(slog.LevelDebug, "dropped block request over the rate limit", "peer", to, "start", r.Start)
+		return nil
+	}
+	blocks := make([][]byte, 0, r.Count)
+	size := 0
+	for h := r.Start; h < r.Start+r.Count && h <= n.height; h++ {
+		b, err := n.GetBlock(h)
+		if err != nil {
+			return err
+		}
+		data, err := rlp.EncodeToBytes(b)
+		if err != nil {
+			return err
+		}
+		// leave room for the rest of the frame
+		if size+len(data) > maxFrameSize/2 && len(blocks) > 0 {
+			break
+		}
+		size += len(data)
+		blocks = append(blocks, data)
+	}
+	msg := &message.Payload{Message: message.Message{Type: message.BlockResponseType}}
+	msg.SetPayload(message.BlockResponse{Start: r.Start, Blocks: blocks})
+	n.sendSync(msg, peer)
+	return nil
+}
+
+// allowServe takes a token from the bucket of a peer, the bucket refills by
+// a token per syncServeInterval up to syncServeBurst
+func (n *Node) allowServe(peer uint16) bool {
+	now := time.Now()
+	l, ok := n.syncServed[peer]
+	if !ok {
+		l = &serveLimit{tokens: syncServeBurst, last: now}
+		n.syncServed[peer] = l
+	}
+	l.tokens += float64(now.Sub(l.last)) / float64(syncServeInterval)
+	if l.tokens > syncServeBurst {
+		l.tokens = syncServeBurst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// verifyBlock checks a synced block extends the latest block and is signed
+// by the validators of its epoch. The last block of an epoch carries the key
+// decision of the next one signed with the keys in use, so a node behind
+// installs the keys of every epoch it has missed before verifying its blocks.
+func (n *Node) verifyBlock(b *Block) error {
+	h := b.Header
+	if h == nil || h.Number == nil || h.Number.Uint64() != n.height+1 {
+		return errors.New("unexpected block number")
+	}
+	if h.ParentHash != n.parentHash() {
+		return errors.New("unexpected parent hash")
+	}
+	if types.DeriveSha(types.Transactions(b.Transactions), trie.NewStackTrie(nil)) != h.TxHash {
+		return errors.New("transactions don't match the header")
+	}
+	if b.CarrierNum > uint64(len(b.Transactions)) {
+		return errors.New("invalid number of carriers")
+	}
+	for _, l := range b.Links {
+		if l.Carrier >= b.CarrierNum || l.Inner < b.CarrierNum || l.Inner >= uint64(len(b.Transactions)) {
+			return errors.New("invalid carrier link")
+		}
+	}
+	if !bytes.Equal(h.Extra, extraHash(b.CarrierNum, b.Links, b.KeyDecision).Bytes()) {
+		return errors.New("carrier links or key decision don't match the header")
+	}
+	key, err := n.blockKey(h.Number.Uint64())
+	if err != nil {
+		return err
+	}
+	sig, err := DecodeSignature(b.Signature)
+	if err != nil {
+		return err
+	}
+	if !key.VerifySig(h.Hash().Bytes(), sig) {
+		return errors.New("invalid block signature")
+	}
+	return nil
+}
+
+// blockKey returns the global key of the epoch a block belongs to, old epochs
+// are known until their grace window ends
+func (n *Node) blockKey(number uint64) (*tpke.PublicKey, error) {
+	if number >= n.keyEnabledHeight && n.globalPubKey != nil {
+		return n.globalPubKey, nil
+	}
+	for i := len(n.oldEpochs) - 1; i >= 0; i-- {
+		if e := n.oldEpochs[i]; number >= e.EnabledHeight {
+			return e.GlobalPubKey, nil
+		}
+	}
+	return nil, fmt.Errorf("no key of the epoch of block %d", number)
+}
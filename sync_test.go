@@ -0,0 +1,218 @@
+package dbft
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+func TestBlockSync(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(8)
+
+	// 7 validators and an observer
+	nodes := make([]*Node, 8)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	nodes[7] = NewObserver(8, signers[8], globalpub, 0, dkg.GetScaler())
+	for i := 0; i < 8; i++ {
+		nodes[i].Connect(nodes)
+	}
+
+	// blocks signed by a quorum of validators
+	blocks := make([]*Block, 3)
+	parent := common.Hash{}
+	for i := range blocks {
+		tx := types.NewTransaction(uint64(i), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		txs := []*types.Transaction{tx}
+		h := &types.Header{
+			ParentHash: parent,
+			Number:     big.NewInt(int64(i + 1)),
+			TxHash:     types.DeriveSha(types.Transactions(txs), trie.NewStackTrie(nil)),
+			Difficulty: big.NewInt(0),
+			Extra:      extraHash(0, nil, nil).Bytes(),
+		}
+		shares := make(map[int]*tpke.SignatureShare)
+		for j := 1; j <= nodes[0].quorum(); j++ {
+			shares[j] = prvs[j].SignShare(h.Hash().Bytes())
+		}
+		sig, err := aggregateSignature(globalpub, h.Hash().Bytes(), nodes[0].quorum(), shares)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		blocks[i] = &Block{Header: h, Transactions: txs, Signature: sig.ToBytes()}
+		parent = h.Hash()
+	}
+
+	// a forged block is rejected
+	forged := *blocks[0]
+	forged.Signature = blocks[1].Signature
+	if err := nodes[1].verifyBlock(&forged); err == nil {
+		t.Fatalf("block with an invalid signature accepted")
+	}
+	if err := nodes[1].verifyBlock(blocks[1]); err == nil {
+		t.Fatalf("block with an unknown parent accepted")
+	}
+	forged = *blocks[0]
+	forged.CarrierNum = 1
+	if err := nodes[1].verifyBlock(&forged); err == nil {
+		t.Fatalf("block with altered carriers accepted")
+	}
+
+	// the first node commits the blocks and announces them, the others catch up,
+	// including the observer
+	for _, b := range blocks {
+		if err := nodes[0].verifyBlock(b); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := nodes[0].commitBlock(b); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	deliver(nodes, nil)
+	for i := 1; i < 8; i++ {
+		if nodes[i].height != 3 {
+			t.Fatalf("node %d synced to height %d", i+1, nodes[i].height)
+		}
+		for j := range blocks {
+			if nodes[i].blocks[uint64(j+1)].Hash() != blocks[j].Hash() {
+				t.Fatalf("invalid synced block")
+			}
+		}
+	}
+}
+
+func TestSyncTarget(t *testing.T) {
+	n := NewObserver(1, newSigners(1)[1], nil, 0, 0)
+	peer := make(chan *message.Payload, 10)
+	n.AddPeer(2, peer)
+
+	// a peer announcing a height it can't back with blocks
+	announce := &message.Payload{Message: message.Message{Type: message.BlockAnnounceType, ValidatorIndex: 2}}
+	announce.SetPayload(message.BlockAnnounce{Height: 1000})
+	n.handleSync(announce)
+	if n.syncTarget != 1000 || len(peer) != 1 {
+		t.Fatalf("blocks not requested")
+	}
+	request := <-peer
+	if request.Type() != message.BlockRequestType || request.ValidatorIndex() != 1 {
+		t.Fatalf("unexpected request")
+	}
+	response := &message.Payload{Message: message.Message{Type: message.BlockResponseType, ValidatorIndex: 2}}
+	response.SetPayload(message.BlockResponse{Start: 1})
+	n.handleSync(response)
+	if n.syncTarget != 0 || len(peer) != 0 {
+		t.Fatalf("empty response kept the sync target %d", n.syncTarget)
+	}
+}
+
+func TestServeBlocks(t *testing.T) {
+	signers := newSigners(3)
+	n := NewObserver(1, signers[1], nil, 0, 0)
+	peer := make(chan *message.Payload, 10)
+	n.AddPeer(2, peer)
+	n.signers[2] = &signers[2].PublicKey
+	n.addBlock(1, &Block{Header: &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0)}})
+	n.height = 1
+
+	request := func(signer int) *message.Payload {
+		m := &message.Payload{Message: message.Message{Type: message.BlockRequestType, ValidatorIndex: 2}}
+		m.SetPayload(message.BlockRequest{Start: 1, Count: 1})
+		if signer != 0 {
+			m.Sign(signers[signer])
+		}
+		return m
+	}
+
+	// unsigned requests and requests signed by another key aren't answered
+	for _, signer := range []int{0, 3} {
+		if err := n.HandleMsg(request(signer)); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(peer) != 0 {
+		t.Fatalf("request of an unknown signer answered")
+	}
+
+	// a known signer is answered up to the burst
+	for i := 0; i < syncServeBurst+1; i++ {
+		if err := n.HandleMsg(request(2)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if len(peer) != syncServeBurst {
+		t.Fatalf("answered %d requests, the burst is %d", len(peer), syncServeBurst)
+	}
+}
+
+func TestSyncKeyRotation(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(8)
+
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+		if err := nodes[i].SetEpochInterval(4); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+	for h := 1; h <= 5; h++ {
+		tx := types.NewTransaction(uint64(h), ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+		for i := 0; i < 7; i++ {
+			nodes[i].PendLegacyTx(tx)
+		}
+		primary(nodes).Propose()
+		deliver(nodes, nil)
+	}
+	if nodes[0].height != 5 || nodes[0].Epoch() != 1 {
+		t.Fatalf("keys not rotated")
+	}
+
+	// an observer offline during the rotation takes the keys of epoch 1 from
+	// the last block of epoch 0 and verifies the blocks after it
+	observer := NewObserver(8, signers[8], globalpub, 0, dkg.GetScaler())
+	if err := observer.SetEpochInterval(4); err != nil {
+		t.Fatalf(err.Error())
+	}
+	observer.Connect(nodes)
+	for i := 0; i < 7; i++ {
+		nodes[i].AddPeer(8, observer.GetHandler())
+		nodes[i].signers[8] = &signers[8].PublicKey
+	}
+	nodes[0].announceBlock(nodes[0].blocks[5])
+	deliver(append(nodes, observer), nil)
+	if observer.height != 5 || observer.Epoch() != 1 {
+		t.Fatalf("observer synced to height %d in epoch %d", observer.height, observer.Epoch())
+	}
+	if !bytes.Equal(observer.globalPubKey.ToBytes(), nodes[0].globalPubKey.ToBytes()) {
+		t.Fatalf("observer installed another global key")
+	}
+	if observer.blocks[5].Hash() != nodes[0].blocks[5].Hash() {
+		t.Fatalf("invalid synced block")
+	}
+}
@@ -0,0 +1,203 @@
+package dbft
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+const (
+	maxFrameSize   = 16 << 20 // the maximum size of a payload on the wire
+	peerQueueSize  = 256      // messages queued for a peer while dialing
+	dialTimeout    = 3 * time.Second
+	redialInterval = time.Second // messages are dropped within this time after a failed dial
+	writeTimeout   = 5 * time.Second
+)
+
+// Transport connects a node to its peers over TCP. Every payload is written
+// as a 4 byte big endian length followed by its binary encoding. Messages to
+// an unreachable peer are dropped, the consensus recovers by change view.
+type Transport struct {
+	node     *Node
+	listener net.Listener
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+}
+
+func NewTransport(n *Node) *Transport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Transport{
+		node:   n,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen accepts connections from peers and queues their messages to the node
+func (t *Transport) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	t.listener = l
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.track(conn, true)
+			t.wg.Add(1)
+			go t.read(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the listening address
+func (t *Transport) Addr() net.Addr {
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+// AddPeer registers a validator reachable at addr with the node, it must be
+// called before the node starts its event loop
+func (t *Transport) AddPeer(index uint16, addr string) {
+	ch := make(chan *message.Payload, peerQueueSize)
+	t.node.AddPeer(index, ch)
+	t.wg.Add(1)
+	go t.write(addr, ch)
+}
+
+// Close stops listening and drops all connections
+func (t *Transport) Close() error {
+	t.cancel()
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	t.mu.Lock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+func (t *Transport) track(c net.Conn, add bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if add {
+		t.conns[c] = struct{}{}
+	} else {
+		delete(t.conns, c)
+	}
+}
+
+// read decodes payloads from a peer connection, the signature is checked by the node
+func (t *Transport) read(conn net.Conn) {
+	defer t.wg.Done()
+	defer t.track(conn, false)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		b, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		m, err := message.BytesToPayload(b)
+		if err != nil {
+			// a peer speaking garbage is dropped
+			return
+		}
+		select {
+		case t.node.messageHandler <- m:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// write sends the queued messages to a peer, dialing it on demand
+func (t *Transport) write(addr string, ch <-chan *message.Payload) {
+	defer t.wg.Done()
+	var conn net.Conn
+	var failed time.Time
+	defer func() {
+		if conn != nil {
+			t.track(conn, false)
+			conn.Close()
+		}
+	}()
+	for {
+		var m *message.Payload
+		select {
+		case m = <-ch:
+		case <-t.ctx.Done():
+			return
+		}
+		if conn == nil {
+			if time.Since(failed) < redialInterval {
+				continue
+			}
+			c, err := net.DialTimeout("tcp", addr, dialTimeout)
+			if err != nil {
+				failed = time.Now()
+				continue
+			}
+			conn = c
+			t.track(conn, true)
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := writeFrame(conn, m.ToBytes()); err != nil {
+			t.track(conn, false)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxFrameSize {
+		return errors.New("frame is too large")
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,47 @@
+package dbft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+func TestTransport(t *testing.T) {
+	a := NewObserver(1, nil, nil, 0, 0)
+	b := NewObserver(2, nil, nil, 0, 0)
+	ta := NewTransport(a)
+	tb := NewTransport(b)
+	if err := tb.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer tb.Close()
+	ta.AddPeer(2, tb.Addr().String())
+	defer ta.Close()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	msg := &message.Payload{
+		Message: message.Message{
+			Type:           payload.ChangeViewType,
+			ValidatorIndex: 1,
+			BlockIndex:     1,
+		},
+	}
+	msg.SetPayload(message.ChangeView{NewViewNumber: 1})
+	msg.Sign(key)
+	a.peers[2] <- msg
+
+	select {
+	case m := <-b.messageHandler:
+		if err := m.Verify(&key.PublicKey); err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not delivered")
+	}
+}
@@ -0,0 +1,23 @@
+package message
+
+import (
+	"github.com/nspcc-dev/neo-go/pkg/io"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+)
+
+// BlockAnnounce tells peers a block is committed, peers further behind
+// request the blocks they miss.
+type BlockAnnounce struct {
+	Height uint64
+	Hash   util.Uint256 // the header hash of the block
+}
+
+func (a BlockAnnounce) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(a.Height)
+	w.WriteBytes(a.Hash[:])
+}
+
+func (a *BlockAnnounce) DecodeBinary(r *io.BinReader) {
+	a.Height = r.ReadU64LE()
+	r.ReadBytes(a.Hash[:])
+}
@@ -0,0 +1,29 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// MaxSyncBlocks is the maximum number of blocks in a single BlockRequest.
+const MaxSyncBlocks = 64
+
+// BlockRequest asks a peer for a range of committed blocks.
+type BlockRequest struct {
+	Start uint64 // the height of the first block
+	Count uint64
+}
+
+func (b BlockRequest) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(b.Start)
+	w.WriteU64LE(b.Count)
+}
+
+func (b *BlockRequest) DecodeBinary(r *io.BinReader) {
+	b.Start = r.ReadU64LE()
+	b.Count = r.ReadU64LE()
+	if r.Err == nil && (b.Count == 0 || b.Count > MaxSyncBlocks) {
+		r.Err = fmt.Errorf("invalid number of blocks: %d", b.Count)
+	}
+}
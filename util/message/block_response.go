@@ -0,0 +1,38 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// BlockResponse carries consecutive committed blocks, a peer may return
+// fewer blocks than requested.
+type BlockResponse struct {
+	Start  uint64   // the height of the first block
+	Blocks [][]byte // RLP encoded blocks
+}
+
+func (b BlockResponse) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(b.Start)
+	w.WriteVarUint(uint64(len(b.Blocks)))
+	for _, v := range b.Blocks {
+		w.WriteVarBytes(v)
+	}
+}
+
+func (b *BlockResponse) DecodeBinary(r *io.BinReader) {
+	b.Start = r.ReadU64LE()
+	l := r.ReadVarUint()
+	if r.Err != nil {
+		return
+	}
+	if l > MaxSyncBlocks {
+		r.Err = fmt.Errorf("too many blocks: %d", l)
+		return
+	}
+	b.Blocks = make([][]byte, l)
+	for i := range b.Blocks {
+		b.Blocks[i] = r.ReadVarBytes()
+	}
+}
@@ -18,7 +18,7 @@ func (c ChangeView) EncodeBinary(w *io.BinWriter) {
 	w.WriteB(byte(c.Reason))
 }
 
-func (c ChangeView) DecodeBinary(r *io.BinReader) {
+func (c *ChangeView) DecodeBinary(r *io.BinReader) {
 	c.Timestamp = r.ReadU64LE()
 	c.Reason = payload.ChangeViewReason(r.ReadB())
 }
@@ -13,10 +13,10 @@ type Commit struct {
 
 func (c Commit) EncodeBinary(w *io.BinWriter) {
 	w.WriteBytes(c.FinalHash[:])
-	w.WriteBytes(c.Signature)
+	w.WriteVarBytes(c.Signature)
 }
 
-func (c Commit) DecodeBinary(r *io.BinReader) {
+func (c *Commit) DecodeBinary(r *io.BinReader) {
 	r.ReadBytes(c.FinalHash[:])
-	r.ReadBytes(c.Signature)
+	c.Signature = r.ReadVarBytes()
 }
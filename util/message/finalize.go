@@ -1,15 +1,57 @@
 package message
 
-import "github.com/nspcc-dev/neo-go/pkg/io"
+import (
+	"fmt"
+
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// MaxDecryptShares is the maximum number of decryption shares in a single Finalize.
+const MaxDecryptShares = 0xffff
+
+// MaxKeyProofs is the maximum number of key proofs in a single Finalize, one per
+// epoch of the envelopes.
+const MaxKeyProofs = 0xff
 
 type Finalize struct {
 	DecryptShare [][]byte // there will be different shares for every tx, each costs 48 bytes
+	KeyProofs    [][]byte // the key proof of every epoch the shares belong to, in ascending epoch order
 }
 
 func (a Finalize) EncodeBinary(w *io.BinWriter) {
-	w.WriteArray(a.DecryptShare)
+	w.WriteVarUint(uint64(len(a.DecryptShare)))
+	for _, s := range a.DecryptShare {
+		w.WriteVarBytes(s)
+	}
+	w.WriteVarUint(uint64(len(a.KeyProofs)))
+	for _, p := range a.KeyProofs {
+		w.WriteVarBytes(p)
+	}
 }
 
-func (a Finalize) DecodeBinary(r *io.BinReader) {
-	r.ReadArray(&a.DecryptShare)
+func (a *Finalize) DecodeBinary(r *io.BinReader) {
+	l := r.ReadVarUint()
+	if r.Err != nil {
+		return
+	}
+	if l > MaxDecryptShares {
+		r.Err = fmt.Errorf("too many decryption shares: %d", l)
+		return
+	}
+	a.DecryptShare = make([][]byte, l)
+	for i := range a.DecryptShare {
+		a.DecryptShare[i] = r.ReadVarBytes()
+	}
+	l = r.ReadVarUint()
+	if r.Err != nil {
+		return
+	}
+	if l > MaxKeyProofs {
+		r.Err = fmt.Errorf("too many key proofs: %d", l)
+		return
+	}
+	a.KeyProofs = make([][]byte, l)
+	for i := range a.KeyProofs {
+		a.KeyProofs[i] = r.ReadVarBytes()
+	}
 }
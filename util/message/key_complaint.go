@@ -0,0 +1,27 @@
+package message
+
+import (
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// KeyComplaint is sent by a member of the next epoch whose share in a KeyDeal
+// fails to decrypt or doesn't match the commitments of the dealer. The dealer
+// answers with a KeyReveal, a dealer with an unanswered complaint is left out
+// of the keys.
+type KeyComplaint struct {
+	Epoch         uint64
+	EnabledHeight uint64
+	Dealer        uint16
+}
+
+func (k KeyComplaint) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(k.Epoch)
+	w.WriteU64LE(k.EnabledHeight)
+	w.WriteU16LE(k.Dealer)
+}
+
+func (k *KeyComplaint) DecodeBinary(r *io.BinReader) {
+	k.Epoch = r.ReadU64LE()
+	k.EnabledHeight = r.ReadU64LE()
+	k.Dealer = r.ReadU16LE()
+}
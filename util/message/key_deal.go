@@ -0,0 +1,78 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// MaxKeyDealSize is the maximum number of members in a single KeyDeal.
+const MaxKeyDealSize = 0xff
+
+// KeyDeal is the part of a single dealer in the keys of the next epoch. The
+// dealer commits to the coefficients of a random polynomial and encrypts its
+// value at every member's index to the member's message signing key, so the
+// deal is broadcast to all nodes.
+type KeyDeal struct {
+	Epoch         uint64
+	EnabledHeight uint64   // the first height that uses the new keys
+	Threshold     uint64   // the degree of the polynomial
+	Members       []uint16 // the sorted indexes of the validator set of the epoch
+	Commitments   [][]byte // commitments to the coefficients in G1, the first one to the secret
+	Shares        [][]byte // the share of Members[i], encrypted to its signing key
+}
+
+func (k KeyDeal) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(k.Epoch)
+	w.WriteU64LE(k.EnabledHeight)
+	w.WriteU64LE(k.Threshold)
+	w.WriteVarUint(uint64(len(k.Members)))
+	for _, m := range k.Members {
+		w.WriteU16LE(m)
+	}
+	writeBytesList(w, k.Commitments)
+	writeBytesList(w, k.Shares)
+}
+
+func (k *KeyDeal) DecodeBinary(r *io.BinReader) {
+	k.Epoch = r.ReadU64LE()
+	k.EnabledHeight = r.ReadU64LE()
+	k.Threshold = r.ReadU64LE()
+	l := r.ReadVarUint()
+	if r.Err != nil {
+		return
+	}
+	if l > MaxKeyDealSize {
+		r.Err = fmt.Errorf("too many members: %d", l)
+		return
+	}
+	k.Members = make([]uint16, l)
+	for i := range k.Members {
+		k.Members[i] = r.ReadU16LE()
+	}
+	k.Commitments = readBytesList(r, "commitments")
+	k.Shares = readBytesList(r, "shares")
+}
+
+func writeBytesList(w *io.BinWriter, bs [][]byte) {
+	w.WriteVarUint(uint64(len(bs)))
+	for _, b := range bs {
+		w.WriteVarBytes(b)
+	}
+}
+
+func readBytesList(r *io.BinReader, name string) [][]byte {
+	l := r.ReadVarUint()
+	if r.Err != nil {
+		return nil
+	}
+	if l > MaxKeyDealSize {
+		r.Err = fmt.Errorf("too many %s: %d", name, l)
+		return nil
+	}
+	bs := make([][]byte, l)
+	for i := range bs {
+		bs[i] = r.ReadVarBytes()
+	}
+	return bs
+}
@@ -0,0 +1,13 @@
+package message
+
+// KeyDecision fixes the keys of the next epoch. The primary proposes it with
+// the last block of an epoch and the block commits to it, so every node
+// installs the same keys at the boundary, or none if the block has no
+// decision. The keys are the sums of the deals of the qualified dealers.
+type KeyDecision struct {
+	Epoch         uint64
+	EnabledHeight uint64   // the first height that uses the new keys
+	Members       []uint16 // the sorted indexes of the validator set of the epoch
+	Dealers       []uint16 // the sorted indexes of the qualified dealers
+	Commitments   [][]byte // the sums of the commitments of the dealers, the first one is the global key
+}
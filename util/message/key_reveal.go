@@ -0,0 +1,29 @@
+package message
+
+import (
+	"github.com/nspcc-dev/neo-go/pkg/io"
+)
+
+// KeyReveal answers a KeyComplaint, the dealer publishes the share of the
+// complaining member in plain, so that every node can check it against the
+// commitments of the deal.
+type KeyReveal struct {
+	Epoch         uint64
+	EnabledHeight uint64
+	Complainer    uint16
+	Share         []byte
+}
+
+func (k KeyReveal) EncodeBinary(w *io.BinWriter) {
+	w.WriteU64LE(k.Epoch)
+	w.WriteU64LE(k.EnabledHeight)
+	w.WriteU16LE(k.Complainer)
+	w.WriteVarBytes(k.Share)
+}
+
+func (k *KeyReveal) DecodeBinary(r *io.BinReader) {
+	k.Epoch = r.ReadU64LE()
+	k.EnabledHeight = r.ReadU64LE()
+	k.Complainer = r.ReadU16LE()
+	k.Share = r.ReadVarBytes(32)
+}
@@ -1,18 +1,54 @@
 package message
 
 import (
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
 
-	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/nspcc-dev/dbft/payload"
 	"github.com/nspcc-dev/neo-go/pkg/io"
-	"github.com/txhsl/tpke"
 )
 
+// ErrInvalidWitness is returned by Verify when the witness doesn't match the message.
+var ErrInvalidWitness = errors.New("invalid witness")
+
 const (
 	FinalizeType payload.MessageType = 0x22 // A new message type for decryption sharing
+	KeyDealType  payload.MessageType = 0x23 // A new message type for key epoch dealing
+
+	// message types of block sync, they are not bound to a round
+	BlockAnnounceType payload.MessageType = 0x24
+	BlockRequestType  payload.MessageType = 0x25
+	BlockResponseType payload.MessageType = 0x26
+
+	// message types answering invalid key deals, they are not bound to a round
+	KeyComplaintType payload.MessageType = 0x27
+	KeyRevealType    payload.MessageType = 0x28
 )
 
+// TypeName returns the name of a message type, including the ones added here
+func TypeName(t payload.MessageType) string {
+	switch t {
+	case FinalizeType:
+		return "Finalize"
+	case KeyDealType:
+		return "KeyDeal"
+	case BlockAnnounceType:
+		return "BlockAnnounce"
+	case BlockRequestType:
+		return "BlockRequest"
+	case BlockResponseType:
+		return "BlockResponse"
+	case KeyComplaintType:
+		return "KeyComplaint"
+	case KeyRevealType:
+		return "KeyReveal"
+	default:
+		return t.String()
+	}
+}
+
 type (
 	Message struct {
 		Type           payload.MessageType
@@ -20,7 +56,13 @@ type (
 		ValidatorIndex byte
 		ViewNumber     byte
 
-		payload io.Serializable
+		payload encodable
+	}
+
+	// encodable is implemented by all message bodies, bodies are stored by value
+	// and decoded through pointers, see Message.DecodeBinary.
+	encodable interface {
+		EncodeBinary(w *io.BinWriter)
 	}
 
 	// Payload is a type for consensus-related messages.
@@ -57,7 +99,7 @@ func (p Payload) Payload() any {
 
 // SetPayload implements the payload.ConsensusPayload interface.
 func (p *Payload) SetPayload(pl any) {
-	p.payload = pl.(io.Serializable)
+	p.payload = pl.(encodable)
 }
 
 // GetChangeView implements the ConsensusPayload interface.
@@ -125,15 +167,50 @@ func (m *Message) DecodeBinary(r *io.BinReader) {
 	switch m.Type {
 	case payload.ChangeViewType:
 		cv := new(ChangeView)
+		cv.DecodeBinary(r)
 		// newViewNumber is not marshaled
 		cv.NewViewNumber = m.ViewNumber + 1
-		m.payload = cv
+		m.payload = *cv
 	case payload.PrepareRequestType:
-		m.payload = new(PrepareRequest)
+		pr := new(PrepareRequest)
+		pr.DecodeBinary(r)
+		m.payload = *pr
 	case payload.PrepareResponseType:
-		m.payload = new(PrepareResponse)
+		pr := new(PrepareResponse)
+		pr.DecodeBinary(r)
+		m.payload = *pr
+	case FinalizeType:
+		f := new(Finalize)
+		f.DecodeBinary(r)
+		m.payload = *f
 	case payload.CommitType:
-		m.payload = new(Commit)
+		c := new(Commit)
+		c.DecodeBinary(r)
+		m.payload = *c
+	case KeyDealType:
+		k := new(KeyDeal)
+		k.DecodeBinary(r)
+		m.payload = *k
+	case KeyComplaintType:
+		k := new(KeyComplaint)
+		k.DecodeBinary(r)
+		m.payload = *k
+	case KeyRevealType:
+		k := new(KeyReveal)
+		k.DecodeBinary(r)
+		m.payload = *k
+	case BlockAnnounceType:
+		a := new(BlockAnnounce)
+		a.DecodeBinary(r)
+		m.payload = *a
+	case BlockRequestType:
+		b := new(BlockRequest)
+		b.DecodeBinary(r)
+		m.payload = *b
+	case BlockResponseType:
+		b := new(BlockResponse)
+		b.DecodeBinary(r)
+		m.payload = *b
 	// case recoveryRequestType:
 	// 	m.payload = new(recoveryRequest)
 	// case recoveryMessageType:
@@ -142,25 +219,88 @@ func (m *Message) DecodeBinary(r *io.BinReader) {
 		r.Err = fmt.Errorf("invalid type: 0x%02x", byte(m.Type))
 		return
 	}
-	m.payload.DecodeBinary(r)
 }
 
-func (p *Payload) Sign(prv *tpke.PrivateKey) {
-	b, err := rlp.EncodeToBytes(p.Message)
-	if err != nil {
-		panic("failed to encode msg to RLP")
+// signedData returns the bytes covered by the witness, that is the whole
+// message including its body.
+func (m *Message) signedData() ([]byte, error) {
+	if m.payload == nil {
+		return nil, errors.New("empty message body")
+	}
+	w := io.NewBufBinWriter()
+	m.EncodeBinary(w.BinWriter)
+	if w.Err != nil {
+		return nil, w.Err
 	}
-	p.witness = prv.SignShare(b).ToBytes()
+	return w.Bytes(), nil
+}
+
+// Witness returns the secp256k1 signature of the sender over the message.
+func (p *Payload) Witness() []byte {
+	return p.witness
 }
 
-func (p *Payload) Verify(pub *tpke.PublicKey) bool {
-	b, err := rlp.EncodeToBytes(p.Message)
+// EncodeBinary implements the io.Serializable interface.
+func (p *Payload) EncodeBinary(w *io.BinWriter) {
+	p.Message.EncodeBinary(w)
+	w.WriteVarBytes(p.witness)
+}
+
+// DecodeBinary implements the io.Serializable interface.
+func (p *Payload) DecodeBinary(r *io.BinReader) {
+	p.Message.DecodeBinary(r)
+	if r.Err != nil {
+		return
+	}
+	p.witness = r.ReadVarBytes()
+}
+
+// ToBytes serializes the signed payload.
+func (p *Payload) ToBytes() []byte {
+	w := io.NewBufBinWriter()
+	p.EncodeBinary(w.BinWriter)
+	if w.Err != nil {
+		panic("failed to encode payload: " + w.Err.Error())
+	}
+	return w.Bytes()
+}
+
+// BytesToPayload deserializes a signed payload, the witness is not verified.
+func BytesToPayload(b []byte) (*Payload, error) {
+	p := new(Payload)
+	r := io.NewBinReaderFromBuf(b)
+	p.DecodeBinary(r)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return p, nil
+}
+
+// Sign signs the message with the message signing key of the sender, which is
+// apart from the threshold key share used for decryption and block signing.
+func (p *Payload) Sign(key *ecdsa.PrivateKey) {
+	b, err := p.signedData()
+	if err != nil {
+		panic("failed to encode msg: " + err.Error())
+	}
+	sig, err := crypto.Sign(crypto.Keccak256(b), key)
 	if err != nil {
-		panic("failed to encode msg to RLP")
+		panic("failed to sign msg: " + err.Error())
 	}
-	s, err := tpke.BytesToSigShare(p.witness)
+	// the recovery id is not needed, the sender is known by its index
+	p.witness = sig[:crypto.RecoveryIDOffset]
+}
+
+func (p *Payload) Verify(pub *ecdsa.PublicKey) error {
+	b, err := p.signedData()
 	if err != nil {
-		panic("failed to decode sig")
+		return fmt.Errorf("failed to encode msg: %w", err)
+	}
+	if len(p.witness) != crypto.RecoveryIDOffset {
+		return fmt.Errorf("%w: unexpected length %d", ErrInvalidWitness, len(p.witness))
+	}
+	if !crypto.VerifySignature(crypto.FromECDSAPub(pub), crypto.Keccak256(b), p.witness) {
+		return ErrInvalidWitness
 	}
-	return pub.VerifySigShare(b, s)
+	return nil
 }
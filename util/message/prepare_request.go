@@ -17,6 +17,9 @@ type PrepareRequest struct {
 	// Fields that should be included into PrepareRequest for its verification:
 	ParentSealHash common.Hash
 	ParentExtra    []byte
+
+	// the keys of the next epoch, proposed with the last block of an epoch
+	KeyDecision *KeyDecision `rlp:"optional"`
 }
 
 func (p PrepareRequest) EncodeBinary(w *io.BinWriter) {
@@ -28,7 +31,7 @@ func (p PrepareRequest) EncodeBinary(w *io.BinWriter) {
 	w.WriteVarBytes(b)
 }
 
-func (p PrepareRequest) DecodeBinary(r *io.BinReader) {
+func (p *PrepareRequest) DecodeBinary(r *io.BinReader) {
 	b := r.ReadVarBytes()
 	if r.Err != nil {
 		return
@@ -13,6 +13,6 @@ func (p PrepareResponse) EncodeBinary(w *io.BinWriter) {
 	w.WriteBytes(p.PreparationHash[:])
 }
 
-func (p PrepareResponse) DecodeBinary(r *io.BinReader) {
+func (p *PrepareResponse) DecodeBinary(r *io.BinReader) {
 	r.ReadBytes(p.PreparationHash[:])
 }
@@ -2,6 +2,7 @@ package transaction
 
 import (
 	"encoding/binary"
+	"errors"
 	"math/big"
 
 	"github.com/txhsl/tpke"
@@ -10,37 +11,69 @@ import (
 const (
 	SeedLen   = 48 * 4
 	Uint64Len = 8
+	HeaderLen = Uint64Len * 2 // encrypt height and epoch
 )
 
 type Envelope struct {
 	EncryptHeight        uint64
+	Epoch                uint64 // the key epoch of the global public key used for encryption
 	EncryptedSeed        *tpke.CipherText
 	EncryptedTransaction []byte
 }
 
-// an envelope costs 200 bytes + tx length
+// an envelope costs 208 bytes + tx length
 func (e Envelope) ToBytes() []byte {
-	b := make([]byte, SeedLen+Uint64Len+len(e.EncryptedTransaction))
+	b := make([]byte, HeaderLen+SeedLen+len(e.EncryptedTransaction))
 	binary.PutUvarint(b, e.EncryptHeight)
-	copy(b[Uint64Len:Uint64Len+SeedLen], e.EncryptedSeed.ToBytes())
-	copy(b[Uint64Len+SeedLen:], e.EncryptedTransaction)
+	binary.PutUvarint(b[Uint64Len:], e.Epoch)
+	copy(b[HeaderLen:HeaderLen+SeedLen], e.EncryptedSeed.ToBytes())
+	copy(b[HeaderLen+SeedLen:], e.EncryptedTransaction)
 	return b
 }
 
 func BytesToEnvelope(b []byte) (*Envelope, error) {
+	if len(b) < HeaderLen+SeedLen {
+		return nil, errors.New("envelope too short")
+	}
 	h, _ := binary.Uvarint(b[:Uint64Len])
-	es, err := tpke.BytesToCipherText(b[Uint64Len : Uint64Len+SeedLen])
+	epoch, _ := binary.Uvarint(b[Uint64Len:HeaderLen])
+	es, err := tpke.BytesToCipherText(b[HeaderLen : HeaderLen+SeedLen])
 	if err != nil {
 		return nil, err
 	}
 	return &Envelope{
 		EncryptHeight:        h,
+		Epoch:                epoch,
 		EncryptedSeed:        es,
-		EncryptedTransaction: b[Uint64Len+SeedLen:],
+		EncryptedTransaction: b[HeaderLen+SeedLen:],
 	}, nil
 }
 
+// FeeParams prices an envelope as a base fee plus a fee per byte of the
+// encrypted transaction.
+type FeeParams struct {
+	BaseFee *big.Int
+	ByteFee *big.Int
+}
+
+// DefaultFeeParams makes envelopes free
+var DefaultFeeParams = FeeParams{
+	BaseFee: big.NewInt(0),
+	ByteFee: big.NewInt(0),
+}
+
 func (e Envelope) ComputeFee() *big.Int {
-	// can be a base fee + bytes fee (in case of big tx), here we return 0
-	return big.NewInt(0)
+	return e.ComputeFeeWith(DefaultFeeParams)
+}
+
+// the service fee of the envelope, a missing param counts as 0
+func (e Envelope) ComputeFeeWith(p FeeParams) *big.Int {
+	fee := new(big.Int)
+	if p.ByteFee != nil {
+		fee.Mul(p.ByteFee, big.NewInt(int64(len(e.EncryptedTransaction))))
+	}
+	if p.BaseFee != nil {
+		fee.Add(fee, p.BaseFee)
+	}
+	return fee
 }
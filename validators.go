@@ -0,0 +1,119 @@
+package dbft
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+// ValidatorSet maps validator indexes to their public keys.
+type ValidatorSet map[uint16]*tpke.PublicKey
+
+// UnknownValidatorError is returned for messages signed by an index which is
+// not in the validator set.
+type UnknownValidatorError struct {
+	Index uint16
+}
+
+func (e *UnknownValidatorError) Error() string {
+	return fmt.Sprintf("unknown validator %d", e.Index)
+}
+
+// Lookup returns the public key of the validator with the given index.
+func (s ValidatorSet) Lookup(index uint16) (*tpke.PublicKey, error) {
+	pub, ok := s[index]
+	if !ok || pub == nil {
+		return nil, &UnknownValidatorError{Index: index}
+	}
+	return pub, nil
+}
+
+// SignerSet maps validator indexes to the keys their messages are signed with.
+type SignerSet map[uint16]*ecdsa.PublicKey
+
+// Lookup returns the message signing key of the validator with the given index.
+func (s SignerSet) Lookup(index uint16) (*ecdsa.PublicKey, error) {
+	pub, ok := s[index]
+	if !ok || pub == nil {
+		return nil, &UnknownValidatorError{Index: index}
+	}
+	return pub, nil
+}
+
+// sortedIndexes returns the sorted indexes of a validator or signer set
+func sortedIndexes[V any](s map[uint16]V) []uint16 {
+	is := make([]uint16, 0, len(s))
+	for i := range s {
+		is = append(is, i)
+	}
+	sort.Slice(is, func(i, j int) bool { return is[i] < is[j] })
+	return is
+}
+
+// validatorChange is a scheduled change of the validator set
+type validatorChange struct {
+	height  uint64   // the first height signed by the new validator set
+	members []uint16 // the sorted indexes of the new validator set
+}
+
+// ScheduleValidatorChange schedules validators to join or leave the set at a
+// future height. The new validator set gets fresh threshold keys dealt through
+// consensus messages, and quorum thresholds switch at that height. Joining
+// nodes follow the consensus as observers until then.
+func (n *Node) ScheduleValidatorChange(height uint64, join []uint16, leave []uint16) error {
+	if n.pendingChange != nil {
+		return errors.New("validator change already scheduled")
+	}
+	if height <= n.height+1+epochDealLead {
+		return fmt.Errorf("validator change should be scheduled after height %d", n.height+1+epochDealLead)
+	}
+	set := make(map[uint16]bool)
+	for _, i := range n.members() {
+		set[i] = true
+	}
+	for _, i := range join {
+		if i == 0 || i > message.MaxKeyDealSize {
+			return fmt.Errorf("invalid validator index %d", i)
+		}
+		set[i] = true
+	}
+	for _, i := range leave {
+		delete(set, i)
+	}
+	if len(set) == 0 {
+		return errors.New("empty validator set")
+	}
+	ms := make([]uint16, 0, len(set))
+	for i := range set {
+		ms = append(ms, i)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i] < ms[j] })
+	n.pendingChange = &validatorChange{
+		height:  height,
+		members: ms,
+	}
+	return nil
+}
+
+// equalMembers reports whether two sorted validator sets are the same
+func equalMembers(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsIndex reports whether a sorted validator set contains an index
+func containsIndex(ms []uint16, index uint16) bool {
+	i := sort.Search(len(ms), func(i int) bool { return ms[i] >= index })
+	return i < len(ms) && ms[i] == index
+}
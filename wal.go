@@ -0,0 +1,186 @@
+package dbft
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+)
+
+// roundState is what a validator has signed in the round in progress. It is
+// persisted before every broadcast, so that a restarted node never signs a
+// message conflicting with one it has sent and can rejoin the round.
+type roundState struct {
+	Height     uint64 // the height being agreed on
+	View       byte
+	ViewLock   bool
+	Proposal   *types.Header `rlp:"nil"` // the proposal this node has sent or responded to
+	TxList     []*types.Transaction
+	EnvelopNum uint64
+	Locked     *lockedState         `rlp:"nil"`
+	Sent       [][]byte             // the messages sent in the view
+	Decision   *message.KeyDecision `rlp:"optional"`
+}
+
+// lockedState is the persisted form of lockedProposal
+type lockedState struct {
+	Proposal   *types.Header
+	TxList     []*types.Transaction
+	EnvelopNum uint64
+	Header     *types.Header
+	Final      []*types.Transaction
+	Links      []CarrierLink
+	Decision   *message.KeyDecision `rlp:"optional"`
+}
+
+// keyDealState is what a node has handled and sent of the key deals of the
+// next epoch, the deals span several rounds
+type keyDealState struct {
+	Epoch         uint64
+	EnabledHeight uint64
+	Msgs          [][]byte
+}
+
+// saveRound persists the round in progress, it does nothing without a store
+func (n *Node) saveRound() error {
+	if n.store == nil {
+		return nil
+	}
+	r := &roundState{
+		Height:     n.height + 1,
+		View:       n.view,
+		ViewLock:   n.viewLock,
+		Proposal:   n.proposal,
+		TxList:     n.txList,
+		EnvelopNum: uint64(n.envelopNum),
+		Sent:       make([][]byte, len(n.sent)),
+		Decision:   n.decision,
+	}
+	for i, m := range n.sent {
+		r.Sent[i] = m.ToBytes()
+	}
+	if l := n.locked; l != nil {
+		r.Locked = &lockedState{
+			Proposal:   l.proposal,
+			TxList:     l.txList,
+			EnvelopNum: uint64(l.envelopNum),
+			Header:     l.header,
+			Final:      l.final,
+			Links:      l.links,
+			Decision:   l.decision,
+		}
+	}
+	return n.store.putRound(r)
+}
+
+// restoreRound picks up the round the node has left when it stopped
+func (n *Node) restoreRound() error {
+	r, err := n.store.round()
+	if err != nil {
+		return fmt.Errorf("failed to load the round in progress: %w", err)
+	}
+	if r == nil || r.Height != n.height+1 {
+		return nil
+	}
+	sent := make([]*message.Payload, len(r.Sent))
+	for i, b := range r.Sent {
+		if sent[i], err = message.BytesToPayload(b); err != nil {
+			return fmt.Errorf("failed to load the round in progress: %w", err)
+		}
+	}
+
+	n.view = r.View
+	n.viewLock = r.ViewLock
+	n.sent = sent
+	if l := r.Locked; l != nil {
+		n.locked = &lockedProposal{
+			proposal:   l.Proposal,
+			txList:     l.TxList,
+			envelopNum: int(l.EnvelopNum),
+			header:     l.Header,
+			final:      l.Final,
+			links:      l.Links,
+			decision:   l.Decision,
+		}
+	}
+	if r.Proposal != nil {
+		// the mempools are lost, pend the proposed txs again for later views
+		for _, tx := range r.TxList {
+			n.PendTx(tx)
+		}
+		n.proposal = r.Proposal
+		n.txList = r.TxList
+		n.envelopNum = int(r.EnvelopNum)
+		n.decision = r.Decision
+		n.proposeEnvelopes()
+	}
+	// the commit of the view is not signed again
+	for _, m := range sent {
+		if m.Type() == payload.CommitType {
+			n.dbftFinalized = true
+		}
+	}
+	n.metrics.setRound(n.height, n.view)
+	n.logRound(slog.LevelInfo, "restored round", "sent", len(sent), "viewLock", n.viewLock, "locked", n.locked != nil)
+	return nil
+}
+
+// resend sends the messages of a restored round and the key deals of this
+// node again, peers may have missed them while this node was down
+func (n *Node) resend() {
+	for _, m := range n.sent {
+		for _, ch := range n.neighbors {
+			ch <- m
+		}
+	}
+	for _, m := range n.keyDealMsgs {
+		if m.ValidatorIndex() != uint16(n.index) {
+			continue
+		}
+		for _, ch := range n.neighbors {
+			ch <- m
+		}
+	}
+}
+
+// saveKeyDeals persists the key deal messages of the next epoch, it does
+// nothing without a store
+func (n *Node) saveKeyDeals() error {
+	if n.store == nil {
+		return nil
+	}
+	boundary, _ := n.nextBoundary()
+	k := &keyDealState{
+		Epoch:         n.epoch + 1,
+		EnabledHeight: boundary,
+		Msgs:          make([][]byte, len(n.keyDealMsgs)),
+	}
+	for i, m := range n.keyDealMsgs {
+		k.Msgs[i] = m.ToBytes()
+	}
+	return n.store.putKeyDeals(k)
+}
+
+// restoreKeyDeals handles the key deal messages of the next epoch persisted
+// before a restart again, the ones of a passed epoch are dropped
+func (n *Node) restoreKeyDeals() error {
+	k, err := n.store.keyDeals()
+	if err != nil {
+		return fmt.Errorf("failed to load the key deals: %w", err)
+	}
+	boundary, ok := n.nextBoundary()
+	if k == nil || !ok || k.Epoch != n.epoch+1 || k.EnabledHeight != boundary {
+		return nil
+	}
+	for _, b := range k.Msgs {
+		m, err := message.BytesToPayload(b)
+		if err != nil {
+			return fmt.Errorf("failed to load the key deals: %w", err)
+		}
+		n.handleKeyDeal(m)
+	}
+	n.logRound(slog.LevelInfo, "restored key deals", "epoch", k.Epoch, "msgs", len(k.Msgs))
+	return nil
+}
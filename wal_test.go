@@ -0,0 +1,165 @@
+package dbft
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nspcc-dev/dbft/payload"
+	"github.com/nspcc-dev/neo-go/pkg/util"
+	"github.com/txhsl/dbft-anti-mev/util/message"
+	"github.com/txhsl/tpke"
+)
+
+func TestRestoreRound(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	n := NewObserver(1, nil, nil, 0, 0)
+	if err := n.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// a node stops after sending commit in view 2
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	h := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0)}
+	final := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(0), Extra: []byte{1}}
+	n.view = 2
+	n.viewLock = true
+	n.proposal = h
+	n.txList = []*types.Transaction{tx}
+	n.locked = &lockedProposal{proposal: h, txList: n.txList, header: final, final: n.txList}
+	commit := &message.Payload{
+		Message: message.Message{
+			Type:           payload.CommitType,
+			ValidatorIndex: 1,
+			BlockIndex:     1,
+			ViewNumber:     2,
+		},
+	}
+	commit.SetPayload(message.Commit{FinalHash: util.Uint256(final.Hash())})
+	n.sent = []*message.Payload{commit}
+	if err := n.saveRound(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	s.Close()
+
+	// the round is picked up after a restart
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	n = NewObserver(1, nil, nil, 0, 0)
+	if err := n.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n.view != 2 || !n.viewLock || !n.dbftFinalized {
+		t.Fatalf("round not restored")
+	}
+	if n.locked == nil || n.locked.header.Hash() != final.Hash() || n.locked.proposal.Hash() != h.Hash() {
+		t.Fatalf("lock not restored")
+	}
+	if n.proposal.Hash() != h.Hash() || len(n.legacyPool) != 1 || n.legacyPool[0].Hash() != tx.Hash() {
+		t.Fatalf("proposal not restored")
+	}
+	if len(n.sent) != 1 || n.sent[0].Type() != payload.CommitType || n.sent[0].GetCommit().FinalHash != util.Uint256(final.Hash()) {
+		t.Fatalf("sent messages not restored")
+	}
+
+	// the round is dropped once its block is stored
+	if err := s.Put(1, &Block{Header: final, Transactions: n.txList}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if r, err := s.round(); err != nil || r != nil {
+		t.Fatalf("round not dropped: %v", err)
+	}
+}
+
+func TestRestartMidView(t *testing.T) {
+	dkg := tpke.NewDKG(7, 4)
+	dkg.Prepare()
+	err := dkg.Verify()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	prvs := dkg.GetPrivateKeys()
+	globalpub := dkg.PublishGlobalPublicKey()
+	signers := newSigners(7)
+
+	dir := t.TempDir()
+	s, err := OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	nodes := make([]*Node, 7)
+	for i := 0; i < 7; i++ {
+		nodes[i] = NewNode(byte(i+1), signers[i+1], prvs[i+1], prvs[i+1].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	}
+	if err := nodes[1].SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 0; i < 7; i++ {
+		nodes[i].Connect(nodes)
+	}
+	tx := types.NewTransaction(1, ZeroAddress, big.NewInt(0), 0, big.NewInt(0), nil)
+	for i := 0; i < 7; i++ {
+		nodes[i].PendLegacyTx(tx)
+	}
+
+	// validator 2 responds and sends its shares, then stops before finalizing
+	nodes[0].Propose()
+	deliver(nodes, func(m *message.Payload) bool {
+		return m.Type() == message.FinalizeType
+	})
+	sent := make([][]byte, 0)
+	for _, m := range nodes[1].sent {
+		sent = append(sent, m.ToBytes())
+	}
+	if len(sent) != 2 {
+		t.Fatalf("unexpected messages sent before restart: %d", len(sent))
+	}
+	s.Close()
+
+	// the restarted node gets the messages of the others again
+	s, err = OpenBlockStore(dir)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	restarted := NewNode(2, signers[2], prvs[2], prvs[2].GetPublicKey(), globalpub, 0, dkg.GetScaler())
+	if err := restarted.SetBlockStore(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+	restarted.Connect(nodes)
+	for len(nodes[1].messageHandler) > 0 {
+		<-nodes[1].messageHandler
+	}
+	restarted.messageHandler = nodes[1].messageHandler
+	nodes[1] = restarted
+	for i := range nodes {
+		nodes[i].resend()
+	}
+
+	// it doesn't sign anything conflicting with the messages sent before
+	deliver(nodes, func(m *message.Payload) bool {
+		if m.ValidatorIndex() != 2 || m.Type() == payload.CommitType {
+			return false
+		}
+		for _, b := range sent {
+			if bytes.Equal(b, m.ToBytes()) {
+				return false
+			}
+		}
+		t.Fatalf("restarted node signed another %s", message.TypeName(m.Type()))
+		return true
+	})
+	for i := 0; i < 7; i++ {
+		if nodes[i].height != 1 {
+			t.Fatalf("node %d failed to commit after the restart", i)
+		}
+	}
+}